@@ -0,0 +1,206 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/s2"
+)
+
+// Compression algorithms of the TCPCompression option.
+const (
+	// TCPCompressionS2 is the S2 stream format, an extension of the Snappy
+	// framing format, which favors speed over compression ratio.
+	TCPCompressionS2 = "s2"
+	// TCPCompressionDeflate is a raw deflate stream (RFC 1951), which
+	// compresses better at a higher CPU cost.
+	TCPCompressionDeflate = "deflate"
+
+	// Size of the S2 blocks, the writer flushes a block on each write
+	// anyway, so there is no need for the 1MB default.
+	s2BlockSize = 64 * 1024
+)
+
+// CompressionStats reports the effect of websocket or TCP compression,
+// counting the bytes before and after compression.
+type CompressionStats struct {
+	InBytes            uint64
+	InCompressedBytes  uint64
+	OutBytes           uint64
+	OutCompressedBytes uint64
+}
+
+// InRatio returns the compression ratio of the received data,
+// or 0 if no compressed data was received.
+func (s CompressionStats) InRatio() float64 {
+	return compressionRatio(s.InBytes, s.InCompressedBytes)
+}
+
+// OutRatio returns the compression ratio of the sent data,
+// or 0 if no compressed data was sent.
+func (s CompressionStats) OutRatio() float64 {
+	return compressionRatio(s.OutBytes, s.OutCompressedBytes)
+}
+
+func compressionRatio(n, cn uint64) float64 {
+	if cn == 0 {
+		return 0
+	}
+	return float64(n) / float64(cn)
+}
+
+func isValidTCPCompression(algorithm string) bool {
+	return algorithm == TCPCompressionS2 || algorithm == TCPCompressionDeflate
+}
+
+// flushWriter is implemented by the S2 and flate writers.
+type flushWriter interface {
+	io.Writer
+	Flush() error
+}
+
+// compressWriter compresses the data written by the natsWriter, flushing
+// the compressor on each write so the data is sent right away.
+type compressWriter struct {
+	zw    flushWriter
+	stats *CompressionStats
+}
+
+func newCompressWriter(algorithm string, w io.Writer, stats *CompressionStats) *compressWriter {
+	cw := &countWriter{w: w, n: &stats.OutCompressedBytes}
+	var zw flushWriter
+	if algorithm == TCPCompressionS2 {
+		zw = s2.NewWriter(cw, s2.WriterConcurrency(1), s2.WriterBlockSize(s2BlockSize))
+	} else {
+		zw, _ = flate.NewWriter(cw, flate.BestSpeed)
+	}
+	return &compressWriter{zw: zw, stats: stats}
+}
+
+func (w *compressWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		if _, err := w.zw.Write(p); err != nil {
+			return 0, err
+		}
+	}
+	if err := w.zw.Flush(); err != nil {
+		return 0, err
+	}
+	atomic.AddUint64(&w.stats.OutBytes, uint64(len(p)))
+	return len(p), nil
+}
+
+// decompressReader decompresses the data read by the natsReader.
+type decompressReader struct {
+	zr    io.Reader
+	stats *CompressionStats
+}
+
+func newDecompressReader(algorithm string, r io.Reader, stats *CompressionStats) *decompressReader {
+	cr := &countReader{r: r, n: &stats.InCompressedBytes}
+	var zr io.Reader
+	if algorithm == TCPCompressionS2 {
+		zr = s2.NewReader(cr)
+	} else {
+		zr = flate.NewReader(cr)
+	}
+	return &decompressReader{zr: zr, stats: stats}
+}
+
+func (r *decompressReader) Read(p []byte) (int, error) {
+	n, err := r.zr.Read(p)
+	atomic.AddUint64(&r.stats.InBytes, uint64(n))
+	return n, err
+}
+
+type countWriter struct {
+	w io.Writer
+	n *uint64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	atomic.AddUint64(w.n, uint64(n))
+	return n, err
+}
+
+type countReader struct {
+	r io.Reader
+	n *uint64
+}
+
+func (r *countReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddUint64(r.n, uint64(n))
+	return n, err
+}
+
+// tcpCompressionToNegotiate returns the algorithm of the TCPCompression
+// option if the server advertised it in its INFO, so that it is used
+// after the CONNECT protocol.
+func (nc *Conn) tcpCompressionToNegotiate() string {
+	algorithm := nc.Opts.TCPCompression
+	if algorithm == _EMPTY_ || nc.Opts.TCPCompressionForced || nc.tc.framed() {
+		return _EMPTY_
+	}
+	for _, a := range nc.info.Compression {
+		if a == algorithm {
+			return a
+		}
+	}
+	return _EMPTY_
+}
+
+// bindCompression wraps the reader and writer of the connection with the
+// given compression algorithm. Data already buffered by the reader is
+// decompressed first.
+func (nc *Conn) bindCompression(algorithm string) {
+	if nc.cstats == nil {
+		nc.cstats = &CompressionStats{}
+	}
+	br, bw := nc.br, nc.bw
+	r := br.r
+	if br.off >= 0 {
+		buffered := append([]byte(nil), br.buf[br.off:br.n]...)
+		r = io.MultiReader(bytes.NewReader(buffered), r)
+		br.off = -1
+	}
+	br.r = newDecompressReader(algorithm, r, nc.cstats)
+	bw.w = newCompressWriter(algorithm, bw.w, nc.cstats)
+}
+
+// CompressionStats returns the compression statistics of the connection,
+// accumulated across reconnects. They are zero if the connection does not
+// use websocket or TCP compression.
+func (nc *Conn) CompressionStats() CompressionStats {
+	if nc == nil {
+		return CompressionStats{}
+	}
+	nc.mu.RLock()
+	stats := nc.cstats
+	nc.mu.RUnlock()
+	if stats == nil {
+		return CompressionStats{}
+	}
+	return CompressionStats{
+		InBytes:            atomic.LoadUint64(&stats.InBytes),
+		InCompressedBytes:  atomic.LoadUint64(&stats.InCompressedBytes),
+		OutBytes:           atomic.LoadUint64(&stats.OutBytes),
+		OutCompressedBytes: atomic.LoadUint64(&stats.OutCompressedBytes),
+	}
+}
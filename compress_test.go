@@ -0,0 +1,307 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCompressionProxy sits in front of a server and compresses the
+// traffic with the clients. In negotiated mode, it advertises the algorithm
+// in the INFO and compresses after the CONNECT if the client asked for it,
+// otherwise it compresses from the start.
+type testCompressionProxy struct {
+	l          net.Listener
+	srv        string
+	algorithm  string
+	negotiated bool
+	mu         sync.Mutex
+	connects   []string
+	conns      []net.Conn
+}
+
+func newTestCompressionProxy(t testing.TB, srv, algorithm string, negotiated bool) *testCompressionProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	p := &testCompressionProxy{l: l, srv: srv, algorithm: algorithm, negotiated: negotiated}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(c)
+		}
+	}()
+	return p
+}
+
+func (p *testCompressionProxy) url() string {
+	return "nats://" + p.l.Addr().String()
+}
+
+func (p *testCompressionProxy) close() {
+	p.l.Close()
+	p.mu.Lock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.mu.Unlock()
+}
+
+func (p *testCompressionProxy) lastConnect() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.connects) == 0 {
+		return _EMPTY_
+	}
+	return p.connects[len(p.connects)-1]
+}
+
+func (p *testCompressionProxy) handle(c net.Conn) {
+	sc, err := net.Dial("tcp", p.srv)
+	if err != nil {
+		c.Close()
+		return
+	}
+	p.mu.Lock()
+	p.conns = append(p.conns, c, sc)
+	p.mu.Unlock()
+	defer c.Close()
+	defer sc.Close()
+
+	var cr io.Reader = c
+	var sr io.Reader = sc
+	compress := !p.negotiated
+	if p.negotiated {
+		sbr, cbr := bufio.NewReader(sc), bufio.NewReader(c)
+		info, err := sbr.ReadString('\n')
+		if err != nil {
+			return
+		}
+		info = strings.Replace(info, "{", fmt.Sprintf(`{"compression":["%s"],`, p.algorithm), 1)
+		if _, err := c.Write([]byte(info)); err != nil {
+			return
+		}
+		connect, err := cbr.ReadString('\n')
+		if err != nil {
+			return
+		}
+		p.mu.Lock()
+		p.connects = append(p.connects, connect)
+		p.mu.Unlock()
+		if _, err := sc.Write([]byte(connect)); err != nil {
+			return
+		}
+		compress = strings.Contains(connect, fmt.Sprintf(`"compression":"%s"`, p.algorithm))
+		cr, sr = cbr, sbr
+	}
+	var cw io.Writer = c
+	if compress {
+		stats := &CompressionStats{}
+		cr = newDecompressReader(p.algorithm, cr, stats)
+		cw = newCompressWriter(p.algorithm, c, stats)
+	}
+	go io.Copy(sc, cr)
+	buf := make([]byte, 32768)
+	for {
+		n, err := sr.Read(buf)
+		if n > 0 {
+			if _, err := cw.Write(buf[:n]); err != nil {
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func testCompressionPubSub(t *testing.T, nc *Conn) {
+	t.Helper()
+	sub, err := nc.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	msg := bytes.Repeat([]byte(`{"sensor":"temperature","value":21.5},`), 50)
+	for i := 0; i < 20; i++ {
+		if err := nc.Publish("foo", msg); err != nil {
+			t.Fatalf("Error on publish: %v", err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		m, err := sub.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatalf("Error getting message %d: %v", i, err)
+		}
+		if !bytes.Equal(m.Data, msg) {
+			t.Fatalf("Unexpected message %d: %q", i, m.Data)
+		}
+	}
+}
+
+func TestTCPCompression(t *testing.T) {
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	for _, algorithm := range []string{TCPCompressionS2, TCPCompressionDeflate} {
+		t.Run(algorithm, func(t *testing.T) {
+			t.Run("negotiated", func(t *testing.T) {
+				p := newTestCompressionProxy(t, s.Addr().String(), algorithm, true)
+				defer p.close()
+
+				rch := make(chan bool, 1)
+				nc, err := Connect(p.url(), TCPCompression(algorithm),
+					ReconnectWait(50*time.Millisecond),
+					ReconnectHandler(func(_ *Conn) { rch <- true }))
+				if err != nil {
+					t.Fatalf("Error on connect: %v", err)
+				}
+				defer nc.Close()
+				if c := p.lastConnect(); !strings.Contains(c, `"compression":"`+algorithm+`"`) {
+					t.Fatalf("Compression not requested in CONNECT: %s", c)
+				}
+				testCompressionPubSub(t, nc)
+				stats := nc.CompressionStats()
+				if stats.OutRatio() < 5 || stats.InRatio() < 5 {
+					t.Fatalf("Unexpected stats: %+v", stats)
+				}
+
+				// Compression is negotiated again on reconnect.
+				p.mu.Lock()
+				for _, c := range p.conns {
+					c.Close()
+				}
+				p.conns = nil
+				p.mu.Unlock()
+				select {
+				case <-rch:
+				case <-time.After(2 * time.Second):
+					t.Fatal("Did not reconnect")
+				}
+				testCompressionPubSub(t, nc)
+				if out := nc.CompressionStats().OutBytes; out <= stats.OutBytes {
+					t.Fatalf("Stats should have been accumulated, got %v", out)
+				}
+			})
+
+			t.Run("forced", func(t *testing.T) {
+				p := newTestCompressionProxy(t, s.Addr().String(), algorithm, false)
+				defer p.close()
+
+				nc, err := Connect(p.url(), TCPCompressionForced(algorithm))
+				if err != nil {
+					t.Fatalf("Error on connect: %v", err)
+				}
+				defer nc.Close()
+				testCompressionPubSub(t, nc)
+				if stats := nc.CompressionStats(); stats.OutRatio() < 5 || stats.InRatio() < 5 {
+					t.Fatalf("Unexpected stats: %+v", stats)
+				}
+			})
+		})
+	}
+
+	// The server does not advertise compression, so it is not used.
+	nc, err := Connect(s.ClientURL(), TCPCompression(TCPCompressionS2))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	testCompressionPubSub(t, nc)
+	if stats := nc.CompressionStats(); stats != (CompressionStats{}) {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+
+	// Not advertising another algorithm either.
+	p := newTestCompressionProxy(t, s.Addr().String(), TCPCompressionDeflate, true)
+	defer p.close()
+	nc, err = Connect(p.url(), TCPCompression(TCPCompressionS2))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	if c := p.lastConnect(); strings.Contains(c, "compression") {
+		t.Fatalf("Compression should not be requested: %s", c)
+	}
+	testCompressionPubSub(t, nc)
+
+	if _, err := Connect(s.ClientURL(), TCPCompression("lz4")); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+	if _, err := Connect(s.ClientURL(), TCPCompressionForced(TCPCompressionS2), Secure()); err != ErrCompressionWithTLS {
+		t.Fatalf("Expected %v, got %v", ErrCompressionWithTLS, err)
+	}
+}
+
+func BenchmarkTCPCompression(b *testing.B) {
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	// A typical JSON payload, compressible but not trivially so.
+	var sb strings.Builder
+	for i := 0; sb.Len() < 1024; i++ {
+		fmt.Fprintf(&sb, `{"device":"sensor-%d","temperature":%d.%d,"status":"ok"},`, i, 15+i%10, i%7)
+	}
+	msg := []byte(sb.String())
+
+	for _, algorithm := range []string{_EMPTY_, TCPCompressionS2, TCPCompressionDeflate} {
+		name := algorithm
+		if name == _EMPTY_ {
+			name = "raw"
+		}
+		b.Run(name, func(b *testing.B) {
+			url := s.ClientURL()
+			var opts []Option
+			if algorithm != _EMPTY_ {
+				p := newTestCompressionProxy(b, s.Addr().String(), algorithm, false)
+				defer p.close()
+				url = p.url()
+				opts = append(opts, TCPCompressionForced(algorithm))
+			}
+			nc, err := Connect(url, opts...)
+			if err != nil {
+				b.Fatalf("Error on connect: %v", err)
+			}
+			defer nc.Close()
+
+			b.SetBytes(int64(len(msg)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := nc.Publish("foo", msg); err != nil {
+					b.Fatalf("Error on publish: %v", err)
+				}
+			}
+			if err := nc.Flush(); err != nil {
+				b.Fatalf("Error on flush: %v", err)
+			}
+			b.StopTimer()
+			if stats := nc.CompressionStats(); stats.OutBytes > 0 {
+				b.ReportMetric(stats.OutRatio(), "ratio")
+			}
+		})
+	}
+}
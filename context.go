@@ -92,6 +92,7 @@ func (nc *Conn) oldRequestWithContext(ctx context.Context, subj string, hdr, dat
 	if err != nil {
 		return nil, err
 	}
+	setResponseSub(s)
 	s.AutoUnsubscribe(1)
 	defer s.Unsubscribe()
 
@@ -0,0 +1,184 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// EncodedKeyValue wraps a KeyValue bucket and encodes the values with an
+// Encoder, similarly to EncodedConn. The key is passed as subject to the
+// encoder.
+type EncodedKeyValue struct {
+	KV  KeyValue
+	Enc Encoder
+	typ reflect.Type
+}
+
+// NewEncodedKeyValue wraps the bucket with the registered encoder of the
+// given type. The values of the bucket have the type of v, which is only
+// used for its type, for instance Person{} or (*Person)(nil). The entries
+// of History and Watch hold pointers to values of that type.
+func NewEncodedKeyValue(kv KeyValue, encType string, v interface{}) (*EncodedKeyValue, error) {
+	if kv == nil {
+		return nil, errors.New("nats: nil KeyValue")
+	}
+	typ := reflect.TypeOf(v)
+	if typ == nil {
+		return nil, ErrInvalidArg
+	}
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	ekv := &EncodedKeyValue{KV: kv, Enc: EncoderForType(encType), typ: typ}
+	if ekv.Enc == nil {
+		return nil, fmt.Errorf("no encoder registered for '%s'", encType)
+	}
+	return ekv, nil
+}
+
+// EncodedKeyValueEntry is an entry of an EncodedKeyValue. Decoded is a
+// pointer to the decoded value, nil for delete and purge operations or if
+// the value could not be decoded, in which case Err is set.
+type EncodedKeyValueEntry struct {
+	KeyValueEntry
+	Decoded interface{}
+	Err     error
+}
+
+func (ekv *EncodedKeyValue) entry(e KeyValueEntry) *EncodedKeyValueEntry {
+	ee := &EncodedKeyValueEntry{KeyValueEntry: e}
+	if e.Operation() != KeyValuePut {
+		return ee
+	}
+	vPtr := reflect.New(ekv.typ).Interface()
+	if ee.Err = ekv.Enc.Decode(e.Key(), e.Value(), vPtr); ee.Err == nil {
+		ee.Decoded = vPtr
+	}
+	return ee
+}
+
+// Get decodes the latest value of the key into vPtr and returns its entry.
+func (ekv *EncodedKeyValue) Get(key string, vPtr interface{}) (KeyValueEntry, error) {
+	e, err := ekv.KV.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := ekv.Enc.Decode(key, e.Value(), vPtr); err != nil {
+		return e, err
+	}
+	return e, nil
+}
+
+// Put encodes and places the value for the key.
+func (ekv *EncodedKeyValue) Put(key string, v interface{}) (uint64, error) {
+	b, err := ekv.Enc.Encode(key, v)
+	if err != nil {
+		return 0, err
+	}
+	return ekv.KV.Put(key, b)
+}
+
+// Create encodes and adds the value for the key iff it does not exist.
+func (ekv *EncodedKeyValue) Create(key string, v interface{}) (uint64, error) {
+	b, err := ekv.Enc.Encode(key, v)
+	if err != nil {
+		return 0, err
+	}
+	return ekv.KV.Create(key, b)
+}
+
+// Update encodes and places the value for the key iff its latest revision
+// is last.
+func (ekv *EncodedKeyValue) Update(key string, v interface{}, last uint64) (uint64, error) {
+	b, err := ekv.Enc.Encode(key, v)
+	if err != nil {
+		return 0, err
+	}
+	return ekv.KV.Update(key, b, last)
+}
+
+// History returns all the decoded values of the key. Values that can not
+// be decoded have their entry's Err set.
+func (ekv *EncodedKeyValue) History(key string, opts ...WatchOpt) ([]*EncodedKeyValueEntry, error) {
+	entries, err := ekv.KV.History(key, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ees := make([]*EncodedKeyValueEntry, len(entries))
+	for i, e := range entries {
+		ees[i] = ekv.entry(e)
+	}
+	return ees, nil
+}
+
+// EncodedKeyWatcher is returned by EncodedKeyValue.Watch.
+type EncodedKeyWatcher struct {
+	w        KeyWatcher
+	updates  chan *EncodedKeyValueEntry
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Watch watches the keys like KeyValue.Watch, with decoded entries. Values
+// that can not be decoded are delivered with their entry's Err set, and
+// the watch goes on.
+func (ekv *EncodedKeyValue) Watch(keys string, opts ...WatchOpt) (*EncodedKeyWatcher, error) {
+	w, err := ekv.KV.Watch(keys, opts...)
+	if err != nil {
+		return nil, err
+	}
+	ew := &EncodedKeyWatcher{
+		w:       w,
+		updates: make(chan *EncodedKeyValueEntry, 256),
+		stop:    make(chan struct{}),
+	}
+	go func() {
+		defer close(ew.updates)
+		for e := range w.Updates() {
+			var ee *EncodedKeyValueEntry
+			if e != nil {
+				ee = ekv.entry(e)
+			}
+			select {
+			case ew.updates <- ee:
+			case <-ew.stop:
+				return
+			}
+		}
+	}()
+	return ew, nil
+}
+
+// Context returns the watcher context optionally provided by the
+// nats.Context option.
+func (ew *EncodedKeyWatcher) Context() context.Context {
+	return ew.w.Context()
+}
+
+// Updates returns the channel of the decoded entries. A nil entry is sent
+// when all the initial values have been received.
+func (ew *EncodedKeyWatcher) Updates() <-chan *EncodedKeyValueEntry {
+	return ew.updates
+}
+
+// Stop stops the watcher.
+func (ew *EncodedKeyWatcher) Stop() error {
+	ew.stopOnce.Do(func() { close(ew.stop) })
+	return ew.w.Stop()
+}
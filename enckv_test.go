@@ -0,0 +1,114 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"testing"
+	"time"
+)
+
+type kvPerson struct {
+	Name string
+	Age  int
+}
+
+func TestEncodedKeyValue(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "PEOPLE", History: 5})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	if _, err := NewEncodedKeyValue(kv, "unknown", kvPerson{}); err == nil {
+		t.Fatal("Expected error with unknown encoder")
+	}
+
+	for _, encType := range []string{JSON_ENCODER, GOB_ENCODER} {
+		t.Run(encType, func(t *testing.T) {
+			ekv, err := NewEncodedKeyValue(kv, encType, kvPerson{})
+			if err != nil {
+				t.Fatalf("Error creating encoded bucket: %v", err)
+			}
+			key := "person-" + encType
+			rev, err := ekv.Create(key, &kvPerson{"derek", 22})
+			if err != nil {
+				t.Fatalf("Error on create: %v", err)
+			}
+			if _, err := ekv.Create(key, &kvPerson{"derek", 22}); err == nil {
+				t.Fatal("Expected error creating an existing key")
+			}
+			if _, err := ekv.Update(key, &kvPerson{"derek", 23}, rev); err != nil {
+				t.Fatalf("Error on update: %v", err)
+			}
+			var p kvPerson
+			e, err := ekv.Get(key, &p)
+			if err != nil || p.Name != "derek" || p.Age != 23 || e.Revision() <= rev {
+				t.Fatalf("Unexpected value: %+v, %+v, %v", p, e, err)
+			}
+
+			history, err := ekv.History(key)
+			if err != nil || len(history) != 2 {
+				t.Fatalf("Unexpected history: %v, %v", history, err)
+			}
+			if p := history[0].Decoded.(*kvPerson); p.Age != 22 || history[0].Revision() != rev {
+				t.Fatalf("Unexpected entry: %+v", history[0])
+			}
+		})
+	}
+
+	// Values that can not be decoded do not stop the watch.
+	ekv, _ := NewEncodedKeyValue(kv, JSON_ENCODER, (*kvPerson)(nil))
+	w, err := ekv.Watch("watched.*")
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	defer w.Stop()
+	if e := <-w.Updates(); e != nil {
+		t.Fatalf("Expected initial marker, got %+v", e)
+	}
+	ekv.Put("watched.a", &kvPerson{"ivan", 40})
+	kv.Put("watched.b", []byte("not json"))
+	kv.Delete("watched.a")
+	ekv.Put("watched.b", &kvPerson{"wally", 30})
+
+	next := func() *EncodedKeyValueEntry {
+		t.Helper()
+		select {
+		case e := <-w.Updates():
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("Did not get the update")
+		}
+		return nil
+	}
+	if e := next(); e.Err != nil || e.Decoded.(*kvPerson).Name != "ivan" || e.Operation() != KeyValuePut {
+		t.Fatalf("Unexpected entry: %+v", e)
+	}
+	if e := next(); e.Err == nil || e.Decoded != nil || string(e.Value()) != "not json" {
+		t.Fatalf("Unexpected entry: %+v", e)
+	}
+	if e := next(); e.Err != nil || e.Decoded != nil || e.Operation() != KeyValueDelete {
+		t.Fatalf("Unexpected entry: %+v", e)
+	}
+	if e := next(); e.Err != nil || e.Decoded.(*kvPerson).Name != "wally" || e.Key() != "watched.b" {
+		t.Fatalf("Unexpected entry: %+v", e)
+	}
+	if err := w.Stop(); err != nil {
+		t.Fatalf("Error stopping watcher: %v", err)
+	}
+}
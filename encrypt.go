@@ -0,0 +1,370 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/wutianze/nats.go/subject"
+)
+
+// Headers of the encrypted messages. The payload is encrypted with a
+// random AES-256-GCM data key, which is itself encrypted with the key
+// identified by EncryptionKeyHdr and EncryptionKeyVersionHdr and carried
+// in EncryptionDataKeyHdr. The other headers are not encrypted.
+const (
+	EncryptionHdr           = "Nats-Encryption"
+	EncryptionKeyHdr        = "Nats-Encryption-Key"
+	EncryptionKeyVersionHdr = "Nats-Encryption-Key-Version"
+	EncryptionDataKeyHdr    = "Nats-Encryption-Data-Key"
+	EncryptionSenderHdr     = "Nats-Encryption-Sender"
+)
+
+const (
+	encryptionAlgAESGCM      = "aes-gcm"
+	encryptionAlgCurve       = "curve"
+	encryptionDataKeySize    = 32
+	encryptionMaxKeyIDLength = 256
+)
+
+var (
+	ErrEncryptionKeyNotFound = errors.New("nats: encryption key not found")
+	ErrDecryptionFailed      = errors.New("nats: message decryption failed")
+)
+
+// CurveKeyPair is a curve key pair used to encrypt the data keys, such as
+// the ones created by nkeys.CreateCurveKeys() in nkeys v0.4.0 and later.
+type CurveKeyPair interface {
+	PublicKey() (string, error)
+	Seal(input []byte, recipient string) ([]byte, error)
+	Open(input []byte, sender string) ([]byte, error)
+}
+
+// EncryptionKey is a key encrypting the data keys of the messages. Either
+// AES, a 16, 24 or 32 bytes AES-GCM key, or Curve must be set.
+type EncryptionKey struct {
+	// ID and Version identify the key, they are sent with the messages.
+	ID      string
+	Version uint32
+
+	// AES is a symmetric key, shared by the publishers and the subscribers.
+	AES []byte
+
+	// Curve is the key pair of the publisher when encrypting, and of the
+	// subscriber when decrypting.
+	Curve CurveKeyPair
+
+	// Recipient is the public curve key the messages are encrypted for.
+	// When empty, the public key of Curve is used, which is convenient to
+	// store data in streams that are read back by the same key holder.
+	Recipient string
+}
+
+func (k *EncryptionKey) validate() error {
+	if k.ID == _EMPTY_ || len(k.ID) > encryptionMaxKeyIDLength || containsControlChars(k.ID) {
+		return fmt.Errorf("nats: invalid encryption key ID %q", k.ID)
+	}
+	switch {
+	case k.Curve != nil && k.AES != nil:
+		return fmt.Errorf("nats: encryption key %q can not be both AES and curve", k.ID)
+	case k.Curve != nil:
+		return nil
+	case len(k.AES) == 16 || len(k.AES) == 24 || len(k.AES) == 32:
+		return nil
+	default:
+		return fmt.Errorf("nats: invalid AES encryption key %q", k.ID)
+	}
+}
+
+func containsControlChars(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < ' ' || s[i] == 0x7f {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyProvider provides the keys used to encrypt and decrypt the messages.
+type KeyProvider interface {
+	// EncryptionKey returns the key to encrypt messages with. It is called
+	// for every message, so returning a new key rotates it right away.
+	EncryptionKey() (*EncryptionKey, error)
+
+	// DecryptionKey returns the key with the given ID and version, which
+	// may no longer be the current one, or ErrEncryptionKeyNotFound.
+	DecryptionKey(id string, version uint32) (*EncryptionKey, error)
+}
+
+// KeyRing is a KeyProvider holding a set of keys, the last one added being
+// used for encryption. Keys are rotated by adding a new version, which all
+// subscribers must have before it is used by a publisher, and removing the
+// old one once the messages encrypted with it are no longer needed.
+type KeyRing struct {
+	mu      sync.RWMutex
+	current *EncryptionKey
+	keys    map[string]*EncryptionKey
+}
+
+// NewKeyRing returns a key ring with the given keys, the last one being
+// the current one.
+func NewKeyRing(keys ...*EncryptionKey) (*KeyRing, error) {
+	kr := &KeyRing{keys: make(map[string]*EncryptionKey)}
+	for _, k := range keys {
+		if err := kr.Add(k); err != nil {
+			return nil, err
+		}
+	}
+	return kr, nil
+}
+
+func keyRingID(id string, version uint32) string {
+	return id + "." + strconv.FormatUint(uint64(version), 10)
+}
+
+// Add adds the key and makes it the current one.
+func (kr *KeyRing) Add(k *EncryptionKey) error {
+	if k == nil {
+		return ErrInvalidArg
+	}
+	if err := k.validate(); err != nil {
+		return err
+	}
+	kr.mu.Lock()
+	kr.keys[keyRingID(k.ID, k.Version)] = k
+	kr.current = k
+	kr.mu.Unlock()
+	return nil
+}
+
+// Remove removes a key, so that the messages encrypted with it can no
+// longer be decrypted. The current key can not be removed.
+func (kr *KeyRing) Remove(id string, version uint32) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if c := kr.current; c != nil && c.ID == id && c.Version == version {
+		return fmt.Errorf("nats: can not remove the current encryption key")
+	}
+	rid := keyRingID(id, version)
+	if _, ok := kr.keys[rid]; !ok {
+		return ErrEncryptionKeyNotFound
+	}
+	delete(kr.keys, rid)
+	return nil
+}
+
+// EncryptionKey implements KeyProvider.
+func (kr *KeyRing) EncryptionKey() (*EncryptionKey, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	if kr.current == nil {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	return kr.current, nil
+}
+
+// DecryptionKey implements KeyProvider.
+func (kr *KeyRing) DecryptionKey(id string, version uint32) (*EncryptionKey, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	k, ok := kr.keys[keyRingID(id, version)]
+	if !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	return k, nil
+}
+
+// Encryption is an Option to encrypt the payload of the messages published
+// with Conn.PublishMsg and the JetStream publish calls, which includes the
+// KeyValue and ObjectStore puts, and to decrypt the received ones. If
+// subjects are given, only the messages published on a subject matching
+// one of them are encrypted. The messages are decrypted after the message
+// interceptors are invoked, which thus see the encrypted payloads. The
+// messages that can not be decrypted are not delivered to the subscription
+// and reported to the ErrorHandler, JetStream messages not delivered must
+// still be acknowledged to not be redelivered. Messages received without
+// their payload, such as the ones of KeyValue.Keys or headers only
+// subscriptions, are delivered with the encryption headers.
+func Encryption(kp KeyProvider, subjects ...string) Option {
+	return func(o *Options) error {
+		if kp == nil {
+			return ErrInvalidArg
+		}
+		for _, s := range subjects {
+			if !subject.IsValidSubscribe(s) {
+				return ErrBadSubject
+			}
+		}
+		o.Encryption = kp
+		o.EncryptionSubjects = subjects
+		return nil
+	}
+}
+
+func aesGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// gcmSeal encrypts data with the key, the nonce being prepended.
+func gcmSeal(key, data []byte) ([]byte, error) {
+	gcm, err := aesGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(data)+gcm.Overhead())
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(out, out, data, nil), nil
+}
+
+func gcmOpen(key, data []byte) ([]byte, error) {
+	gcm, err := aesGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, ErrDecryptionFailed
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+// encryptMsg returns a copy of the message with an encrypted payload, or
+// the message itself if it is not to be encrypted. Empty payloads, such as
+// KeyValue delete markers, and already encrypted messages are left as is.
+func (nc *Conn) encryptMsg(m *Msg) (*Msg, error) {
+	kp := nc.Opts.Encryption
+	if kp == nil || len(m.Data) == 0 || m.Header.Get(EncryptionHdr) != _EMPTY_ ||
+		!subjectMatchesAny(nc.Opts.EncryptionSubjects, m.Subject) {
+		return m, nil
+	}
+	k, err := kp.EncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	if err := k.validate(); err != nil {
+		return nil, err
+	}
+
+	dk := make([]byte, encryptionDataKeySize)
+	if _, err := rand.Read(dk); err != nil {
+		return nil, err
+	}
+	data, err := gcmSeal(dk, m.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make(Header, len(m.Header)+5)
+	for k, v := range m.Header {
+		hdr[k] = v
+	}
+	var wdk []byte
+	if k.Curve != nil {
+		pub, err := k.Curve.PublicKey()
+		if err != nil {
+			return nil, err
+		}
+		recipient := k.Recipient
+		if recipient == _EMPTY_ {
+			recipient = pub
+		}
+		if wdk, err = k.Curve.Seal(dk, recipient); err != nil {
+			return nil, err
+		}
+		hdr.Set(EncryptionHdr, encryptionAlgCurve)
+		hdr.Set(EncryptionSenderHdr, pub)
+	} else {
+		if wdk, err = gcmSeal(k.AES, dk); err != nil {
+			return nil, err
+		}
+		hdr.Set(EncryptionHdr, encryptionAlgAESGCM)
+	}
+	hdr.Set(EncryptionKeyHdr, k.ID)
+	hdr.Set(EncryptionKeyVersionHdr, strconv.FormatUint(uint64(k.Version), 10))
+	hdr.Set(EncryptionDataKeyHdr, base64.StdEncoding.EncodeToString(wdk))
+
+	return &Msg{Subject: m.Subject, Reply: m.Reply, Header: hdr, Data: data, Sub: m.Sub}, nil
+}
+
+// decryptPayload returns the decrypted payload of a message and removes
+// the encryption headers. Messages that are not encrypted, or received
+// without their payload, are returned as is.
+func (nc *Conn) decryptPayload(hdr Header, data []byte) ([]byte, error) {
+	alg := hdr.Get(EncryptionHdr)
+	kp := nc.Opts.Encryption
+	if alg == _EMPTY_ || kp == nil || len(data) == 0 || hdr.Get(MsgSize) != _EMPTY_ {
+		return data, nil
+	}
+	id := hdr.Get(EncryptionKeyHdr)
+	version, err := strconv.ParseUint(hdr.Get(EncryptionKeyVersionHdr), 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid key version", ErrDecryptionFailed)
+	}
+	wdk, err := base64.StdEncoding.DecodeString(hdr.Get(EncryptionDataKeyHdr))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid data key", ErrDecryptionFailed)
+	}
+	k, err := kp.DecryptionKey(id, uint32(version))
+	if err != nil {
+		return nil, fmt.Errorf("%w: key %q version %d: %v", ErrDecryptionFailed, id, version, err)
+	}
+
+	var dk []byte
+	switch {
+	case alg == encryptionAlgCurve && k.Curve != nil:
+		dk, err = k.Curve.Open(wdk, hdr.Get(EncryptionSenderHdr))
+	case alg == encryptionAlgAESGCM && k.AES != nil:
+		dk, err = gcmOpen(k.AES, wdk)
+	default:
+		return nil, fmt.Errorf("%w: unsupported algorithm %q for key %q", ErrDecryptionFailed, alg, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptionFailed, err)
+	}
+	if data, err = gcmOpen(dk, data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecryptionFailed, err)
+	}
+	for _, h := range []string{EncryptionHdr, EncryptionKeyHdr, EncryptionKeyVersionHdr, EncryptionDataKeyHdr, EncryptionSenderHdr} {
+		hdr.Del(h)
+	}
+	return data, nil
+}
+
+// decryptMsg decrypts a received message in place and returns whether it
+// can be delivered, reporting the ones that can not be decrypted.
+func (nc *Conn) decryptMsg(sub *Subscription, m *Msg) bool {
+	data, err := nc.decryptPayload(m.Header, m.Data)
+	if err == nil {
+		m.Data = data
+		return true
+	}
+	nc.mu.Lock()
+	if nc.Opts.AsyncErrorCB != nil {
+		nc.ach.push(func() { nc.Opts.AsyncErrorCB(nc, sub, err) })
+	}
+	nc.mu.Unlock()
+	return false
+}
@@ -0,0 +1,377 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// testCurveKeys implements CurveKeyPair with NaCl boxes, as nkeys does.
+type testCurveKeys struct {
+	pub, priv *[32]byte
+}
+
+func newTestCurveKeys(t *testing.T) *testCurveKeys {
+	t.Helper()
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	return &testCurveKeys{pub, priv}
+}
+
+func (k *testCurveKeys) PublicKey() (string, error) {
+	return hex.EncodeToString(k.pub[:]), nil
+}
+
+func decodeTestCurveKey(s string) (*[32]byte, error) {
+	var key [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(key) {
+		return nil, errors.New("invalid curve key")
+	}
+	copy(key[:], b)
+	return &key, nil
+}
+
+func (k *testCurveKeys) Seal(input []byte, recipient string) ([]byte, error) {
+	rpub, err := decodeTestCurveKey(recipient)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [24]byte
+	rand.Read(nonce[:])
+	return box.Seal(nonce[:], input, &nonce, rpub, k.priv), nil
+}
+
+func (k *testCurveKeys) Open(input []byte, sender string) ([]byte, error) {
+	spub, err := decodeTestCurveKey(sender)
+	if err != nil {
+		return nil, err
+	}
+	if len(input) < 24 {
+		return nil, errors.New("invalid sealed data")
+	}
+	var nonce [24]byte
+	copy(nonce[:], input)
+	out, ok := box.Open(nil, input[24:], &nonce, spub, k.priv)
+	if !ok {
+		return nil, errors.New("could not open sealed data")
+	}
+	return out, nil
+}
+
+func testAESKey(id string, version uint32) *EncryptionKey {
+	k := &EncryptionKey{ID: id, Version: version, AES: make([]byte, 32)}
+	rand.Read(k.AES)
+	return k
+}
+
+func TestEncryptionPubSub(t *testing.T) {
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	kr, err := NewKeyRing(testAESKey("orders", 1))
+	if err != nil {
+		t.Fatalf("Error creating key ring: %v", err)
+	}
+	errCh := make(chan error, 10)
+	nc, err := Connect(s.ClientURL(), Encryption(kr, "orders.>"),
+		ErrorHandler(func(_ *Conn, _ *Subscription, err error) { errCh <- err }))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// A connection without the keys sees the encrypted payloads.
+	raw, err := Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer raw.Close()
+	rsub, err := raw.SubscribeSync(">")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	raw.Flush()
+
+	sub, err := nc.SubscribeSync(">")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	msg := NewMsg("orders.new")
+	msg.Header.Set("Id", "1")
+	msg.Data = []byte("secret order")
+	if err := nc.PublishMsg(msg); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	// The message is not modified.
+	if msg.Header.Get(EncryptionHdr) != _EMPTY_ || string(msg.Data) != "secret order" {
+		t.Fatalf("Published message was modified: %+v", msg)
+	}
+	// Not matching the subjects.
+	if err := nc.PublishMsg(&Msg{Subject: "public", Data: []byte("hello")}); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+
+	enc, err := rsub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error getting message: %v", err)
+	}
+	if bytes.Contains(enc.Data, []byte("secret")) || enc.Header.Get("Id") != "1" ||
+		enc.Header.Get(EncryptionKeyHdr) != "orders" || enc.Header.Get(EncryptionKeyVersionHdr) != "1" {
+		t.Fatalf("Unexpected encrypted message: %+v", enc)
+	}
+	if m, err := rsub.NextMsg(time.Second); err != nil || string(m.Data) != "hello" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+	m, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error getting message: %v", err)
+	}
+	if string(m.Data) != "secret order" || m.Header.Get("Id") != "1" || m.Header.Get(EncryptionHdr) != _EMPTY_ {
+		t.Fatalf("Unexpected decrypted message: %+v", m)
+	}
+	if m, err := sub.NextMsg(time.Second); err != nil || string(m.Data) != "hello" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+
+	// Rotation: messages encrypted with the previous key can still be
+	// decrypted until it is removed.
+	if err := kr.Add(testAESKey("orders", 2)); err != nil {
+		t.Fatalf("Error adding key: %v", err)
+	}
+	nc.PublishMsg(&Msg{Subject: "orders.new", Data: []byte("order 2")})
+	if m, err := rsub.NextMsg(time.Second); err != nil || m.Header.Get(EncryptionKeyVersionHdr) != "2" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+	if m, err := sub.NextMsg(time.Second); err != nil || string(m.Data) != "order 2" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+	enc.Sub = nil
+	if err := raw.PublishMsg(enc); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if m, err := sub.NextMsg(time.Second); err != nil || string(m.Data) != "secret order" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+	if err := kr.Remove("orders", 2); err == nil {
+		t.Fatal("Expected error removing the current key")
+	}
+	if err := kr.Remove("orders", 1); err != nil {
+		t.Fatalf("Error removing key: %v", err)
+	}
+	// The message encrypted with version 1 is not delivered.
+	if err := raw.PublishMsg(enc); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if m, err := sub.NextMsg(100 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("Expected %v, got %+v, %v", ErrTimeout, m, err)
+	}
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, ErrDecryptionFailed) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Decryption error not reported")
+	}
+
+	if _, err := Connect(s.ClientURL(), Encryption(nil)); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+	if _, err := NewKeyRing(&EncryptionKey{ID: "bad", AES: []byte("short")}); err == nil {
+		t.Fatal("Expected error with invalid AES key")
+	}
+}
+
+func TestEncryptionCurveKeys(t *testing.T) {
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	pubKeys, subKeys := newTestCurveKeys(t), newTestCurveKeys(t)
+	recipient, _ := subKeys.PublicKey()
+	pkr, _ := NewKeyRing(&EncryptionKey{ID: "curve", Curve: pubKeys, Recipient: recipient})
+	skr, _ := NewKeyRing(&EncryptionKey{ID: "curve", Curve: subKeys})
+
+	pnc, err := Connect(s.ClientURL(), Encryption(pkr))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer pnc.Close()
+	snc, err := Connect(s.ClientURL(), Encryption(skr))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer snc.Close()
+
+	sub, err := snc.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	snc.Flush()
+	if err := pnc.PublishMsg(&Msg{Subject: "foo", Data: []byte("for your eyes only")}); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if m, err := sub.NextMsg(time.Second); err != nil || string(m.Data) != "for your eyes only" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+}
+
+func TestEncryptionJetStream(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	kr, _ := NewKeyRing(testAESKey("data", 1))
+	errCh := make(chan error, 10)
+	nc, js := jsClient(t, s, Encryption(kr),
+		ErrorHandler(func(_ *Conn, _ *Subscription, err error) { errCh <- err }))
+	defer nc.Close()
+
+	if _, err := js.AddStream(&StreamConfig{Name: "ORDERS", Subjects: []string{"orders"}}); err != nil {
+		t.Fatalf("Error adding stream: %v", err)
+	}
+	if _, err := js.Publish("orders", []byte("order 1"), MsgId("1")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	paf, err := js.PublishAsync("orders", []byte("order 2"))
+	if err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	select {
+	case <-paf.Ok():
+	case err := <-paf.Err():
+		t.Fatalf("Error on publish: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Did not get the ack")
+	}
+
+	// Stored encrypted, with the other headers kept.
+	raw, err := Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer raw.Close()
+	rjs, _ := raw.JetStream()
+	rm, err := rjs.GetMsg("ORDERS", 1)
+	if err != nil {
+		t.Fatalf("Error getting message: %v", err)
+	}
+	if bytes.Contains(rm.Data, []byte("order")) || rm.Header.Get(MsgIdHdr) != "1" {
+		t.Fatalf("Unexpected stored message: %+v", rm)
+	}
+
+	if rm, err := js.GetMsg("ORDERS", 1); err != nil || string(rm.Data) != "order 1" {
+		t.Fatalf("Unexpected message: %+v, %v", rm, err)
+	}
+	sub, err := js.SubscribeSync("orders")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	for _, data := range []string{"order 1", "order 2"} {
+		if m, err := sub.NextMsg(time.Second); err != nil || string(m.Data) != data {
+			t.Fatalf("Unexpected message: %+v, %v", m, err)
+		}
+	}
+
+	// KeyValue
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "CONFIG", History: 5})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	if _, err := kv.Put("password", []byte("hunter2")); err != nil {
+		t.Fatalf("Error on put: %v", err)
+	}
+	if e, err := kv.Get("password"); err != nil || string(e.Value()) != "hunter2" {
+		t.Fatalf("Unexpected entry: %+v, %v", e, err)
+	}
+	if rm, err := rjs.GetMsg("KV_CONFIG", 1); err != nil || bytes.Contains(rm.Data, []byte("hunter2")) {
+		t.Fatalf("Unexpected stored message: %+v, %v", rm, err)
+	}
+	w, err := kv.Watch("password")
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	defer w.Stop()
+	select {
+	case e := <-w.Updates():
+		if e == nil || string(e.Value()) != "hunter2" {
+			t.Fatalf("Unexpected entry: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Did not get the entry")
+	}
+	// Headers only deliveries are not decrypted.
+	if keys, err := kv.Keys(); err != nil || len(keys) != 1 || keys[0] != "password" {
+		t.Fatalf("Unexpected keys: %v, %v", keys, err)
+	}
+	mw, err := kv.Watch("password", MetaOnly())
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	defer mw.Stop()
+	select {
+	case e := <-mw.Updates():
+		if e == nil || e.Key() != "password" || len(e.Value()) != 0 {
+			t.Fatalf("Unexpected entry: %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Did not get the entry")
+	}
+	// Deletes are not encrypted.
+	if err := kv.Delete("password"); err != nil {
+		t.Fatalf("Error on delete: %v", err)
+	}
+	if _, err := kv.Get("password"); err != ErrKeyNotFound {
+		t.Fatalf("Expected %v, got %v", ErrKeyNotFound, err)
+	}
+
+	// ObjectStore
+	obs, err := js.CreateObjectStore(&ObjectStoreConfig{Bucket: "FILES"})
+	if err != nil {
+		t.Fatalf("Error creating object store: %v", err)
+	}
+	blob := make([]byte, 300*1024)
+	rand.Read(blob)
+	if _, err := obs.PutBytes("blob", blob); err != nil {
+		t.Fatalf("Error on put: %v", err)
+	}
+	data, err := obs.GetBytes("blob")
+	if err != nil {
+		t.Fatalf("Error on get: %v", err)
+	}
+	if !bytes.Equal(data, blob) {
+		t.Fatal("Object does not match")
+	}
+	// Without the keys, the object can not be read.
+	robs, err := rjs.ObjectStore("FILES")
+	if err != nil {
+		t.Fatalf("Error getting object store: %v", err)
+	}
+	if _, err := robs.GetBytes("blob"); err == nil {
+		t.Fatal("Expected error reading an encrypted object")
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	default:
+	}
+}
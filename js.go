@@ -46,6 +46,10 @@ type JetStream interface {
 	// The message should not be changed until the PubAckFuture has been processed.
 	PublishMsgAsync(m *Msg, opts ...PubOpt) (PubAckFuture, error)
 
+	// PublishBatch publishes the messages asynchronously and waits for all their
+	// PubAcks, or until the AckWait() or Context() given as options is done.
+	PublishBatch(msgs []*Msg, opts ...PubOpt) ([]*PubAck, error)
+
 	// PublishAsyncPending returns the number of async publishes outstanding for this context.
 	PublishAsyncPending() int
 
@@ -423,9 +427,12 @@ func (js *js) PublishMsg(m *Msg, opts ...PubOpt) (*PubAck, error) {
 		m.Header.Set(ExpectedLastSubjSeqHdr, strconv.FormatUint(o.lss, 10))
 	}
 
-	var resp *Msg
-	var err error
+	m, err := js.nc.secureMsg(m)
+	if err != nil {
+		return nil, err
+	}
 
+	var resp *Msg
 	if o.ttl > 0 {
 		resp, err = js.nc.RequestMsg(m, time.Duration(o.ttl))
 	} else {
@@ -467,7 +474,7 @@ func (js *js) PublishMsg(m *Msg, opts ...PubOpt) (*PubAck, error) {
 		return nil, ErrInvalidJSAck
 	}
 	if pa.Error != nil {
-		return nil, fmt.Errorf("nats: %s", pa.Error.Description)
+		return nil, pa.Error
 	}
 	if pa.PubAck == nil || pa.PubAck.Stream == _EMPTY_ {
 		return nil, ErrInvalidJSAck
@@ -475,6 +482,15 @@ func (js *js) PublishMsg(m *Msg, opts ...PubOpt) (*PubAck, error) {
 	return pa.PubAck, nil
 }
 
+// IsWrongLastSequence returns whether a publish was rejected because the
+// last sequence of the stream or of the subject was not the expected one,
+// such as a KeyValue Update of a key written in between.
+func IsWrongLastSequence(err error) bool {
+	var ae *apiError
+	// JSStreamWrongLastSequenceErr
+	return errors.As(err, &ae) && ae.ErrorCode == 10071
+}
+
 // Publish publishes a message to a stream from JetStream.
 func (js *js) Publish(subj string, data []byte, opts ...PubOpt) (*PubAck, error) {
 	return js.PublishMsg(&Msg{Subject: subj, Data: data}, opts...)
@@ -494,6 +510,7 @@ type PubAckFuture interface {
 
 type pubAckFuture struct {
 	js     *js
+	id     string
 	msg    *Msg
 	pa     *PubAck
 	st     time.Time
@@ -556,6 +573,7 @@ func (js *js) newAsyncReply() string {
 			js.mu.Unlock()
 			return _EMPTY_
 		}
+		setResponseSub(sub)
 		js.rsub = sub
 		js.rr = rand.New(rand.NewSource(time.Now().UnixNano()))
 	}
@@ -601,6 +619,40 @@ func (js *js) clearPAF(id string) {
 	js.mu.Unlock()
 }
 
+// removePAF removes a PubAckFuture, releasing the publishers stalled with
+// too many outstanding. It returns the done channel to close when none is
+// left. Lock should be held.
+func (js *js) removePAF(id string) chan struct{} {
+	delete(js.pafs, id)
+
+	// Check on anyone stalled and waiting.
+	if js.stc != nil && len(js.pafs) < js.opts.maxpa {
+		close(js.stc)
+		js.stc = nil
+	}
+	// Check on anyone one waiting on done status.
+	if js.dch != nil && len(js.pafs) == 0 {
+		dch := js.dch
+		js.dch = nil
+		return dch
+	}
+	return nil
+}
+
+// expirePAF removes a PubAckFuture no longer waited for. It returns false
+// if its reply was already processed.
+func (js *js) expirePAF(paf *pubAckFuture) bool {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.getPAF(paf.id) != paf {
+		return false
+	}
+	if dch := js.removePAF(paf.id); dch != nil {
+		close(dch)
+	}
+	return true
+}
+
 // PublishAsyncPending returns how many PubAckFutures are pending.
 func (js *js) PublishAsyncPending() int {
 	js.mu.RLock()
@@ -632,17 +684,7 @@ func (js *js) handleAsyncReply(m *Msg) {
 		return
 	}
 	// Remove
-	delete(js.pafs, id)
-
-	// Check on anyone stalled and waiting.
-	if js.stc != nil && len(js.pafs) < js.opts.maxpa {
-		close(js.stc)
-		js.stc = nil
-	}
-	// Check on anyone one waiting on done status.
-	if js.dch != nil && len(js.pafs) == 0 {
-		dch := js.dch
-		js.dch = nil
+	if dch := js.removePAF(id); dch != nil {
 		// Defer here so error is processed and can be checked.
 		defer close(dch)
 	}
@@ -671,7 +713,7 @@ func (js *js) handleAsyncReply(m *Msg) {
 		return
 	}
 	if pa.Error != nil {
-		doErr(fmt.Errorf("nats: %s", pa.Error.Description))
+		doErr(pa.Error)
 		return
 	}
 	if pa.PubAck == nil || pa.PubAck.Stream == _EMPTY_ {
@@ -735,6 +777,14 @@ func (js *js) PublishMsgAsync(m *Msg, opts ...PubOpt) (PubAckFuture, error) {
 	if o.ttl != 0 || o.ctx != nil {
 		return nil, ErrContextAndTimeout
 	}
+	paf, err := js.publishMsgAsync(m, &o)
+	if err != nil {
+		return nil, err
+	}
+	return paf, nil
+}
+
+func (js *js) publishMsgAsync(m *Msg, o *pubOpts) (*pubAckFuture, error) {
 	stallWait := defaultStallWait
 	if o.stallWait > 0 {
 		stallWait = o.stallWait
@@ -770,7 +820,7 @@ func (js *js) PublishMsgAsync(m *Msg, opts ...PubOpt) (PubAckFuture, error) {
 	}
 
 	id := m.Reply[aReplyPreLen:]
-	paf := &pubAckFuture{msg: m, st: time.Now()}
+	paf := &pubAckFuture{id: id, msg: m, st: time.Now()}
 	numPending, maxPending := js.registerPAF(id, paf)
 
 	if maxPending > 0 && numPending >= maxPending {
@@ -789,6 +839,93 @@ func (js *js) PublishMsgAsync(m *Msg, opts ...PubOpt) (PubAckFuture, error) {
 	return paf, nil
 }
 
+// PublishBatch publishes the messages asynchronously and waits for all their
+// PubAcks. The returned slice has one entry per message, which is nil for the
+// messages that failed, those being reported by index in a *PublishBatchError.
+// The options apply to every message of the batch, hence MsgId(),
+// ExpectLastMsgId(), ExpectLastSequence() and ExpectLastSequencePerSubject()
+// are rejected with ErrBatchMsgPubOpt: set the MsgIdHdr,
+// ExpectedLastMsgIdHdr, ExpectedLastSeqHdr or ExpectedLastSubjSeqHdr header
+// of each message instead. The wait is bound by the AckWait() or Context()
+// options, or the JetStream context's default wait.
+func (js *js) PublishBatch(msgs []*Msg, opts ...PubOpt) ([]*PubAck, error) {
+	var o pubOpts
+	for _, opt := range opts {
+		if err := opt.configurePublish(&o); err != nil {
+			return nil, err
+		}
+	}
+	if o.ctx != nil && o.ttl != 0 {
+		return nil, ErrContextAndTimeout
+	}
+	if o.id != _EMPTY_ || o.lid != _EMPTY_ || o.seq > 0 || o.lss > 0 {
+		return nil, ErrBatchMsgPubOpt
+	}
+	ctx, ttl := o.ctx, o.ttl
+	if ctx == nil {
+		if ttl == 0 {
+			ttl = js.opts.wait
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(context.Background(), ttl)
+		defer cancel()
+	}
+
+	// Publish all messages without waiting, unless stalled with too
+	// many outstanding acks, in which case wait up to the deadline.
+	o.ctx, o.ttl = nil, 0
+	if deadline, ok := ctx.Deadline(); ok && o.stallWait == 0 {
+		o.stallWait = time.Until(deadline)
+	}
+	pafs := make([]*pubAckFuture, len(msgs))
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		if m == nil {
+			errs[i] = ErrInvalidMsg
+			continue
+		}
+		// Options set headers, on a copy of the message.
+		if o.str != _EMPTY_ {
+			cm := *m
+			cm.Header = make(Header, len(m.Header)+1)
+			for k, v := range m.Header {
+				cm.Header[k] = v
+			}
+			m = &cm
+		}
+		pafs[i], errs[i] = js.publishMsgAsync(m, &o)
+	}
+
+	acks := make([]*PubAck, len(msgs))
+	for i, paf := range pafs {
+		if paf == nil {
+			continue
+		}
+		select {
+		case pa := <-paf.Ok():
+			acks[i] = pa
+		case err := <-paf.Err():
+			errs[i] = err
+		case <-ctx.Done():
+			// The reply may have been processed along with the
+			// deadline, otherwise it is no longer waited for.
+			if !js.expirePAF(paf) {
+				select {
+				case pa := <-paf.Ok():
+					acks[i] = pa
+				case err := <-paf.Err():
+					errs[i] = err
+				}
+			} else if ttl > 0 {
+				errs[i] = ErrTimeout
+			} else {
+				errs[i] = ctx.Err()
+			}
+		}
+	}
+	return acks, newPublishBatchError(errs)
+}
+
 // PublishAsyncComplete returns a channel that will be closed when all outstanding messages have been ack'd.
 func (js *js) PublishAsyncComplete() <-chan struct{} {
 	js.mu.Lock()
@@ -18,6 +18,7 @@ package nats
 ////////////////////////////////////////////////////////////////////////////////
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
@@ -939,3 +940,139 @@ func TestJetStreamExpiredPullRequests(t *testing.T) {
 		}
 	}
 }
+
+func TestJetStreamPublishBatch(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	if _, err := js.AddStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo.*"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var msgs []*Msg
+	for i := 0; i < 10; i++ {
+		msgs = append(msgs, &Msg{Subject: fmt.Sprintf("foo.%d", i), Data: []byte("ok")})
+	}
+	// This one will be rejected by the stream.
+	bad := NewMsg("foo.bad")
+	bad.Header.Set(ExpectedStreamHdr, "OTHER")
+	msgs = append(msgs, bad)
+
+	acks, err := js.PublishBatch(msgs, AckWait(2*time.Second))
+	berr, ok := err.(*PublishBatchError)
+	if !ok {
+		t.Fatalf("Expected a PublishBatchError, got %v", err)
+	}
+	if len(berr.Errors) != 1 || berr.Errors[0].Index != 10 || berr.Errors[0].Err == nil {
+		t.Fatalf("Unexpected errors: %+v", berr.Errors)
+	}
+	if len(acks) != len(msgs) {
+		t.Fatalf("Expected %d acks, got %d", len(msgs), len(acks))
+	}
+	for i, pa := range acks[:10] {
+		if pa == nil || pa.Stream != "TEST" || pa.Sequence != uint64(i+1) {
+			t.Fatalf("Bad PubAck at %d: %+v", i, pa)
+		}
+	}
+	if acks[10] != nil {
+		t.Fatalf("Expected no PubAck for failed message, got %+v", acks[10])
+	}
+
+	// Using a context.
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if _, err := js.PublishBatch(msgs[:10], Context(ctx), AckWait(time.Second)); err != ErrContextAndTimeout {
+		t.Fatalf("Expected ErrContextAndTimeout, got %v", err)
+	}
+	acks, err = js.PublishBatch(msgs[:10], Context(ctx), ExpectStream("TEST"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if acks[9] == nil || acks[9].Sequence != 20 {
+		t.Fatalf("Bad PubAck: %+v", acks[9])
+	}
+	if msgs[0].Header != nil {
+		t.Fatalf("Message should not be modified: %+v", msgs[0].Header)
+	}
+
+	// Acks not received in time are no longer pending.
+	if _, err := nc.SubscribeSync("bar"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err = js.PublishBatch([]*Msg{NewMsg("bar"), NewMsg("bar")}, AckWait(100*time.Millisecond))
+	if berr, ok := err.(*PublishBatchError); !ok || len(berr.Errors) != 2 || berr.Errors[0].Err != ErrTimeout {
+		t.Fatalf("Expected timeouts, got %v", err)
+	}
+	if n := js.PublishAsyncPending(); n != 0 {
+		t.Fatalf("Expected no pending acks, got %d", n)
+	}
+	select {
+	case <-js.PublishAsyncComplete():
+	case <-time.After(time.Second):
+		t.Fatal("Expected publishes to be complete")
+	}
+
+	// Options for a single message are rejected, headers are used instead.
+	for _, opt := range []PubOpt{MsgId("1"), ExpectLastMsgId("1"), ExpectLastSequence(1), ExpectLastSequencePerSubject(1)} {
+		if _, err := js.PublishBatch(msgs[:1], opt); err != ErrBatchMsgPubOpt {
+			t.Fatalf("Expected %v, got %v", ErrBatchMsgPubOpt, err)
+		}
+	}
+	msgs = nil
+	for i, id := range []string{"a", "b", "a"} {
+		m := NewMsg(fmt.Sprintf("foo.%d", i))
+		m.Header.Set(MsgIdHdr, id)
+		msgs = append(msgs, m)
+	}
+	m := NewMsg("foo.0")
+	m.Header.Set(ExpectedLastSubjSeqHdr, "21")
+	msgs = append(msgs, m)
+	acks, err = js.PublishBatch(msgs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if acks[0].Duplicate || acks[1].Duplicate || !acks[2].Duplicate || acks[3].Sequence != 23 {
+		t.Fatalf("Unexpected acks: %+v, %+v, %+v, %+v", acks[0], acks[1], acks[2], acks[3])
+	}
+}
+
+func TestJetStreamWrongLastSequence(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	if _, err := js.AddStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := js.Publish("foo", []byte("1")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	_, err := js.Publish("foo", []byte("2"), ExpectLastSequence(2))
+	if !IsWrongLastSequence(err) || err.Error() != "nats: wrong last sequence: 1" {
+		t.Fatalf("Expected wrong last sequence error, got %v", err)
+	}
+	paf, err := js.PublishAsync("foo", []byte("2"), ExpectLastSequencePerSubject(2))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	select {
+	case err := <-paf.Err():
+		if !IsWrongLastSequence(err) {
+			t.Fatalf("Expected wrong last sequence error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Did not get the error")
+	}
+	_, err = js.Publish("foo", []byte("2"), ExpectLastMsgId("1"))
+	if err == nil || IsWrongLastSequence(err) {
+		t.Fatalf("Expected wrong last message id error, got %v", err)
+	}
+	if IsWrongLastSequence(nil) || IsWrongLastSequence(ErrTimeout) {
+		t.Fatal("Unexpected wrong last sequence error")
+	}
+}
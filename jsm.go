@@ -115,6 +115,19 @@ type StreamSource struct {
 	OptStartTime  *time.Time      `json:"opt_start_time,omitempty"`
 	FilterSubject string          `json:"filter_subject,omitempty"`
 	External      *ExternalStream `json:"external,omitempty"`
+	// SubjectTransforms change the subjects of the messages sourced,
+	// which requires server version 2.10.0 or later.
+	SubjectTransforms []SubjectTransformConfig `json:"subject_transforms,omitempty"`
+	// Domain is the JetStream domain of the stream, a shorthand for an
+	// External stream with the API prefix of the domain.
+	Domain string `json:"-"`
+}
+
+// SubjectTransformConfig transforms the subjects matching Source into
+// Destination, which can reference the wildcards of Source.
+type SubjectTransformConfig struct {
+	Source      string `json:"src"`
+	Destination string `json:"dest"`
 }
 
 // ExternalStream allows you to qualify access to a stream source in another
@@ -124,6 +137,37 @@ type ExternalStream struct {
 	DeliverPrefix string `json:"deliver"`
 }
 
+// withDomains returns the config with the sources having a Domain
+// converted to external sources.
+func (cfg *StreamConfig) withDomains() (*StreamConfig, error) {
+	convert := func(ss *StreamSource) (*StreamSource, error) {
+		if ss == nil || ss.Domain == _EMPTY_ {
+			return ss, nil
+		}
+		if ss.External != nil {
+			return nil, errors.New("nats: domain and external are both set")
+		}
+		c := *ss
+		c.External = &ExternalStream{APIPrefix: strings.TrimSuffix(fmt.Sprintf(jsDomainT, ss.Domain), ".")}
+		c.Domain = _EMPTY_
+		return &c, nil
+	}
+	ncfg := *cfg
+	var err error
+	if ncfg.Mirror, err = convert(cfg.Mirror); err != nil {
+		return nil, err
+	}
+	if cfg.Sources != nil {
+		ncfg.Sources = make([]*StreamSource, len(cfg.Sources))
+		for i, ss := range cfg.Sources {
+			if ncfg.Sources[i], err = convert(ss); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &ncfg, nil
+}
+
 // apiError is included in all API responses if there was an error.
 type apiError struct {
 	Code        int    `json:"code"`
@@ -131,6 +175,10 @@ type apiError struct {
 	Description string `json:"description,omitempty"`
 }
 
+func (e *apiError) Error() string {
+	return fmt.Sprintf("nats: %s", e.Description)
+}
+
 // apiResponse is a standard response from the JetStream JSON API
 type apiResponse struct {
 	Type  string    `json:"type"`
@@ -572,7 +620,11 @@ func (js *js) AddStream(cfg *StreamConfig, opts ...JSOpt) (*StreamInfo, error) {
 		return nil, ErrInvalidStreamName
 	}
 
-	req, err := json.Marshal(cfg)
+	ncfg, err := cfg.withDomains()
+	if err != nil {
+		return nil, err
+	}
+	req, err := json.Marshal(ncfg)
 	if err != nil {
 		return nil, err
 	}
@@ -690,7 +742,11 @@ func (js *js) UpdateStream(cfg *StreamConfig, opts ...JSOpt) (*StreamInfo, error
 		return nil, ErrStreamNameRequired
 	}
 
-	req, err := json.Marshal(cfg)
+	ncfg, err := cfg.withDomains()
+	if err != nil {
+		return nil, err
+	}
+	req, err := json.Marshal(ncfg)
 	if err != nil {
 		return nil, err
 	}
@@ -833,12 +889,19 @@ func (js *js) getMsg(name string, mreq *apiMsgGetRequest, opts ...JSOpt) (*RawSt
 			return nil, err
 		}
 	}
+	if err := js.nc.verifyMsg(msg.Subject, hdr, msg.Data); err != nil {
+		return nil, err
+	}
+	data, err := js.nc.decryptPayload(hdr, msg.Data)
+	if err != nil {
+		return nil, err
+	}
 
 	return &RawStreamMsg{
 		Subject:  msg.Subject,
 		Sequence: msg.Sequence,
 		Header:   hdr,
-		Data:     msg.Data,
+		Data:     data,
 		Time:     msg.Time,
 	}, nil
 }
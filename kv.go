@@ -17,6 +17,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"regexp"
 	"strconv"
@@ -35,6 +36,8 @@ type KeyValueManager interface {
 	CreateKeyValue(cfg *KeyValueConfig) (KeyValue, error)
 	// DeleteKeyValue will delete this KeyValue store (JetStream stream).
 	DeleteKeyValue(bucket string) error
+	// RestoreKeyValue will create a KeyValue store from a snapshot.
+	RestoreKeyValue(r io.Reader, opts ...RestoreOpt) (KeyValue, error)
 }
 
 // Notice: Experimental Preview
@@ -62,6 +65,8 @@ type KeyValue interface {
 	Watch(keys string, opts ...WatchOpt) (KeyWatcher, error)
 	// WatchAll will invoke the callback for all updates.
 	WatchAll(opts ...WatchOpt) (KeyWatcher, error)
+	// DeleteWatcher removes a durable watcher.
+	DeleteWatcher(name string) error
 	// Keys will return all keys.
 	Keys(opts ...WatchOpt) ([]string, error)
 	// History will return all historical values for the key.
@@ -72,6 +77,28 @@ type KeyValue interface {
 	PurgeDeletes(opts ...PurgeOpt) error
 	// Status retrieves the status and configuration of a bucket
 	Status() (KeyValueStatus, error)
+	// Txn returns a transaction to update several keys atomically.
+	Txn() KeyValueTxn
+	// RecoverTxns completes the transactions of crashed clients.
+	RecoverTxns(olderThan time.Duration) error
+	// PutWithTTL will place the new value for the key, which expires after ttl.
+	PutWithTTL(key string, value []byte, ttl time.Duration) (revision uint64, err error)
+	// ReapExpired places expired markers for the keys past their TTL.
+	ReapExpired() (reaped int, err error)
+	// Increment adds delta to the numeric value of the key.
+	Increment(key string, delta int64) (value int64, err error)
+	// Decrement subtracts delta from the numeric value of the key.
+	Decrement(key string, delta int64) (value int64, err error)
+	// Min sets the numeric value of the key to value if lower.
+	Min(key string, value int64) (int64, error)
+	// Max sets the numeric value of the key to value if greater.
+	Max(key string, value int64) (int64, error)
+	// SetIfGreater sets the numeric value of the key to value if greater.
+	SetIfGreater(key string, value int64) (set bool, err error)
+	// Snapshot writes an export of the bucket, including history.
+	Snapshot(w io.Writer) error
+	// List returns the keys starting with prefix, page by page.
+	List(prefix string, opts ...ListOpt) (KeyLister, error)
 }
 
 // KeyValueStatus is run-time status about a Key-Value bucket
@@ -120,6 +147,14 @@ type watchOpts struct {
 	includeHistory bool
 	// retrieve only the meta data of the entry
 	metaOnly bool
+	// Include the keys used internally by the client.
+	includeReserved bool
+	// Deliver the updates from this revision, included.
+	resumeFromRevision uint64
+	// Name of the durable consumer of a durable watcher.
+	durable string
+	// Resolve the initial values written by uncommitted transactions.
+	committed bool
 }
 
 type watchOptFn func(opts *watchOpts) error
@@ -128,6 +163,15 @@ func (opt watchOptFn) configureWatcher(opts *watchOpts) error {
 	return opt(opts)
 }
 
+// committedState resolves the initial values written by uncommitted
+// transactions, for the readers of the committed state of the bucket.
+func committedState() WatchOpt {
+	return watchOptFn(func(opts *watchOpts) error {
+		opts.committed = true
+		return nil
+	})
+}
+
 // IncludeHistory instructs the key watcher to include historical values as well.
 func IncludeHistory() WatchOpt {
 	return watchOptFn(func(opts *watchOpts) error {
@@ -152,6 +196,44 @@ func MetaOnly() WatchOpt {
 	})
 }
 
+// ResumeFromRevision instructs the key watcher to deliver all the updates
+// from the given revision included, instead of the latest values.
+func ResumeFromRevision(revision uint64) WatchOpt {
+	return watchOptFn(func(opts *watchOpts) error {
+		if revision == 0 {
+			return ErrInvalidArg
+		}
+		opts.resumeFromRevision = revision
+		return nil
+	})
+}
+
+// DurableWatcher makes the key watcher durable under the given name. The
+// position of a durable watcher is kept by the server, so that a watcher
+// of the same name resumes with the first update not read from Updates by
+// the previous one, and its initial values are the updates missed since.
+// The other options only apply when the watcher is first created.
+//
+// An update is acknowledged when the next one is read from Updates, or
+// when the watcher is stopped, so that an update is only done once the
+// reader is back for more. Should the client stop without calling Stop,
+// the update being read is delivered again, once the ack wait of the
+// consumer expired. Durable watchers are removed with DeleteWatcher.
+//
+// At most two updates are in flight and they are acknowledged
+// synchronously, which limits a durable watcher to about one update per
+// round trip to the server; watchers of busy buckets should not be
+// durable.
+func DurableWatcher(name string) WatchOpt {
+	return watchOptFn(func(opts *watchOpts) error {
+		if name == _EMPTY_ || checkDurName(name) != nil {
+			return ErrInvalidDurableName
+		}
+		opts.durable = name
+		return nil
+	})
+}
+
 type PurgeOpt interface {
 	configurePurge(opts *purgeOpts) error
 }
@@ -191,6 +273,14 @@ type KeyValueConfig struct {
 	Storage      StorageType
 	Replicas     int
 	Placement    *Placement
+	// Mirror makes the bucket a read-only mirror of the bucket named by
+	// the source, which can be in another domain.
+	Mirror *StreamSource
+	// Sources merge the buckets they name into the bucket. Their values
+	// are stored under the keys of the bucket, with subject transforms,
+	// as if written to it, so that the latest value of a key wins. This
+	// requires server version 2.10.0 or later.
+	Sources []*StreamSource
 }
 
 // Used to watch all keys.
@@ -201,6 +291,7 @@ const (
 	kvop               = "KV-Operation"
 	kvdel              = "DEL"
 	kvpurge            = "PURGE"
+	kvexpired          = "EXPIRED"
 )
 
 type KeyValueOp uint8
@@ -209,6 +300,7 @@ const (
 	KeyValuePut KeyValueOp = iota
 	KeyValueDelete
 	KeyValuePurge
+	KeyValueExpired
 )
 
 func (op KeyValueOp) String() string {
@@ -219,6 +311,8 @@ func (op KeyValueOp) String() string {
 		return "KeyValueDeleteOp"
 	case KeyValuePurge:
 		return "KeyValuePurgeOp"
+	case KeyValueExpired:
+		return "KeyValueExpiredOp"
 	default:
 		return "Unknown Operation"
 	}
@@ -253,9 +347,11 @@ var (
 	ErrKeyDeleted             = errors.New("nats: key was deleted")
 	ErrHistoryToLarge         = errors.New("nats: history limited to a max of 64")
 	ErrNoKeysFound            = errors.New("nats: no keys found")
+	ErrKeyValueReadOnly       = errors.New("nats: key-value bucket is a read-only mirror")
 )
 
 const (
+	kvBucketNamePre   = "KV_"
 	kvBucketNameTmpl  = "KV_%s"
 	kvSubjectsTmpl    = "$KV.%s.>"
 	kvSubjectsPreTmpl = "$KV.%s."
@@ -290,15 +386,57 @@ func (js *js) KeyValue(bucket string) (KeyValue, error) {
 		return nil, ErrBadBucket
 	}
 
+	return js.bindKeyValue(bucket, &si.Config), nil
+}
+
+// bindKeyValue returns the bucket stored in the stream with the given
+// config. Mirrors keep the subjects of the bucket they mirror.
+func (js *js) bindKeyValue(bucket string, scfg *StreamConfig) *kvs {
 	kv := &kvs{
 		name:   bucket,
-		stream: stream,
+		stream: scfg.Name,
 		pre:    fmt.Sprintf(kvSubjectsPreTmpl, bucket),
 		js:     js,
 		// Determine if we need to use the JS prefix in front of Put and Delete operations
 		useJSPfx: js.opts.pre != defaultAPIPrefix,
 	}
-	return kv, nil
+	if m := scfg.Mirror; m != nil {
+		kv.pre = fmt.Sprintf(kvSubjectsPreTmpl, strings.TrimPrefix(m.Name, kvBucketNamePre))
+		kv.readOnly = true
+	}
+	return kv
+}
+
+// kvStreamSource returns a copy of the source of a bucket, naming its
+// stream.
+func kvStreamSource(ss *StreamSource) (*StreamSource, error) {
+	if ss == nil || !validBucketRe.MatchString(strings.TrimPrefix(ss.Name, kvBucketNamePre)) {
+		return nil, ErrInvalidBucketName
+	}
+	c := *ss
+	if !strings.HasPrefix(c.Name, kvBucketNamePre) {
+		c.Name = kvBucketNamePre + c.Name
+	}
+	return &c, nil
+}
+
+// kvStreamSources returns the sources of the bucket, which transform the
+// subjects of their values into the subjects of the bucket.
+func kvStreamSources(bucket string, sources []*StreamSource) ([]*StreamSource, error) {
+	var scs []*StreamSource
+	for _, ss := range sources {
+		s, err := kvStreamSource(ss)
+		if err != nil {
+			return nil, err
+		}
+		src := strings.TrimPrefix(s.Name, kvBucketNamePre)
+		s.SubjectTransforms = []SubjectTransformConfig{{
+			Source:      fmt.Sprintf(kvSubjectsTmpl, src),
+			Destination: fmt.Sprintf(kvSubjectsTmpl, bucket),
+		}}
+		scs = append(scs, s)
+	}
+	return scs, nil
 }
 
 // CreateKeyValue will create a KeyValue store with the following configuration.
@@ -366,6 +504,25 @@ func (js *js) CreateKeyValue(cfg *KeyValueConfig) (KeyValue, error) {
 		MaxMsgs:           -1,
 		MaxConsumers:      -1,
 	}
+	if cfg.Mirror != nil {
+		if len(cfg.Sources) > 0 {
+			return nil, errors.New("nats: a bucket can not have both a mirror and sources")
+		}
+		m, err := kvStreamSource(cfg.Mirror)
+		if err != nil {
+			return nil, err
+		}
+		// Mirrors have no subjects of their own.
+		scfg.Mirror, scfg.Subjects, scfg.Duplicates = m, nil, 0
+	}
+	if len(cfg.Sources) > 0 && !js.nc.serverMinVersion(2, 10, 0) {
+		return nil, errors.New("nats: key-value sources require at least server version 2.10.0")
+	}
+	sources, err := kvStreamSources(cfg.Bucket, cfg.Sources)
+	if err != nil {
+		return nil, err
+	}
+	scfg.Sources = sources
 
 	// If we are at server version 2.7.2 or above use DiscardNew. We can not use DiscardNew for 2.7.1 or below.
 	if js.nc.serverMinVersion(2, 7, 2) {
@@ -393,15 +550,7 @@ func (js *js) CreateKeyValue(cfg *KeyValueConfig) (KeyValue, error) {
 		}
 	}
 
-	kv := &kvs{
-		name:   cfg.Bucket,
-		stream: scfg.Name,
-		pre:    fmt.Sprintf(kvSubjectsPreTmpl, cfg.Bucket),
-		js:     js,
-		// Determine if we need to use the JS prefix in front of Put and Delete operations
-		useJSPfx: js.opts.pre != defaultAPIPrefix,
-	}
-	return kv, nil
+	return js.bindKeyValue(cfg.Bucket, scfg), nil
 }
 
 // DeleteKeyValue will delete this KeyValue store (JetStream stream).
@@ -422,6 +571,15 @@ type kvs struct {
 	// and we need to add something to some of our high level protocols
 	// (such as Put, etc..)
 	useJSPfx bool
+	// Mirrors can not be written.
+	readOnly bool
+}
+
+func (kv *kvs) checkWritable() error {
+	if kv.readOnly {
+		return ErrKeyValueReadOnly
+	}
+	return nil
 }
 
 // Underlying entry.
@@ -433,6 +591,7 @@ type kve struct {
 	delta    uint64
 	created  time.Time
 	op       KeyValueOp
+	hdr      Header
 }
 
 func (e *kve) Bucket() string        { return e.bucket }
@@ -443,6 +602,11 @@ func (e *kve) Created() time.Time    { return e.created }
 func (e *kve) Delta() uint64         { return e.delta }
 func (e *kve) Operation() KeyValueOp { return e.op }
 
+// kvReservedKey returns true for the keys used internally by the client.
+func kvReservedKey(key string) bool {
+	return strings.HasPrefix(key, kvTxnPrefix) || strings.HasPrefix(key, kvExpPrefix)
+}
+
 func keyValid(key string) bool {
 	if len(key) == 0 || key[0] == '.' || key[len(key)-1] == '.' {
 		return false
@@ -503,12 +667,20 @@ func (kv *kvs) get(key string, revision uint64) (KeyValueEntry, error) {
 		return nil, err
 	}
 
+	// Resolve the writes of uncommitted transactions to the previous value.
+	if revision == kvLatestRevision && m.Header.Get(kvTxnHdr) != _EMPTY_ {
+		if e, err := kv.resolveTxn(key, m.Header); e != nil || err != nil {
+			return e, err
+		}
+	}
+
 	entry := &kve{
 		bucket:   kv.name,
 		key:      key,
 		value:    m.Data,
 		revision: m.Sequence,
 		created:  m.Time,
+		hdr:      m.Header,
 	}
 
 	// Double check here that this is not a DEL Operation marker.
@@ -520,6 +692,14 @@ func (kv *kvs) get(key string, revision uint64) (KeyValueEntry, error) {
 		case kvpurge:
 			entry.op = KeyValuePurge
 			return entry, ErrKeyDeleted
+		case kvexpired:
+			entry.op = KeyValueExpired
+			return entry, ErrKeyDeleted
+		}
+		// Keys past their TTL read as expired before being reaped.
+		if revision == kvLatestRevision && kvMsgExpired(m.Header, m.Time) {
+			entry.op = KeyValueExpired
+			return entry, ErrKeyDeleted
 		}
 	}
 
@@ -531,6 +711,9 @@ func (kv *kvs) Put(key string, value []byte) (revision uint64, err error) {
 	if !keyValid(key) {
 		return 0, ErrInvalidKey
 	}
+	if err := kv.checkWritable(); err != nil {
+		return 0, err
+	}
 
 	var b strings.Builder
 	if kv.useJSPfx {
@@ -572,6 +755,9 @@ func (kv *kvs) Update(key string, value []byte, revision uint64) (uint64, error)
 	if !keyValid(key) {
 		return 0, ErrInvalidKey
 	}
+	if err := kv.checkWritable(); err != nil {
+		return 0, err
+	}
 
 	var b strings.Builder
 	if kv.useJSPfx {
@@ -604,6 +790,9 @@ func (kv *kvs) delete(key string, purge bool) error {
 	if !keyValid(key) {
 		return ErrInvalidKey
 	}
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
 
 	var b strings.Builder
 	if kv.useJSPfx {
@@ -631,6 +820,9 @@ const kvDefaultPurgeDeletesMarkerThreshold = 30 * time.Minute
 // This is a maintenance option if there is a larger buildup of delete markers.
 // See DeleteMarkersOlderThan() option for more information.
 func (kv *kvs) PurgeDeletes(opts ...PurgeOpt) error {
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
 	var o purgeOpts
 	for _, opt := range opts {
 		if opt != nil {
@@ -667,7 +859,7 @@ func (kv *kvs) PurgeDeletes(opts ...PurgeOpt) error {
 		if entry == nil {
 			break
 		}
-		if op := entry.Operation(); op == KeyValueDelete || op == KeyValuePurge {
+		if op := entry.Operation(); op != KeyValuePut {
 			deleteMarkers = append(deleteMarkers, entry)
 		}
 	}
@@ -695,7 +887,7 @@ func (kv *kvs) PurgeDeletes(opts ...PurgeOpt) error {
 
 // Keys() will return all keys.
 func (kv *kvs) Keys(opts ...WatchOpt) ([]string, error) {
-	opts = append(opts, IgnoreDeletes(), MetaOnly())
+	opts = append(opts, IgnoreDeletes(), MetaOnly(), committedState())
 	watcher, err := kv.WatchAll(opts...)
 	if err != nil {
 		return nil, err
@@ -717,7 +909,7 @@ func (kv *kvs) Keys(opts ...WatchOpt) ([]string, error) {
 
 // History will return all values for the key.
 func (kv *kvs) History(key string, opts ...WatchOpt) ([]KeyValueEntry, error) {
-	opts = append(opts, IncludeHistory())
+	opts = append(opts, IncludeHistory(), committedState())
 	watcher, err := kv.Watch(key, opts...)
 	if err != nil {
 		return nil, err
@@ -746,6 +938,20 @@ type watcher struct {
 	initPending uint64
 	received    uint64
 	ctx         context.Context
+
+	// Durable watchers queue the updates with their message, acknowledged
+	// once the next one is read from updates.
+	durable bool
+	queue   chan kvUpdate
+	lastRev uint64
+	stop    chan struct{}
+	stopped sync.Once
+	done    chan struct{}
+}
+
+type kvUpdate struct {
+	entry KeyValueEntry
+	m     *Msg
 }
 
 // Context returns the context for the watcher if set.
@@ -769,7 +975,56 @@ func (w *watcher) Stop() error {
 	if w == nil {
 		return nil
 	}
-	return w.sub.Unsubscribe()
+	if !w.durable {
+		return w.sub.Unsubscribe()
+	}
+	w.stopped.Do(func() { close(w.stop) })
+	err := w.sub.Unsubscribe()
+	if err == nil {
+		// Wait for the updates not read to be released to the next
+		// watcher.
+		<-w.done
+	}
+	return err
+}
+
+// send passes an update, or the initial values marker if nil, to the
+// watcher. Lock should be held.
+func (w *watcher) send(entry KeyValueEntry, m *Msg) {
+	if w.durable {
+		w.queue <- kvUpdate{entry, m}
+	} else {
+		w.updates <- entry
+	}
+}
+
+// forward hands the updates of a durable watcher out one at a time. An
+// update is acknowledged once the next one is read, its reader being
+// done with it, or when the watcher stops. The updates not read when the
+// watcher stops are negatively acknowledged, so that they are redelivered
+// at once to the next watcher.
+func (w *watcher) forward() {
+	defer close(w.done)
+	defer close(w.updates)
+	var read *Msg
+	for u := range w.queue {
+		select {
+		case w.updates <- u.entry:
+			if read != nil {
+				read.AckSync()
+			}
+			if u.m != nil {
+				read = u.m
+			}
+		case <-w.stop:
+			if u.m != nil {
+				u.m.ackReply(ackNak, true)
+			}
+		}
+	}
+	if read != nil {
+		read.AckSync()
+	}
 }
 
 // WatchAll watches all keys.
@@ -789,6 +1044,10 @@ func (kv *kvs) Watch(keys string, opts ...WatchOpt) (KeyWatcher, error) {
 		}
 	}
 
+	// Hide the transaction intent records and the expiry index, unless
+	// explicitly watched.
+	hideReserved := !o.includeReserved && !kvReservedKey(keys)
+
 	// Could be a pattern so don't check for validity as we normally do.
 	var b strings.Builder
 	b.WriteString(kv.pre)
@@ -815,22 +1074,61 @@ func (kv *kvs) Watch(keys string, opts ...WatchOpt) (KeyWatcher, error) {
 				op = KeyValueDelete
 			case kvpurge:
 				op = KeyValuePurge
+			case kvexpired:
+				op = KeyValueExpired
 			}
 		}
 		delta := uint64(parseNum(tokens[ackNumPendingTokenPos]))
+		revision := uint64(parseNum(tokens[ackStreamSeqTokenPos]))
+		created := time.Unix(0, parseNum(tokens[ackTimestampSeqTokenPos]))
+		// Values past their TTL, not reaped yet, are expired. Older values
+		// of the history may have been replaced before their TTL.
+		if op == KeyValuePut && !o.includeHistory && kvMsgExpired(m.Header, created) {
+			op = KeyValueExpired
+		}
 		w.mu.Lock()
 		defer w.mu.Unlock()
-		if !o.ignoreDeletes || (op != KeyValueDelete && op != KeyValuePurge) {
-			entry := &kve{
-				bucket:   kv.name,
-				key:      subj,
-				value:    m.Data,
-				revision: uint64(parseNum(tokens[ackStreamSeqTokenPos])),
-				created:  time.Unix(0, parseNum(tokens[ackTimestampSeqTokenPos])),
-				delta:    delta,
-				op:       op,
+		if w.durable {
+			// Redelivered while still queued or being read, when not
+			// acknowledged within the ack wait.
+			if revision <= w.lastRev {
+				return
 			}
-			w.updates <- entry
+			w.lastRev = revision
+		}
+		hidden := hideReserved && kvReservedKey(subj)
+		entry := &kve{
+			bucket:   kv.name,
+			key:      subj,
+			value:    m.Data,
+			revision: revision,
+			created:  created,
+			delta:    delta,
+			op:       op,
+			hdr:      m.Header,
+		}
+		// Initial values written by uncommitted transactions are resolved
+		// as in Get for the readers of the committed state, their previous
+		// values being already part of the history. They are delivered as
+		// written otherwise, as the updates that follow, or if they can
+		// not be resolved.
+		if !hidden && !w.initDone && o.committed && m.Header.Get(kvTxnHdr) != _EMPTY_ {
+			re, err := kv.resolveTxn(subj, m.Header)
+			if err == ErrKeyNotFound || (re != nil && o.includeHistory) {
+				hidden = true
+			} else if re != nil {
+				if o.metaOnly {
+					re.value = nil
+				}
+				// The headers are those of the value written.
+				re.delta, re.hdr = delta, m.Header
+				entry, op = re, KeyValuePut
+			}
+		}
+		if !hidden && (!o.ignoreDeletes || op == KeyValuePut) {
+			w.send(entry, m)
+		} else if w.durable {
+			m.Ack()
 		}
 		// Check if done and initial values.
 		if !w.initDone {
@@ -841,18 +1139,40 @@ func (kv *kvs) Watch(keys string, opts ...WatchOpt) (KeyWatcher, error) {
 			}
 			if w.received > w.initPending || delta == 0 {
 				w.initDone = true
-				w.updates <- nil
+				w.send(nil, nil)
 			}
 		}
 	}
 
-	// Used ordered consumer to deliver results.
-	subOpts := []SubOpt{OrderedConsumer()}
-	if !o.includeHistory {
-		subOpts = append(subOpts, DeliverLastPerSubject())
-	}
-	if o.metaOnly {
-		subOpts = append(subOpts, HeadersOnly())
+	// Used ordered consumer to deliver results. Mirrors store the
+	// subjects of the bucket they mirror, hence the binding.
+	var subOpts []SubOpt
+	var pending uint64
+	if o.durable != _EMPTY_ {
+		info, err := kv.durableWatcher(keys, &o)
+		if err != nil {
+			return nil, err
+		}
+		// The initial values are the updates not delivered yet, and the
+		// one not acknowledged by the previous watcher.
+		pending = info.NumPending + uint64(info.NumAckPending)
+		w.initPending = pending
+		w.durable = true
+		w.updates = make(chan KeyValueEntry)
+		w.queue = make(chan kvUpdate, 256)
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		subOpts = []SubOpt{Bind(kv.stream, o.durable), ManualAck()}
+	} else {
+		subOpts = []SubOpt{OrderedConsumer(), BindStream(kv.stream)}
+		if o.resumeFromRevision > 0 {
+			subOpts = append(subOpts, StartSequence(o.resumeFromRevision))
+		} else if !o.includeHistory {
+			subOpts = append(subOpts, DeliverLastPerSubject())
+		}
+		if o.metaOnly {
+			subOpts = append(subOpts, HeadersOnly())
+		}
 	}
 	if o.ctx != nil {
 		subOpts = append(subOpts, Context(o.ctx))
@@ -866,16 +1186,27 @@ func (kv *kvs) Watch(keys string, opts ...WatchOpt) (KeyWatcher, error) {
 	if err != nil {
 		return nil, err
 	}
+	if w.durable {
+		go w.forward()
+	}
 	sub.mu.Lock()
+	if sub.jsi != nil && !w.durable {
+		pending = sub.jsi.pending
+	}
 	// If there were no pending messages at the time of the creation
 	// of the consumer, send the marker.
-	if sub.jsi != nil && sub.jsi.pending == 0 {
+	if sub.jsi != nil && pending == 0 {
 		w.initDone = true
-		w.updates <- nil
+		w.send(nil, nil)
 	}
 	// Set us up to close when the waitForMessages func returns.
 	sub.pDone = func() {
-		close(w.updates)
+		if w.durable {
+			w.stopped.Do(func() { close(w.stop) })
+			close(w.queue)
+		} else {
+			close(w.updates)
+		}
 	}
 	sub.mu.Unlock()
 
@@ -883,6 +1214,40 @@ func (kv *kvs) Watch(keys string, opts ...WatchOpt) (KeyWatcher, error) {
 	return w, nil
 }
 
+// durableWatcher returns the info of the durable consumer of a durable
+// watcher, created with the options of the watcher if it does not exist.
+func (kv *kvs) durableWatcher(filter string, o *watchOpts) (*ConsumerInfo, error) {
+	info, err := kv.js.ConsumerInfo(kv.stream, o.durable)
+	if err != ErrConsumerNotFound {
+		return info, err
+	}
+	cfg := &ConsumerConfig{
+		Durable:        o.durable,
+		DeliverSubject: kv.js.nc.newInbox(),
+		DeliverPolicy:  DeliverLastPerSubjectPolicy,
+		AckPolicy:      AckExplicitPolicy,
+		MaxAckPending:  2, // The update being read and the next one.
+		FilterSubject:  filter,
+		HeadersOnly:    o.metaOnly,
+	}
+	if o.resumeFromRevision > 0 {
+		cfg.DeliverPolicy = DeliverByStartSequencePolicy
+		cfg.OptStartSeq = o.resumeFromRevision
+	} else if o.includeHistory {
+		cfg.DeliverPolicy = DeliverAllPolicy
+	}
+	return kv.js.AddConsumer(kv.stream, cfg)
+}
+
+// DeleteWatcher removes the durable watcher of the given name, which must
+// be stopped.
+func (kv *kvs) DeleteWatcher(name string) error {
+	if name == _EMPTY_ || checkDurName(name) != nil {
+		return ErrInvalidDurableName
+	}
+	return kv.js.DeleteConsumer(kv.stream, name)
+}
+
 // Bucket returns the current bucket name (JetStream stream).
 func (kv *kvs) Bucket() string {
 	return kv.name
@@ -0,0 +1,355 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+// KeyValueCache is a KeyValue bucket whose Get serves the values from
+// memory. The cache is kept up to date by watching the bucket, other
+// operations are passed through to the bucket.
+//
+// Keys written by transactions are read from the bucket until written
+// again, so that uncommitted values are not served.
+type KeyValueCache struct {
+	KeyValue
+
+	w        KeyWatcher
+	sub      *Subscription
+	maxKeys  int
+	maxStale time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]*list.Element
+	lru       *list.List
+	seq       uint64
+	synced    time.Time
+	lag       time.Duration
+	primed    bool
+	stopped   bool
+	changed   chan struct{}
+	hits      uint64
+	misses    uint64
+	evictions uint64
+}
+
+type kvCacheEntry struct {
+	key string
+	// entry is nil if the key was deleted.
+	entry   KeyValueEntry
+	expires time.Time
+	bypass  bool
+}
+
+// KeyValueCacheStats are the statistics of a KeyValueCache.
+type KeyValueCacheStats struct {
+	// Keys is the number of cached keys, including deleted ones.
+	Keys int
+	// Hits is the number of Get served from the cache, Misses from
+	// the bucket.
+	Hits   uint64
+	Misses uint64
+	// Evictions is the number of keys evicted to respect CacheMaxKeys.
+	Evictions uint64
+	// Revision is the latest revision of the bucket seen by the cache.
+	Revision uint64
+	// Lag is how long the latest update took to reach the cache.
+	Lag time.Duration
+}
+
+// HitRate returns the ratio of the Get served from the cache.
+func (s KeyValueCacheStats) HitRate() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// CacheOpt configures a KeyValueCache.
+type CacheOpt interface {
+	configureCache(opts *cacheOpts) error
+}
+
+type cacheOpts struct {
+	ctx      context.Context
+	maxKeys  int
+	maxStale time.Duration
+}
+
+type cacheOptFn func(opts *cacheOpts) error
+
+func (opt cacheOptFn) configureCache(opts *cacheOpts) error {
+	return opt(opts)
+}
+
+// For nats.Context() support, bounding the loading of the cache.
+func (ctx ContextOpt) configureCache(opts *cacheOpts) error {
+	opts.ctx = ctx
+	return nil
+}
+
+// CacheMaxKeys bounds the number of keys of the cache, evicting the least
+// recently used ones. Evicted keys are read from the bucket and cached
+// again.
+func CacheMaxKeys(n int) CacheOpt {
+	return cacheOptFn(func(opts *cacheOpts) error {
+		if n <= 0 {
+			return ErrInvalidArg
+		}
+		opts.maxKeys = n
+		return nil
+	})
+}
+
+// CacheMaxStaleness bounds how long the cache is trusted without being
+// known to be up to date. When no update was received for longer than
+// that, Get checks with the server that none is pending, or reads from
+// the bucket.
+func CacheMaxStaleness(d time.Duration) CacheOpt {
+	return cacheOptFn(func(opts *cacheOpts) error {
+		if d <= 0 {
+			return ErrInvalidArg
+		}
+		opts.maxStale = d
+		return nil
+	})
+}
+
+// NewKeyValueCache returns a cache of the bucket, once loaded with all its
+// keys.
+func NewKeyValueCache(kv KeyValue, opts ...CacheOpt) (*KeyValueCache, error) {
+	var o cacheOpts
+	for _, opt := range opts {
+		if opt != nil {
+			if err := opt.configureCache(&o); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c := &KeyValueCache{
+		KeyValue: kv,
+		maxKeys:  o.maxKeys,
+		maxStale: o.maxStale,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+		changed:  make(chan struct{}),
+	}
+	// Internal keys are watched to track the revision of the bucket.
+	wopts := []WatchOpt{watchOptFn(func(opts *watchOpts) error {
+		opts.includeReserved = true
+		return nil
+	})}
+	if o.ctx != nil {
+		wopts = append(wopts, Context(o.ctx))
+	}
+	w, err := kv.WatchAll(wopts...)
+	if err != nil {
+		return nil, err
+	}
+	c.w = w
+	if iw, ok := w.(*watcher); ok {
+		c.sub = iw.sub
+	}
+	go c.watch()
+
+	if err := c.WaitForRevision(o.ctx, 0); err != nil {
+		w.Stop()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *KeyValueCache) watch() {
+	for e := range c.w.Updates() {
+		c.mu.Lock()
+		if e == nil {
+			c.primed = true
+			c.synced = time.Now()
+		} else {
+			c.apply(e)
+		}
+		close(c.changed)
+		c.changed = make(chan struct{})
+		c.mu.Unlock()
+	}
+	c.mu.Lock()
+	c.stopped = true
+	close(c.changed)
+	c.mu.Unlock()
+}
+
+// apply updates the cache with a watched entry. Lock should be held.
+func (c *KeyValueCache) apply(e KeyValueEntry) {
+	if e.Revision() > c.seq {
+		c.seq = e.Revision()
+	}
+	if c.primed {
+		c.lag = time.Since(e.Created())
+	}
+	if e.Delta() == 0 {
+		c.synced = time.Now()
+	}
+	if kvReservedKey(e.Key()) {
+		return
+	}
+	ce := &kvCacheEntry{key: e.Key()}
+	if e.Operation() == KeyValuePut {
+		ce.entry = e
+	}
+	if ke, ok := e.(*kve); ok && ke.hdr != nil {
+		ce.bypass = ke.hdr.Get(kvTxnHdr) != _EMPTY_
+		ce.expires, _ = kvMsgExpires(ke.hdr, e.Created())
+	}
+	c.put(ce)
+}
+
+// put adds or replaces the entry of the key. Lock should be held.
+func (c *KeyValueCache) put(ce *kvCacheEntry) {
+	if el, ok := c.entries[ce.key]; ok {
+		el.Value = ce
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[ce.key] = c.lru.PushFront(ce)
+	if c.maxKeys > 0 && c.lru.Len() > c.maxKeys {
+		el := c.lru.Back()
+		c.lru.Remove(el)
+		delete(c.entries, el.Value.(*kvCacheEntry).key)
+		c.evictions++
+	}
+}
+
+// fresh returns true if the cache is known to be up to date within the
+// configured staleness bound.
+func (c *KeyValueCache) fresh() bool {
+	c.mu.Lock()
+	ok := !c.stopped && (c.maxStale == 0 || time.Since(c.synced) <= c.maxStale)
+	seq := c.seq
+	c.mu.Unlock()
+	if ok || c.maxStale == 0 || c.sub == nil {
+		return ok
+	}
+	ci, err := c.sub.ConsumerInfo()
+	if err != nil || ci.NumPending > 0 || ci.Delivered.Stream > seq {
+		return false
+	}
+	c.mu.Lock()
+	c.synced = time.Now()
+	c.mu.Unlock()
+	return true
+}
+
+// Get returns the latest value for the key, from the cache if possible.
+func (c *KeyValueCache) Get(key string) (KeyValueEntry, error) {
+	if !keyValid(key) {
+		return nil, ErrInvalidKey
+	}
+	if c.fresh() {
+		c.mu.Lock()
+		el, ok := c.entries[key]
+		var ce *kvCacheEntry
+		if ok {
+			ce = el.Value.(*kvCacheEntry)
+		}
+		switch {
+		case ok && !ce.bypass:
+			c.lru.MoveToFront(el)
+			c.hits++
+			c.mu.Unlock()
+			if ce.entry == nil || (!ce.expires.IsZero() && !time.Now().Before(ce.expires)) {
+				return nil, ErrKeyNotFound
+			}
+			return ce.entry, nil
+		case !ok && c.evictions == 0:
+			// All the keys are cached, including those written by
+			// transactions, which are bypassed.
+			c.hits++
+			c.mu.Unlock()
+			return nil, ErrKeyNotFound
+		}
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	c.misses++
+	c.mu.Unlock()
+	e, err := c.KeyValue.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	// Cache evicted keys again, unless updated by the watcher meanwhile.
+	c.mu.Lock()
+	if _, ok := c.entries[key]; !ok && !c.stopped {
+		ce := &kvCacheEntry{key: key, entry: e}
+		if ke, ok := e.(*kve); ok && ke.hdr != nil {
+			ce.expires, _ = kvMsgExpires(ke.hdr, e.Created())
+		}
+		c.put(ce)
+	}
+	c.mu.Unlock()
+	return e, nil
+}
+
+// WaitForRevision waits until the cache has seen the given revision of
+// the bucket, for instance returned by Put, to read its own writes.
+func (c *KeyValueCache) WaitForRevision(ctx context.Context, revision uint64) error {
+	var done <-chan struct{}
+	if ctx != nil {
+		done = ctx.Done()
+	}
+	for {
+		c.mu.Lock()
+		if c.primed && c.seq >= revision {
+			c.mu.Unlock()
+			return nil
+		}
+		if c.stopped {
+			c.mu.Unlock()
+			return ErrBadSubscription
+		}
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-done:
+			return ctx.Err()
+		}
+	}
+}
+
+// Stats returns the statistics of the cache.
+func (c *KeyValueCache) Stats() KeyValueCacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return KeyValueCacheStats{
+		Keys:      c.lru.Len(),
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Revision:  c.seq,
+		Lag:       c.lag,
+	}
+}
+
+// Stop stops updating the cache, Get then reads from the bucket.
+func (c *KeyValueCache) Stop() error {
+	c.mu.Lock()
+	c.stopped = true
+	c.mu.Unlock()
+	return c.w.Stop()
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKeyValueCache(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "CONFIG", History: 5})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	kv.Put("a", []byte("1"))
+	kv.Put("b", []byte("1"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := NewKeyValueCache(kv, Context(ctx))
+	if err != nil {
+		t.Fatalf("Error creating cache: %v", err)
+	}
+	defer c.Stop()
+
+	expectKV(t, c, map[string]string{"a": "1", "b": "1", "missing": ""})
+	if st := c.Stats(); st.Hits != 3 || st.Misses != 0 || st.Keys != 2 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+
+	// Read your writes.
+	rev, _ := c.Put("a", []byte("2"))
+	if err := c.WaitForRevision(ctx, rev); err != nil {
+		t.Fatalf("Error waiting for revision: %v", err)
+	}
+	c.Delete("b")
+	rev, _ = c.PutWithTTL("t", []byte("1"), 100*time.Millisecond)
+	if err := c.WaitForRevision(ctx, rev); err != nil {
+		t.Fatalf("Error waiting for revision: %v", err)
+	}
+	expectKV(t, c, map[string]string{"a": "2", "b": "", "t": "1"})
+	time.Sleep(150 * time.Millisecond)
+	expectKV(t, c, map[string]string{"t": ""})
+	if st := c.Stats(); st.Misses != 0 || st.Revision < rev || st.HitRate() != 1 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+
+	// Keys written by transactions are read from the bucket.
+	if err := c.Txn().Put("a", []byte("3")).Commit(); err != nil {
+		t.Fatalf("Error on commit: %v", err)
+	}
+	expectKV(t, c, map[string]string{"a": "3"})
+	if st := c.Stats(); st.Misses != 1 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+
+	// So are the keys created by a transaction committed after the cache
+	// primed.
+	var pc *KeyValueCache
+	kvTxnCrash = func(stage string) error {
+		var err error
+		if stage == "op0" {
+			pc, err = NewKeyValueCache(kv)
+		}
+		return err
+	}
+	err = kv.Txn().Put("new", []byte("1")).Commit()
+	kvTxnCrash = nil
+	if err != nil {
+		t.Fatalf("Error on commit: %v", err)
+	}
+	defer pc.Stop()
+	expectKV(t, pc, map[string]string{"new": "1"})
+
+	// Evicted keys are read from the bucket.
+	lc, err := NewKeyValueCache(kv, CacheMaxKeys(2))
+	if err != nil {
+		t.Fatalf("Error creating cache: %v", err)
+	}
+	defer lc.Stop()
+	if st := lc.Stats(); st.Keys != 2 || st.Evictions == 0 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+	expectKV(t, lc, map[string]string{"a": "3", "b": "", "t": ""})
+	if st := lc.Stats(); st.Misses == 0 || st.Keys != 2 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+
+	// Idle caches are checked with the server.
+	sc, err := NewKeyValueCache(kv, CacheMaxStaleness(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("Error creating cache: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	expectKV(t, sc, map[string]string{"b": ""})
+	if st := sc.Stats(); st.Hits != 1 || st.Misses != 0 {
+		t.Fatalf("Unexpected stats: %+v", st)
+	}
+
+	// Stopped caches read from the bucket.
+	sc.Stop()
+	kv.Put("a", []byte("4"))
+	expectKV(t, sc, map[string]string{"a": "4"})
+	if err := sc.WaitForRevision(ctx, 100); err != ErrBadSubscription {
+		t.Fatalf("Expected %v, got %v", ErrBadSubscription, err)
+	}
+}
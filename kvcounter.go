@@ -0,0 +1,201 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// Numeric values are stored as decimal strings and updated with
+// revision-checked writes, retried with a jittered backoff when the key
+// was written concurrently.
+const (
+	kvNumMaxRetries   = 10
+	kvNumRetryBackoff = time.Millisecond
+)
+
+var (
+	ErrKeyValueNotNumber  = errors.New("nats: value is not a number")
+	ErrKeyValueContention = errors.New("nats: too many concurrent updates")
+	ErrKeyValueOverflow   = errors.New("nats: numeric value overflow")
+)
+
+// updateNum applies fn to the numeric value of the key, missing keys
+// being passed as not existing, until the result is written without
+// conflict. fn returns the new value and whether to write it. The
+// resulting value and whether it was written are returned.
+func (kv *kvs) updateNum(key string, fn func(cur int64, exists bool) (int64, bool)) (int64, bool, error) {
+	if !keyValid(key) || kvReservedKey(key) {
+		return 0, false, ErrInvalidKey
+	}
+	backoff := kvNumRetryBackoff
+	for i := 0; i < kvNumMaxRetries; i++ {
+		var (
+			cur    int64
+			rev    uint64
+			exists bool
+		)
+		e, err := kv.get(key, kvLatestRevision)
+		switch err {
+		case nil:
+			if cur, err = strconv.ParseInt(string(e.Value()), 10, 64); err != nil {
+				return 0, false, ErrKeyValueNotNumber
+			}
+			rev, exists = e.Revision(), true
+		case ErrKeyDeleted:
+			rev = e.Revision()
+		case ErrKeyNotFound:
+		default:
+			return 0, false, err
+		}
+		v, write := fn(cur, exists)
+		if !write {
+			return cur, false, nil
+		}
+		_, err = kv.Update(key, []byte(strconv.FormatInt(v, 10)), rev)
+		if err == nil {
+			return v, true, nil
+		}
+		if !IsWrongLastSequence(err) {
+			return 0, false, err
+		}
+		time.Sleep(backoff/2 + time.Duration(rand.Int63n(int64(backoff))))
+		backoff *= 2
+	}
+	return 0, false, ErrKeyValueContention
+}
+
+// Increment adds delta to the numeric value of the key, missing keys
+// counting as 0, and returns the new value. ErrKeyValueOverflow is
+// returned, and the value left unchanged, if the result does not fit in
+// an int64.
+func (kv *kvs) Increment(key string, delta int64) (int64, error) {
+	return kv.addNum(key, delta, false)
+}
+
+// Decrement subtracts delta from the numeric value of the key, missing
+// keys counting as 0, and returns the new value. ErrKeyValueOverflow is
+// returned, and the value left unchanged, if the result does not fit in
+// an int64.
+func (kv *kvs) Decrement(key string, delta int64) (int64, error) {
+	return kv.addNum(key, delta, true)
+}
+
+// addNum adds delta to, or subtracts it from, the numeric value of the key.
+func (kv *kvs) addNum(key string, delta int64, subtract bool) (int64, error) {
+	var overflow bool
+	v, _, err := kv.updateNum(key, func(cur int64, _ bool) (int64, bool) {
+		var v int64
+		if subtract {
+			v = cur - delta
+			overflow = (delta > 0 && v > cur) || (delta < 0 && v < cur)
+		} else {
+			v = cur + delta
+			overflow = (delta > 0 && v < cur) || (delta < 0 && v > cur)
+		}
+		return v, !overflow
+	})
+	if err == nil && overflow {
+		return 0, ErrKeyValueOverflow
+	}
+	return v, err
+}
+
+// Min sets the numeric value of the key to value if lower, or if the key
+// does not exist, and returns the resulting value.
+func (kv *kvs) Min(key string, value int64) (int64, error) {
+	v, _, err := kv.updateNum(key, func(cur int64, exists bool) (int64, bool) {
+		return value, !exists || value < cur
+	})
+	return v, err
+}
+
+// Max sets the numeric value of the key to value if greater, or if the
+// key does not exist, and returns the resulting value.
+func (kv *kvs) Max(key string, value int64) (int64, error) {
+	v, _, err := kv.updateNum(key, func(cur int64, exists bool) (int64, bool) {
+		return value, !exists || value > cur
+	})
+	return v, err
+}
+
+// SetIfGreater sets the numeric value of the key to value if greater, or
+// if the key does not exist, and returns whether it was set.
+func (kv *kvs) SetIfGreater(key string, value int64) (bool, error) {
+	_, set, err := kv.updateNum(key, func(cur int64, exists bool) (int64, bool) {
+		return value, !exists || value > cur
+	})
+	return set, err
+}
+
+// ShardedCounter is a counter spread over several keys of a KeyValue
+// bucket, named after the counter key followed by the shard index, so
+// that concurrent increments of hot counters rarely conflict. Its value is
+// the sum of the shards.
+type ShardedCounter struct {
+	kv     KeyValue
+	key    string
+	shards int
+}
+
+// NewShardedCounter returns a counter stored in the given number of shards
+// under key.
+func NewShardedCounter(kv KeyValue, key string, shards int) (*ShardedCounter, error) {
+	if kv == nil || shards <= 0 {
+		return nil, ErrInvalidArg
+	}
+	if !keyValid(key) || kvReservedKey(key) {
+		return nil, ErrInvalidKey
+	}
+	return &ShardedCounter{kv: kv, key: key, shards: shards}, nil
+}
+
+func (c *ShardedCounter) shardKey(i int) string {
+	return c.key + "." + strconv.Itoa(i)
+}
+
+// Increment adds delta to a random shard of the counter.
+func (c *ShardedCounter) Increment(delta int64) error {
+	_, err := c.kv.Increment(c.shardKey(rand.Intn(c.shards)), delta)
+	return err
+}
+
+// Decrement subtracts delta from a random shard of the counter.
+func (c *ShardedCounter) Decrement(delta int64) error {
+	_, err := c.kv.Decrement(c.shardKey(rand.Intn(c.shards)), delta)
+	return err
+}
+
+// Value returns the sum of the shards of the counter.
+func (c *ShardedCounter) Value() (int64, error) {
+	var sum int64
+	for i := 0; i < c.shards; i++ {
+		e, err := c.kv.Get(c.shardKey(i))
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		v, err := strconv.ParseInt(string(e.Value()), 10, 64)
+		if err != nil {
+			return 0, ErrKeyValueNotNumber
+		}
+		sum += v
+	}
+	return sum, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestKeyValueCounters(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "COUNTERS"})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+
+	if v, err := kv.Increment("hits", 5); err != nil || v != 5 {
+		t.Fatalf("Unexpected value: %v, %v", v, err)
+	}
+	if v, err := kv.Decrement("hits", 7); err != nil || v != -2 {
+		t.Fatalf("Unexpected value: %v, %v", v, err)
+	}
+	kv.Delete("hits")
+	if v, err := kv.Increment("hits", 1); err != nil || v != 1 {
+		t.Fatalf("Unexpected value: %v, %v", v, err)
+	}
+
+	if v, err := kv.Min("low", 10); err != nil || v != 10 {
+		t.Fatalf("Unexpected value: %v, %v", v, err)
+	}
+	if v, err := kv.Min("low", 20); err != nil || v != 10 {
+		t.Fatalf("Unexpected value: %v, %v", v, err)
+	}
+	if v, err := kv.Max("high", 10); err != nil || v != 10 {
+		t.Fatalf("Unexpected value: %v, %v", v, err)
+	}
+	if v, err := kv.Max("high", 20); err != nil || v != 20 {
+		t.Fatalf("Unexpected value: %v, %v", v, err)
+	}
+	if set, err := kv.SetIfGreater("high", 15); err != nil || set {
+		t.Fatalf("Unexpected set: %v, %v", set, err)
+	}
+	if set, err := kv.SetIfGreater("high", 25); err != nil || !set {
+		t.Fatalf("Unexpected set: %v, %v", set, err)
+	}
+	expectKV(t, kv, map[string]string{"hits": "1", "low": "10", "high": "25"})
+
+	kv.Put("name", []byte("derek"))
+	if _, err := kv.Increment("name", 1); err != ErrKeyValueNotNumber {
+		t.Fatalf("Expected %v, got %v", ErrKeyValueNotNumber, err)
+	}
+
+	// Overflows leave the value unchanged.
+	if _, err := kv.Increment("big", math.MaxInt64); err != nil {
+		t.Fatalf("Error incrementing: %v", err)
+	}
+	if _, err := kv.Increment("big", 1); err != ErrKeyValueOverflow {
+		t.Fatalf("Expected %v, got %v", ErrKeyValueOverflow, err)
+	}
+	if _, err := kv.Decrement("big", -1); err != ErrKeyValueOverflow {
+		t.Fatalf("Expected %v, got %v", ErrKeyValueOverflow, err)
+	}
+	if v, err := kv.Decrement("small", math.MinInt64); err != ErrKeyValueOverflow {
+		t.Fatalf("Expected %v, got %v, %v", ErrKeyValueOverflow, v, err)
+	}
+	if v, err := kv.Decrement("big", math.MaxInt64); err != nil || v != 0 {
+		t.Fatalf("Unexpected value: %v, %v", v, err)
+	}
+	if v, err := kv.Increment("big", math.MinInt64); err != nil || v != math.MinInt64 {
+		t.Fatalf("Unexpected value: %v, %v", v, err)
+	}
+	if _, err := kv.Increment("big", -1); err != ErrKeyValueOverflow {
+		t.Fatalf("Expected %v, got %v", ErrKeyValueOverflow, err)
+	}
+	expectKV(t, kv, map[string]string{"big": strconv.FormatInt(math.MinInt64, 10)})
+
+	// Concurrent increments are not lost.
+	c, err := NewShardedCounter(kv, "requests", 4)
+	if err != nil {
+		t.Fatalf("Error creating counter: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				if _, err := kv.Increment("total", 1); err != nil {
+					t.Errorf("Error incrementing: %v", err)
+				}
+				if err := c.Increment(2); err != nil {
+					t.Errorf("Error incrementing: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	expectKV(t, kv, map[string]string{"total": "100"})
+	if v, err := c.Value(); err != nil || v != 200 {
+		t.Fatalf("Unexpected value: %v, %v", v, err)
+	}
+	if err := c.Decrement(50); err != nil {
+		t.Fatalf("Error decrementing: %v", err)
+	}
+	if v, err := c.Value(); err != nil || v != 150 {
+		t.Fatalf("Unexpected value: %v, %v", v, err)
+	}
+
+	if _, err := NewShardedCounter(kv, "requests", 0); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+}
@@ -0,0 +1,228 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+const kvDefaultListPageSize = 100
+
+// KeyLister returns the keys of a KeyValue bucket page by page, in the
+// order they were last written. It is not safe for concurrent use.
+type KeyLister interface {
+	// Next fetches the next page, returning false when all the keys
+	// were listed or on error.
+	Next() bool
+	// Page returns the entries of the current page.
+	Page() []KeyValueEntry
+	// Err returns any error found while fetching pages.
+	Err() error
+	// Cursor returns a cursor to resume the listing after the current
+	// page with StartAfter.
+	Cursor() string
+	// Stop stops the listing before all the keys were listed.
+	Stop() error
+}
+
+type ListOpt interface {
+	configureList(opts *listOpts) error
+}
+
+type listOpts struct {
+	ctx      context.Context
+	pageSize int
+	after    uint64
+	values   bool
+}
+
+type listOptFn func(opts *listOpts) error
+
+func (opt listOptFn) configureList(opts *listOpts) error {
+	return opt(opts)
+}
+
+// For nats.Context() support.
+func (ctx ContextOpt) configureList(opts *listOpts) error {
+	opts.ctx = ctx
+	return nil
+}
+
+// ListPageSize sets the number of entries of the pages of a listing.
+func ListPageSize(n int) ListOpt {
+	return listOptFn(func(opts *listOpts) error {
+		if n <= 0 {
+			return ErrInvalidArg
+		}
+		opts.pageSize = n
+		return nil
+	})
+}
+
+// StartAfter resumes a listing after the cursor returned by
+// KeyLister.Cursor. Keys written since are listed again. The server still
+// delivers the keys listed before the cursor, which are skipped by the
+// client, so resuming a listing costs as much as listing the keys up to
+// the cursor again.
+func StartAfter(cursor string) ListOpt {
+	return listOptFn(func(opts *listOpts) error {
+		if cursor == _EMPTY_ {
+			return nil
+		}
+		after, err := strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return ErrInvalidArg
+		}
+		opts.after = after
+		return nil
+	})
+}
+
+// ListValues has the listed entries include the values, which are
+// omitted by default.
+func ListValues() ListOpt {
+	return listOptFn(func(opts *listOpts) error {
+		opts.values = true
+		return nil
+	})
+}
+
+type keyLister struct {
+	w      KeyWatcher
+	prefix string
+	o      listOpts
+	page   []KeyValueEntry
+	cursor uint64
+	done   bool
+	err    error
+}
+
+func (l *keyLister) stop() error {
+	if l.done {
+		return nil
+	}
+	l.done = true
+	return l.w.Stop()
+}
+
+// List returns a lister of the keys starting with prefix. Only the keys
+// under the tokens of the prefix before its last dot are delivered by the
+// server, the others being filtered by the client. Listing a prefix
+// ending with a dot thus only reads the matching keys, while listing a
+// prefix without a dot, such as "user", reads the whole bucket.
+func (kv *kvs) List(prefix string, opts ...ListOpt) (KeyLister, error) {
+	o := listOpts{pageSize: kvDefaultListPageSize}
+	for _, opt := range opts {
+		if opt != nil {
+			if err := opt.configureList(&o); err != nil {
+				return nil, err
+			}
+		}
+	}
+	filter := AllKeys
+	if i := strings.LastIndexByte(prefix, '.'); i >= 0 {
+		if !keyValid(prefix[:i]) {
+			return nil, ErrInvalidKey
+		}
+		filter = prefix[:i+1] + AllKeys
+	}
+	wopts := []WatchOpt{IgnoreDeletes(), committedState()}
+	if !o.values {
+		wopts = append(wopts, MetaOnly())
+	}
+	if o.ctx != nil {
+		wopts = append(wopts, Context(o.ctx))
+	}
+	w, err := kv.Watch(filter, wopts...)
+	if err != nil {
+		return nil, err
+	}
+	return &keyLister{w: w, prefix: prefix, o: o, cursor: o.after}, nil
+}
+
+// Next fetches the next page of entries.
+func (l *keyLister) Next() bool {
+	if l.err != nil || l.done {
+		return false
+	}
+	var done <-chan struct{}
+	if l.o.ctx != nil {
+		done = l.o.ctx.Done()
+	}
+	l.page = nil
+	for len(l.page) < l.o.pageSize {
+		var (
+			e  KeyValueEntry
+			ok bool
+		)
+		select {
+		case e, ok = <-l.w.Updates():
+		case <-done:
+			l.err = l.o.ctx.Err()
+			l.stop()
+			return false
+		}
+		if !ok {
+			// Closed before the end of the initial values.
+			l.err = l.watchErr()
+			l.stop()
+			return false
+		}
+		// The nil entry marks the end of the initial values.
+		if e == nil {
+			l.stop()
+			break
+		}
+		if e.Revision() <= l.o.after || !strings.HasPrefix(e.Key(), l.prefix) {
+			continue
+		}
+		l.page = append(l.page, e)
+		l.cursor = e.Revision()
+	}
+	return len(l.page) > 0
+}
+
+// watchErr returns why the watcher was closed before all the keys were
+// listed.
+func (l *keyLister) watchErr() error {
+	if l.o.ctx != nil && l.o.ctx.Err() != nil {
+		return l.o.ctx.Err()
+	}
+	if w, ok := l.w.(*watcher); ok && w.sub.conn.IsClosed() {
+		return ErrConnectionClosed
+	}
+	return ErrBadSubscription
+}
+
+// Page returns the current page.
+func (l *keyLister) Page() []KeyValueEntry {
+	return l.page
+}
+
+// Err returns any error found while fetching pages.
+func (l *keyLister) Err() error {
+	return l.err
+}
+
+// Cursor returns the cursor of the current page.
+func (l *keyLister) Cursor() string {
+	return strconv.FormatUint(l.cursor, 10)
+}
+
+// Stop stops the listing.
+func (l *keyLister) Stop() error {
+	return l.stop()
+}
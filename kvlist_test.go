@@ -0,0 +1,117 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestKeyValueList(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "USERS"})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	for i := 1; i <= 25; i++ {
+		kv.Put(fmt.Sprintf("users.%d", i), []byte(fmt.Sprintf("user %d", i)))
+	}
+	kv.Put("users", []byte("not listed"))
+	kv.Put("admins.x", []byte("admin"))
+	kv.Delete("users.5")
+
+	list := func(prefix string, opts ...ListOpt) ([]int, KeyLister) {
+		t.Helper()
+		l, err := kv.List(prefix, opts...)
+		if err != nil {
+			t.Fatalf("Error listing: %v", err)
+		}
+		var pages []int
+		for l.Next() {
+			for _, e := range l.Page() {
+				if !strings.HasPrefix(e.Key(), prefix) {
+					t.Fatalf("Unexpected key %q for prefix %q", e.Key(), prefix)
+				}
+			}
+			pages = append(pages, len(l.Page()))
+		}
+		if err := l.Err(); err != nil {
+			t.Fatalf("Error listing: %v", err)
+		}
+		return pages, l
+	}
+
+	if pages, _ := list("users.", ListPageSize(10)); fmt.Sprint(pages) != "[10 10 4]" {
+		t.Fatalf("Unexpected pages: %v", pages)
+	}
+	if pages, _ := list("users.1"); fmt.Sprint(pages) != "[11]" {
+		t.Fatalf("Unexpected pages: %v", pages)
+	}
+	if pages, _ := list("adm"); fmt.Sprint(pages) != "[1]" {
+		t.Fatalf("Unexpected pages: %v", pages)
+	}
+
+	// Resume after the first page.
+	l, err := kv.List("users.", ListPageSize(10))
+	if err != nil {
+		t.Fatalf("Error listing: %v", err)
+	}
+	if !l.Next() || len(l.Page()[0].Value()) != 0 {
+		t.Fatalf("Unexpected page: %v, %v", l.Page(), l.Err())
+	}
+	cursor := l.Cursor()
+	if err := l.Stop(); err != nil {
+		t.Fatalf("Error stopping: %v", err)
+	}
+	if pages, _ := list("users.", ListPageSize(10), StartAfter(cursor)); fmt.Sprint(pages) != "[10 4]" {
+		t.Fatalf("Unexpected pages: %v", pages)
+	}
+
+	l, _ = kv.List("users.2", ListValues())
+	if !l.Next() || string(l.Page()[0].Value()) != "user 2" {
+		t.Fatalf("Unexpected page: %v, %v", l.Page(), l.Err())
+	}
+	l.Stop()
+
+	// Listings interrupted before all the keys were listed fail.
+	for i := 0; i < 300; i++ {
+		kv.Put(fmt.Sprintf("many.%d", i), nil)
+	}
+	nc2, js2 := jsClient(t, s)
+	kv2, err := js2.KeyValue("USERS")
+	if err != nil {
+		t.Fatalf("Error getting bucket: %v", err)
+	}
+	l, err = kv2.List("many.", ListPageSize(1000))
+	if err != nil {
+		t.Fatalf("Error listing: %v", err)
+	}
+	nc2.Close()
+	if l.Next() || l.Err() != ErrConnectionClosed {
+		t.Fatalf("Expected %v, got %v", ErrConnectionClosed, l.Err())
+	}
+
+	if _, err := kv.List("a b."); err != ErrInvalidKey {
+		t.Fatalf("Expected %v, got %v", ErrInvalidKey, err)
+	}
+	if _, err := kv.List("users.", StartAfter("x")); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+}
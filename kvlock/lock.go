@@ -0,0 +1,369 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kvlock provides distributed locks and leader election on top of
+// a JetStream KeyValue bucket.
+//
+// A lock is a key whose value names its holder and the duration of its
+// lease. It is taken with KeyValue.Create, or with a revision-checked
+// KeyValue.Update when the previous lease expired or was released, and
+// renewed in the background with revision-checked updates:
+//
+//	l := kvlock.NewLocker(kv, "worker-1")
+//	lock, err := l.Acquire(ctx, "jobs", 10*time.Second)
+//	if err != nil {
+//		return err
+//	}
+//	defer lock.Release()
+//	select {
+//	case <-lock.Lost():
+//		// Stop working, another holder may have the lock.
+//	case <-work():
+//	}
+//
+// Leases expire relative to the server time of their last renewal, so
+// the clocks of the holders only need to be roughly in sync with it.
+package kvlock
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nuid"
+	"github.com/wutianze/nats.go"
+)
+
+var (
+	// ErrLocked is returned by TryAcquire when the lock is held.
+	ErrLocked = errors.New("kvlock: lock is held")
+	// ErrLockLost is returned by Release when the lock was lost.
+	ErrLockLost = errors.New("kvlock: lock was lost")
+	// ErrNoLeader is returned by Election.Leader when there is no leader.
+	ErrNoLeader = errors.New("kvlock: no leader")
+)
+
+// lease is the value of a held lock. A released lock has an empty value.
+type lease struct {
+	Owner string        `json:"owner"`
+	TTL   time.Duration `json:"ttl"`
+	// Token is the revision the lock was acquired at, not set on the
+	// acquiring write itself.
+	Token uint64 `json:"token,omitempty"`
+}
+
+// leaseOf returns the lease of an entry and its remaining time, or nil if
+// the lock is free.
+func leaseOf(e nats.KeyValueEntry) (*lease, time.Duration) {
+	if e == nil || e.Operation() != nats.KeyValuePut || len(e.Value()) == 0 {
+		return nil, 0
+	}
+	var ls lease
+	if err := json.Unmarshal(e.Value(), &ls); err != nil || ls.Owner == "" {
+		return nil, 0
+	}
+	remaining := time.Until(e.Created().Add(ls.TTL))
+	if remaining <= 0 {
+		return nil, 0
+	}
+	if ls.Token == 0 {
+		ls.Token = e.Revision()
+	}
+	return &ls, remaining
+}
+
+// Locker acquires locks in a bucket on behalf of an owner.
+type Locker struct {
+	kv    nats.KeyValue
+	owner string
+}
+
+// NewLocker returns a locker for the bucket. The owner identifies the
+// holder of the locks and must be unique, a random one is used if empty.
+func NewLocker(kv nats.KeyValue, owner string) *Locker {
+	if owner == "" {
+		owner = nuid.Next()
+	}
+	return &Locker{kv: kv, owner: owner}
+}
+
+// Owner returns the owner of the locks acquired by this locker.
+func (l *Locker) Owner() string {
+	return l.owner
+}
+
+// Acquire blocks until the lock of the key is acquired or the context is
+// done. Waiting acquirers are woken up when the lock is released and
+// retry when its lease expires. The lease is renewed in the background
+// until the lock is released or lost.
+func (l *Locker) Acquire(ctx context.Context, key string, ttl time.Duration) (*Lock, error) {
+	if ctx == nil {
+		return nil, nats.ErrInvalidContext
+	}
+	if ttl <= 0 {
+		return nil, nats.ErrInvalidArg
+	}
+	w, err := l.kv.Watch(key)
+	if err != nil {
+		return nil, err
+	}
+	defer w.Stop()
+
+	for {
+		lk, wait, err := l.tryAcquire(key, ttl)
+		if lk != nil || err != nil {
+			return lk, err
+		}
+		t := time.NewTimer(wait)
+		select {
+		case _, ok := <-w.Updates():
+			if !ok {
+				t.Stop()
+				return nil, nats.ErrConnectionClosed
+			}
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		}
+		t.Stop()
+	}
+}
+
+// TryAcquire acquires the lock of the key, or returns ErrLocked if it is
+// held.
+func (l *Locker) TryAcquire(key string, ttl time.Duration) (*Lock, error) {
+	if ttl <= 0 {
+		return nil, nats.ErrInvalidArg
+	}
+	lk, _, err := l.tryAcquire(key, ttl)
+	if lk == nil && err == nil {
+		err = ErrLocked
+	}
+	return lk, err
+}
+
+// tryAcquire returns the lock if acquired, or how long to wait for the
+// current lease to expire.
+func (l *Locker) tryAcquire(key string, ttl time.Duration) (*Lock, time.Duration, error) {
+	data, err := json.Marshal(&lease{Owner: l.owner, TTL: ttl})
+	if err != nil {
+		return nil, 0, err
+	}
+	var rev uint64
+	e, err := l.kv.Get(key)
+	switch {
+	case err == nats.ErrKeyNotFound:
+		rev, err = l.kv.Create(key, data)
+	case err != nil:
+		return nil, 0, err
+	default:
+		if ls, remaining := leaseOf(e); ls != nil {
+			return nil, remaining, nil
+		}
+		rev, err = l.kv.Update(key, data, e.Revision())
+	}
+	if nats.IsWrongLastSequence(err) {
+		// Another acquirer won, its write wakes us up if it is short lived.
+		return nil, ttl, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	lk := &Lock{
+		l:      l,
+		key:    key,
+		ttl:    ttl,
+		token:  rev,
+		rev:    rev,
+		lost:   make(chan struct{}),
+		stop:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+	if lk.w, err = l.kv.Watch(key); err != nil {
+		l.kv.Update(key, nil, rev)
+		return nil, 0, err
+	}
+	go lk.run()
+	return lk, 0, nil
+}
+
+// Lock is an acquired lock.
+type Lock struct {
+	l      *Locker
+	key    string
+	ttl    time.Duration
+	token  uint64
+	w      nats.KeyWatcher
+	lost   chan struct{}
+	stop   chan struct{}
+	exited chan struct{}
+
+	mu       sync.Mutex
+	rev      uint64
+	isLost   bool
+	released bool
+}
+
+// Key returns the locked key.
+func (lk *Lock) Key() string {
+	return lk.key
+}
+
+// Token returns the fencing token of the lock, the revision of the key
+// when it was acquired. Tokens increase with each acquisition, so that
+// resources protected by the lock can reject the requests of a previous
+// holder that did not notice it lost the lock.
+func (lk *Lock) Token() uint64 {
+	return lk.token
+}
+
+// Lost returns a channel closed when the lock is no longer held, because
+// its lease could not be renewed, the key was changed by someone else, or
+// the lock was released.
+func (lk *Lock) Lost() <-chan struct{} {
+	return lk.lost
+}
+
+// owns returns whether the entry is a write of this lock.
+func (lk *Lock) owns(e nats.KeyValueEntry) bool {
+	var ls lease
+	if e.Operation() != nats.KeyValuePut || json.Unmarshal(e.Value(), &ls) != nil {
+		return false
+	}
+	if ls.Token == 0 {
+		ls.Token = e.Revision()
+	}
+	return ls.Owner == lk.l.owner && ls.Token == lk.token
+}
+
+// run renews the lease and watches the key until the lock is released or
+// lost.
+func (lk *Lock) run() {
+	defer close(lk.exited)
+	renew := time.NewTicker(lk.ttl / 3)
+	defer renew.Stop()
+	data, _ := json.Marshal(&lease{Owner: lk.l.owner, TTL: lk.ttl, Token: lk.token})
+	expires := time.Now().Add(lk.ttl)
+	updates := lk.w.Updates()
+	for {
+		select {
+		case <-lk.stop:
+			return
+		case e, ok := <-updates:
+			if !ok {
+				// Keep renewing, which detects the loss of the lock.
+				updates = nil
+				continue
+			}
+			if e != nil && !lk.owns(e) {
+				lk.setLost()
+				return
+			}
+		case <-renew.C:
+			lk.mu.Lock()
+			rev := lk.rev
+			lk.mu.Unlock()
+			nrev, err := lk.l.kv.Update(lk.key, data, rev)
+			if err == nil {
+				lk.mu.Lock()
+				lk.rev = nrev
+				lk.mu.Unlock()
+				expires = time.Now().Add(lk.ttl)
+			} else if nats.IsWrongLastSequence(err) || time.Now().After(expires) {
+				lk.setLost()
+				return
+			}
+		}
+	}
+}
+
+func (lk *Lock) setLost() {
+	lk.mu.Lock()
+	lk.isLost = true
+	lk.mu.Unlock()
+	lk.w.Stop()
+	close(lk.lost)
+}
+
+// Release releases the lock, waking up the waiting acquirers. It returns
+// ErrLockLost if the lock was lost.
+func (lk *Lock) Release() error {
+	lk.mu.Lock()
+	if lk.released {
+		lk.mu.Unlock()
+		return nil
+	}
+	lk.released = true
+	lk.mu.Unlock()
+
+	close(lk.stop)
+	<-lk.exited
+
+	lk.mu.Lock()
+	rev, isLost := lk.rev, lk.isLost
+	lk.mu.Unlock()
+	if isLost {
+		return ErrLockLost
+	}
+	lk.w.Stop()
+	defer close(lk.lost)
+	if _, err := lk.l.kv.Update(lk.key, nil, rev); err != nil {
+		if nats.IsWrongLastSequence(err) {
+			return ErrLockLost
+		}
+		return err
+	}
+	return nil
+}
+
+// Election elects a leader among the lockers campaigning on a key.
+type Election struct {
+	l   *Locker
+	key string
+	ttl time.Duration
+}
+
+// Election returns an election on the key, the leader holding its lock
+// with leases of the given duration.
+func (l *Locker) Election(key string, ttl time.Duration) *Election {
+	return &Election{l: l, key: key, ttl: ttl}
+}
+
+// Campaign blocks until this locker is elected or the context is done.
+// The returned lock's Token is the fencing token of the leadership, and
+// its Lost channel notifies the loss of the leadership. Releasing the
+// lock resigns.
+func (e *Election) Campaign(ctx context.Context) (*Lock, error) {
+	return e.l.Acquire(ctx, e.key, e.ttl)
+}
+
+// Leader returns the owner of the current leader and its fencing token,
+// or ErrNoLeader.
+func (e *Election) Leader() (string, uint64, error) {
+	entry, err := e.l.kv.Get(e.key)
+	if err == nats.ErrKeyNotFound {
+		return "", 0, ErrNoLeader
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	ls, _ := leaseOf(entry)
+	if ls == nil {
+		return "", 0, ErrNoLeader
+	}
+	return ls.Owner, ls.Token, nil
+}
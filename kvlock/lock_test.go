@@ -0,0 +1,189 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kvlock
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/wutianze/nats.go"
+)
+
+func setup(t *testing.T) (nats.KeyValue, func()) {
+	t.Helper()
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	s := natsserver.RunServer(&opts)
+
+	nc, err := nats.Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatalf("Error getting JetStream context: %v", err)
+	}
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "LOCKS"})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	return kv, func() {
+		nc.Close()
+		s.Shutdown()
+		os.RemoveAll(opts.StoreDir)
+	}
+}
+
+func TestLock(t *testing.T) {
+	kv, teardown := setup(t)
+	defer teardown()
+
+	l1, l2 := NewLocker(kv, "one"), NewLocker(kv, "two")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	lk, err := l1.Acquire(ctx, "job", 300*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error acquiring lock: %v", err)
+	}
+	if _, err := l2.TryAcquire("job", time.Second); err != ErrLocked {
+		t.Fatalf("Expected %v, got %v", ErrLocked, err)
+	}
+	// The lease is renewed past its TTL.
+	time.Sleep(500 * time.Millisecond)
+	if _, err := l2.TryAcquire("job", time.Second); err != ErrLocked {
+		t.Fatalf("Expected %v, got %v", ErrLocked, err)
+	}
+
+	// A blocked acquirer is woken up on release, with a greater token.
+	acquired := make(chan *Lock, 1)
+	go func() {
+		lk2, err := l2.Acquire(ctx, "job", time.Second)
+		if err != nil {
+			t.Errorf("Error acquiring lock: %v", err)
+		}
+		acquired <- lk2
+	}()
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if err := lk.Release(); err != nil {
+		t.Fatalf("Error releasing lock: %v", err)
+	}
+	select {
+	case <-lk.Lost():
+	default:
+		t.Fatal("Released lock should be reported as lost")
+	}
+	var lk2 *Lock
+	select {
+	case lk2 = <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Waiting acquirer not woken up")
+	}
+	if lk2 == nil {
+		t.FailNow()
+	}
+	if d := time.Since(start); d > 250*time.Millisecond {
+		t.Fatalf("Acquired after %v", d)
+	}
+	if lk2.Token() <= lk.Token() {
+		t.Fatalf("Expected token greater than %v, got %v", lk.Token(), lk2.Token())
+	}
+
+	// The holder is notified when the lock is taken away.
+	e, err := kv.Get("job")
+	if err != nil {
+		t.Fatalf("Error getting key: %v", err)
+	}
+	if _, err := kv.Update("job", []byte(`{"owner":"intruder","ttl":1000000000}`), e.Revision()); err != nil {
+		t.Fatalf("Error updating key: %v", err)
+	}
+	select {
+	case <-lk2.Lost():
+	case <-time.After(time.Second):
+		t.Fatal("Lost lock not reported")
+	}
+	if err := lk2.Release(); err != ErrLockLost {
+		t.Fatalf("Expected %v, got %v", ErrLockLost, err)
+	}
+
+	// The lease of a holder that stopped renewing expires.
+	kv.Put("job", []byte(`{"owner":"crashed","ttl":200000000}`))
+	start = time.Now()
+	lk3, err := l1.Acquire(ctx, "job", time.Second)
+	if err != nil {
+		t.Fatalf("Error acquiring lock: %v", err)
+	}
+	defer lk3.Release()
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("Acquired before the lease expired, after %v", d)
+	}
+
+	cctx, ccancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer ccancel()
+	if _, err := l2.Acquire(cctx, "job", time.Second); err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v, got %v", context.DeadlineExceeded, err)
+	}
+}
+
+func TestElection(t *testing.T) {
+	kv, teardown := setup(t)
+	defer teardown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	e1 := NewLocker(kv, "one").Election("leader", time.Second)
+	e2 := NewLocker(kv, "two").Election("leader", time.Second)
+	if _, _, err := e1.Leader(); err != ErrNoLeader {
+		t.Fatalf("Expected %v, got %v", ErrNoLeader, err)
+	}
+	lead, err := e1.Campaign(ctx)
+	if err != nil {
+		t.Fatalf("Error on campaign: %v", err)
+	}
+	owner, token, err := e2.Leader()
+	if err != nil || owner != "one" || token != lead.Token() {
+		t.Fatalf("Unexpected leader: %q, %v, %v", owner, token, err)
+	}
+
+	elected := make(chan *Lock, 1)
+	go func() {
+		lk, _ := e2.Campaign(ctx)
+		elected <- lk
+	}()
+	if err := lead.Release(); err != nil {
+		t.Fatalf("Error resigning: %v", err)
+	}
+	select {
+	case lk := <-elected:
+		if lk == nil {
+			t.Fatal("Not elected")
+		}
+		defer lk.Release()
+		// The token is kept by the renewals.
+		time.Sleep(500 * time.Millisecond)
+		owner, token, err := e1.Leader()
+		if err != nil || owner != "two" || token != lk.Token() || token <= lead.Token() {
+			t.Fatalf("Unexpected leader: %q, %v, %v", owner, token, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Not elected")
+	}
+}
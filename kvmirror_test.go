@@ -0,0 +1,256 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+)
+
+func waitForKV(t *testing.T, kv KeyValue, values map[string]string) {
+	t.Helper()
+	var last string
+	for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(20 * time.Millisecond) {
+		last = _EMPTY_
+		for k, v := range values {
+			e, err := kv.Get(k)
+			if err != nil || string(e.Value()) != v {
+				last = fmt.Sprintf("%q: %v, %v", k, e, err)
+				break
+			}
+		}
+		if last == _EMPTY_ {
+			return
+		}
+	}
+	t.Fatalf("Values not replicated, last %s", last)
+}
+
+func TestKeyValueMirror(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	origin, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "ORIGIN", History: 3})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	origin.Put("a", []byte("1"))
+	origin.Put("b", []byte("1"))
+
+	mirror, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "REPLICA", History: 3, Mirror: &StreamSource{Name: "ORIGIN"}})
+	if err != nil {
+		t.Fatalf("Error creating mirror: %v", err)
+	}
+	waitForKV(t, mirror, map[string]string{"a": "1", "b": "1"})
+	if _, err := mirror.Put("a", []byte("2")); err != ErrKeyValueReadOnly {
+		t.Fatalf("Expected %v, got %v", ErrKeyValueReadOnly, err)
+	}
+	if err := mirror.Delete("a"); err != ErrKeyValueReadOnly {
+		t.Fatalf("Expected %v, got %v", ErrKeyValueReadOnly, err)
+	}
+
+	w, err := mirror.Watch("a")
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	defer w.Stop()
+	if e := <-w.Updates(); e == nil || string(e.Value()) != "1" {
+		t.Fatalf("Unexpected entry: %+v", e)
+	}
+	<-w.Updates()
+	origin.Put("a", []byte("2"))
+	select {
+	case e := <-w.Updates():
+		if e.Key() != "a" || string(e.Value()) != "2" {
+			t.Fatalf("Unexpected entry: %+v", e)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not get the update")
+	}
+
+	// Bound mirrors read the keys of the origin.
+	bound, err := js.KeyValue("REPLICA")
+	if err != nil {
+		t.Fatalf("Error binding mirror: %v", err)
+	}
+	expectKV(t, bound, map[string]string{"a": "2", "b": "1"})
+	if h, err := bound.History("a"); err != nil || len(h) != 2 {
+		t.Fatalf("Unexpected history: %v, %v", h, err)
+	}
+	if _, err := bound.Put("a", nil); err != ErrKeyValueReadOnly {
+		t.Fatalf("Expected %v, got %v", ErrKeyValueReadOnly, err)
+	}
+
+	if _, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "BAD", Mirror: &StreamSource{Name: "ORIGIN"},
+		Sources: []*StreamSource{{Name: "ORIGIN"}}}); err == nil {
+		t.Fatal("Expected error with both mirror and sources")
+	}
+	if _, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "BAD", Mirror: &StreamSource{Name: "a.b"}}); err != ErrInvalidBucketName {
+		t.Fatalf("Expected %v, got %v", ErrInvalidBucketName, err)
+	}
+}
+
+func TestKeyValueSources(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	eu, _ := js.CreateKeyValue(&KeyValueConfig{Bucket: "EU", History: 5})
+	us, _ := js.CreateKeyValue(&KeyValueConfig{Bucket: "US", History: 5})
+	eu.Put("x", []byte("eu"))
+	us.Put("y", []byte("us"))
+
+	cfg := &KeyValueConfig{
+		Bucket:  "GLOBAL",
+		History: 5,
+		Sources: []*StreamSource{{Name: "EU"}, {Name: "KV_US"}},
+	}
+	if !nc.serverMinVersion(2, 10, 0) {
+		if _, err := js.CreateKeyValue(cfg); err == nil {
+			t.Fatal("Expected error creating merged bucket")
+		}
+		t.Skip("Merged buckets require server version 2.10.0")
+	}
+	global, err := js.CreateKeyValue(cfg)
+	if err != nil {
+		t.Fatalf("Error creating merged bucket: %v", err)
+	}
+	if _, err := global.Put("z", []byte("local")); err != nil {
+		t.Fatalf("Error on put: %v", err)
+	}
+	waitForKV(t, global, map[string]string{"x": "eu", "y": "us", "z": "local"})
+
+	// The latest value wins, wherever it comes from.
+	us.Put("x", []byte("us"))
+	waitForKV(t, global, map[string]string{"x": "us"})
+	global.Put("x", []byte("local"))
+	expectKV(t, global, map[string]string{"x": "local"})
+	eu.Delete("y")
+	us.Delete("y")
+	waitForKV(t, global, map[string]string{"x": "local", "z": "local"})
+	time.Sleep(100 * time.Millisecond)
+	expectKV(t, global, map[string]string{"y": ""})
+
+	keys, err := global.Keys()
+	if err != nil {
+		t.Fatalf("Error getting keys: %v", err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "x" || keys[1] != "z" {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+	history, err := global.History("x")
+	if err != nil || len(history) != 3 {
+		t.Fatalf("Unexpected history: %v, %v", history, err)
+	}
+	if e, err := global.GetRevision("x", history[0].Revision()); err != nil || string(e.Value()) != "eu" {
+		t.Fatalf("Unexpected entry: %v, %v", e, err)
+	}
+
+	// Values of the sources are values of the bucket.
+	if _, err := global.Create("x", []byte("again")); err == nil {
+		t.Fatal("Expected error creating existing key")
+	}
+	eu.Put("n", []byte("1"))
+	waitForKV(t, global, map[string]string{"n": "1"})
+	e, err := global.Get("n")
+	if err != nil {
+		t.Fatalf("Error on get: %v", err)
+	}
+	if _, err := global.Update("n", []byte("2"), e.Revision()); err != nil {
+		t.Fatalf("Error on update: %v", err)
+	}
+	if v, err := global.Increment("n", 3); err != nil || v != 5 {
+		t.Fatalf("Unexpected increment: %v, %v", v, err)
+	}
+	global.Delete("n")
+
+	bound, err := js.KeyValue("GLOBAL")
+	if err != nil {
+		t.Fatalf("Error binding bucket: %v", err)
+	}
+	expectKV(t, bound, map[string]string{"x": "local", "y": "", "z": "local"})
+
+	// Merged buckets are restored as regular buckets.
+	var buf bytes.Buffer
+	if err := global.Snapshot(&buf); err != nil {
+		t.Fatalf("Error on snapshot: %v", err)
+	}
+	js.DeleteKeyValue("GLOBAL")
+	restored, err := js.RestoreKeyValue(&buf)
+	if err != nil {
+		t.Fatalf("Error on restore: %v", err)
+	}
+	expectKV(t, restored, map[string]string{"x": "local", "y": "", "z": "local"})
+	if h, err := restored.History("x"); err != nil || len(h) != 3 {
+		t.Fatalf("Unexpected history: %v, %v", h, err)
+	}
+}
+
+func TestKeyValueSourceTransforms(t *testing.T) {
+	sources := []*StreamSource{{Name: "EU"}, {Name: "KV_US", Domain: "us"}}
+	scs, err := kvStreamSources("GLOBAL", sources)
+	if err != nil {
+		t.Fatalf("Error converting sources: %v", err)
+	}
+	for i, src := range []string{"$KV.EU.>", "$KV.US.>"} {
+		st := scs[i].SubjectTransforms
+		if len(st) != 1 || st[0].Source != src || st[0].Destination != "$KV.GLOBAL.>" {
+			t.Fatalf("Unexpected transforms: %+v", st)
+		}
+	}
+	if scs[0].Name != "KV_EU" || scs[1].Name != "KV_US" || scs[1].Domain != "us" {
+		t.Fatalf("Unexpected sources: %+v, %+v", scs[0], scs[1])
+	}
+	if sources[0].Name != "EU" || sources[0].SubjectTransforms != nil {
+		t.Fatal("Sources should not be modified")
+	}
+	if _, err := kvStreamSources("GLOBAL", []*StreamSource{{Name: "a.b"}}); err != ErrInvalidBucketName {
+		t.Fatalf("Expected %v, got %v", ErrInvalidBucketName, err)
+	}
+}
+
+func TestStreamSourceDomain(t *testing.T) {
+	cfg := &StreamConfig{
+		Name:    "S",
+		Mirror:  &StreamSource{Name: "M", Domain: "hub"},
+		Sources: []*StreamSource{{Name: "A"}, {Name: "B", Domain: "leaf"}},
+	}
+	ncfg, err := cfg.withDomains()
+	if err != nil {
+		t.Fatalf("Error converting domains: %v", err)
+	}
+	if ext := ncfg.Mirror.External; ext == nil || ext.APIPrefix != "$JS.hub.API" {
+		t.Fatalf("Unexpected external stream: %+v", ext)
+	}
+	if ncfg.Sources[0].External != nil || ncfg.Sources[1].External.APIPrefix != "$JS.leaf.API" {
+		t.Fatalf("Unexpected sources: %+v, %+v", ncfg.Sources[0], ncfg.Sources[1])
+	}
+	if cfg.Mirror.External != nil || cfg.Sources[1].External != nil {
+		t.Fatal("Config should not be modified")
+	}
+
+	cfg.Mirror.External = &ExternalStream{APIPrefix: "$JS.other.API"}
+	if _, err := cfg.withDomains(); err == nil {
+		t.Fatal("Expected error with both domain and external")
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+)
+
+// Per-key expiry is applied by the clients. PutWithTTL stores the TTL in
+// the kvTTLHdr header of the value, and records the revision and TTL in an
+// index entry stored under the reserved kvExpPrefix key prefix. Values
+// expire their TTL after the time they were stored at, as recorded by the
+// server, so that the clocks of the clients only need to be in sync with
+// the one of the servers. Get and watchers report values past their TTL
+// as expired, and ReapExpired replaces them by an expired marker rolling
+// up the key. The markers and the removal of the index entries are
+// revision-checked writes, so that any number of clients can reap at the
+// same time, each key being reaped once.
+const (
+	kvTTLHdr    = "KV-TTL"
+	kvExpPrefix = "_exp."
+)
+
+type kvExpiry struct {
+	Revision uint64        `json:"rev"`
+	TTL      time.Duration `json:"ttl"`
+}
+
+// kvMsgExpires returns when the message expires, which is its TTL after
+// the time it was stored at, and false if it has no TTL.
+func kvMsgExpires(hdr Header, created time.Time) (time.Time, bool) {
+	ttl, err := time.ParseDuration(hdr.Get(kvTTLHdr))
+	if err != nil {
+		return time.Time{}, false
+	}
+	return created.Add(ttl), true
+}
+
+// kvMsgExpired returns true if the message has a TTL and is past it.
+func kvMsgExpired(hdr Header, created time.Time) bool {
+	expires, ok := kvMsgExpires(hdr, created)
+	return ok && !time.Now().Before(expires)
+}
+
+// PutWithTTL will place the new value for the key into the store, which
+// expires after ttl. The key then reads as not found, and is replaced by
+// an expired marker once reaped by ReapExpired. Writing the key again
+// cancels the expiry, unless it is written with PutWithTTL.
+func (kv *kvs) PutWithTTL(key string, value []byte, ttl time.Duration) (uint64, error) {
+	if !keyValid(key) || kvReservedKey(key) {
+		return 0, ErrInvalidKey
+	}
+	if ttl <= 0 {
+		return 0, ErrInvalidArg
+	}
+	if err := kv.checkWritable(); err != nil {
+		return 0, err
+	}
+	m := &Msg{Subject: kv.putSubject(key), Header: Header{}, Data: value}
+	m.Header.Set(kvTTLHdr, ttl.String())
+	pa, err := kv.js.PublishMsg(m)
+	if err != nil {
+		return 0, err
+	}
+	idx, err := json.Marshal(&kvExpiry{Revision: pa.Sequence, TTL: ttl})
+	if err != nil {
+		return 0, err
+	}
+	// Should the client fail here, the value still reads as expired but
+	// is not reaped.
+	if _, err := kv.Put(kvExpPrefix+key, idx); err != nil {
+		return 0, err
+	}
+	return pa.Sequence, nil
+}
+
+// ReapExpired places an expired marker, removing the value, for every key
+// past its TTL, and returns how many keys it reaped. It is meant to be
+// called periodically and can be called by several clients at once.
+func (kv *kvs) ReapExpired() (int, error) {
+	if err := kv.checkWritable(); err != nil {
+		return 0, err
+	}
+	w, err := kv.Watch(kvExpPrefix+AllKeys, IgnoreDeletes())
+	if err != nil {
+		return 0, err
+	}
+	var index []KeyValueEntry
+	for e := range w.Updates() {
+		if e == nil {
+			break
+		}
+		index = append(index, e)
+	}
+	w.Stop()
+
+	var reaped int
+	for _, e := range index {
+		// The index entry is stored after the value, it expires later.
+		var exp kvExpiry
+		if err := json.Unmarshal(e.Value(), &exp); err == nil && time.Now().Before(e.Created().Add(exp.TTL)) {
+			continue
+		}
+		key := e.Key()[len(kvExpPrefix):]
+		m, err := kv.lastMsg(key)
+		if err != nil {
+			return reaped, err
+		}
+		// The index entry is stale if the key was written since.
+		if m != nil && m.Sequence == exp.Revision && m.Header.Get(kvTTLHdr) != _EMPTY_ {
+			if !kvMsgExpired(m.Header, m.Time) {
+				continue
+			}
+			err := kv.putMarker(key, kvexpired, m.Sequence)
+			if err == nil {
+				reaped++
+			} else if !IsWrongLastSequence(err) {
+				return reaped, err
+			}
+		}
+		// The index entry may have been updated by PutWithTTL in between.
+		if err := kv.putMarker(e.Key(), kvpurge, e.Revision()); err != nil && !IsWrongLastSequence(err) {
+			return reaped, err
+		}
+	}
+	return reaped, nil
+}
+
+// putMarker places a marker of the given operation rolling up the key iff
+// its latest revision matches.
+func (kv *kvs) putMarker(key, op string, revision uint64) error {
+	m := NewMsg(kv.putSubject(key))
+	m.Header.Set(kvop, op)
+	m.Header.Set(MsgRollup, MsgRollupSubject)
+	m.Header.Set(ExpectedLastSubjSeqHdr, strconv.FormatUint(revision, 10))
+	_, err := kv.js.PublishMsg(m)
+	return err
+}
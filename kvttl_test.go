@@ -0,0 +1,155 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKeyValueTTL(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "SESSIONS", History: 5})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	w, err := kv.Watch("session.*")
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	defer w.Stop()
+	if e := <-w.Updates(); e != nil {
+		t.Fatalf("Expected initial marker, got %+v", e)
+	}
+
+	if _, err := kv.PutWithTTL("session.a", []byte("a"), 200*time.Millisecond); err != nil {
+		t.Fatalf("Error on put: %v", err)
+	}
+	kv.PutWithTTL("session.b", []byte("b"), time.Minute)
+	kv.Put("session.c", []byte("c"))
+	expectKV(t, kv, map[string]string{"session.a": "a", "session.b": "b", "session.c": "c"})
+	if n, err := kv.ReapExpired(); err != nil || n != 0 {
+		t.Fatalf("Unexpected reap: %v, %v", n, err)
+	}
+
+	// Expired keys are not found before being reaped.
+	time.Sleep(300 * time.Millisecond)
+	expectKV(t, kv, map[string]string{"session.a": "", "session.b": "b"})
+	if keys, _ := kv.Keys(); len(keys) != 2 || keys[0] == "session.a" || keys[1] == "session.a" {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+	ew, err := kv.Watch("session.a")
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	if e := <-ew.Updates(); e == nil || e.Operation() != KeyValueExpired {
+		t.Fatalf("Expected the key to be expired, got %+v", e)
+	}
+	ew.Stop()
+
+	// Concurrent reapers reap the key once.
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		reaped int
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := kv.ReapExpired()
+			if err != nil {
+				t.Errorf("Error reaping: %v", err)
+			}
+			mu.Lock()
+			reaped += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if reaped != 1 {
+		t.Fatalf("Expected 1 key reaped, got %d", reaped)
+	}
+	if _, err := kv.GetRevision("session.a", 1); err != ErrKeyNotFound {
+		t.Fatalf("Expected the value to be removed, got %v", err)
+	}
+
+	for _, expected := range []struct {
+		key string
+		op  KeyValueOp
+	}{
+		{"session.a", KeyValuePut},
+		{"session.b", KeyValuePut},
+		{"session.c", KeyValuePut},
+		{"session.a", KeyValueExpired},
+	} {
+		select {
+		case e := <-w.Updates():
+			if e.Key() != expected.key || e.Operation() != expected.op {
+				t.Fatalf("Expected %v of %q, got %v of %q", expected.op, expected.key, e.Operation(), e.Key())
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Did not get the update")
+		}
+	}
+
+	// The expiry index is hidden.
+	keys, err := kv.Keys()
+	if err != nil {
+		t.Fatalf("Error getting keys: %v", err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "session.b" || keys[1] != "session.c" {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+
+	// Writing the key again cancels the expiry.
+	kv.PutWithTTL("session.d", []byte("d"), 50*time.Millisecond)
+	kv.Put("session.d", []byte("kept"))
+	time.Sleep(100 * time.Millisecond)
+	if n, err := kv.ReapExpired(); err != nil || n != 0 {
+		t.Fatalf("Unexpected reap: %v, %v", n, err)
+	}
+	expectKV(t, kv, map[string]string{"session.d": "kept"})
+	ix, _ := kv.Watch(kvExpPrefix+AllKeys, IgnoreDeletes())
+	if e := <-ix.Updates(); e == nil || e.Key() != kvExpPrefix+"session.b" {
+		t.Fatalf("Unexpected index entry: %+v", e)
+	}
+	if e := <-ix.Updates(); e != nil {
+		t.Fatalf("Unexpected index entry: %+v", e)
+	}
+	ix.Stop()
+
+	// Expired keys can be created again.
+	kv.PutWithTTL("session.e", []byte("e"), 50*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := kv.Create("session.e", []byte("new")); err != nil {
+		t.Fatalf("Error on create: %v", err)
+	}
+	expectKV(t, kv, map[string]string{"session.e": "new"})
+
+	if _, err := kv.PutWithTTL("session.f", nil, 0); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+	if _, err := kv.PutWithTTL(kvExpPrefix+"x", nil, time.Second); err != ErrInvalidKey {
+		t.Fatalf("Expected %v, got %v", ErrInvalidKey, err)
+	}
+}
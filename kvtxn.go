@@ -0,0 +1,418 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// Transactions are applied by the client. The operations are recorded in
+// an intent record, stored under the reserved kvTxnPrefix key prefix,
+// before being applied one by one with revision-checked writes carrying
+// the kvTxnHdr header. The transaction commits when its intent record is
+// marked as committed. Until then, Get resolves the keys written by the
+// transaction to their previous value, which is kept in the intent
+// record, so that readers see either the old or the new state. So do
+// Keys, History and List, the writes of uncommitted transactions being
+// left out of the history. Watchers receive the writes as they are made,
+// with the kvTxnHdr header, before the transaction commits, followed by
+// the restored values if it is rolled back. The KeyValueCache reads the
+// keys with such values from the bucket until they are written again.
+//
+// A transaction failing, or found by RecoverTxns after its client crashed,
+// is rolled back by restoring the previous values of the keys it wrote.
+const (
+	kvTxnHdr       = "KV-Txn"
+	kvTxnPrefix    = "_txn."
+	kvTxnPending   = "pending"
+	kvTxnCommitted = "committed"
+	kvTxnAborted   = "aborted"
+)
+
+// ErrTxnConflict is returned when a transaction condition is not met or a
+// key was written concurrently. The transaction is then rolled back.
+var ErrTxnConflict = errors.New("nats: transaction conflict")
+
+// KeyValueTxn is a set of conditions and operations applied atomically to
+// a KeyValue bucket, built with KeyValue.Txn().
+type KeyValueTxn interface {
+	// IfRevision requires the latest revision of the key to be revision,
+	// 0 meaning that the key must not exist.
+	IfRevision(key string, revision uint64) KeyValueTxn
+	// Put places the value for the key.
+	Put(key string, value []byte) KeyValueTxn
+	// Delete places a delete marker for the key.
+	Delete(key string) KeyValueTxn
+	// Commit applies the operations if all conditions are met, or returns
+	// ErrTxnConflict and leaves the bucket unchanged.
+	Commit() error
+}
+
+type kvTxnOp struct {
+	Key string `json:"key"`
+	// Revision is the latest revision of the key, including delete
+	// markers, before the transaction. Existed and Old are its state.
+	Revision uint64    `json:"rev,omitempty"`
+	Existed  bool      `json:"existed,omitempty"`
+	Old      []byte    `json:"old,omitempty"`
+	Created  time.Time `json:"created"`
+	Value    []byte    `json:"value,omitempty"`
+	Delete   bool      `json:"delete,omitempty"`
+}
+
+type kvTxnIntent struct {
+	State string    `json:"state"`
+	Ops   []kvTxnOp `json:"ops"`
+}
+
+type kvTxnCond struct {
+	key      string
+	revision uint64
+}
+
+type kvTxn struct {
+	kv    *kvs
+	conds []kvTxnCond
+	ops   []kvTxnOp
+	err   error
+}
+
+// Txn returns a new transaction on the bucket.
+func (kv *kvs) Txn() KeyValueTxn {
+	return &kvTxn{kv: kv}
+}
+
+func (txn *kvTxn) checkKey(key string) bool {
+	if txn.err == nil && (!keyValid(key) || kvReservedKey(key)) {
+		txn.err = ErrInvalidKey
+	}
+	return txn.err == nil
+}
+
+func (txn *kvTxn) IfRevision(key string, revision uint64) KeyValueTxn {
+	if txn.checkKey(key) {
+		txn.conds = append(txn.conds, kvTxnCond{key, revision})
+	}
+	return txn
+}
+
+func (txn *kvTxn) Put(key string, value []byte) KeyValueTxn {
+	if txn.checkKey(key) {
+		txn.ops = append(txn.ops, kvTxnOp{Key: key, Value: value})
+	}
+	return txn
+}
+
+func (txn *kvTxn) Delete(key string) KeyValueTxn {
+	if txn.checkKey(key) {
+		txn.ops = append(txn.ops, kvTxnOp{Key: key, Delete: true})
+	}
+	return txn
+}
+
+// kvTxnCrash, when set by tests, simulates a crash of the client at the
+// given stage of a commit, which returns the error right away.
+var kvTxnCrash func(stage string) error
+
+func kvTxnCrashed(stage string) error {
+	if kvTxnCrash == nil {
+		return nil
+	}
+	return kvTxnCrash(stage)
+}
+
+func (txn *kvTxn) Commit() error {
+	if txn.err != nil {
+		return txn.err
+	}
+	kv := txn.kv
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, op := range txn.ops {
+		if seen[op.Key] {
+			return ErrInvalidArg
+		}
+		seen[op.Key] = true
+	}
+
+	// Read the current state of the keys.
+	for i := range txn.ops {
+		op := &txn.ops[i]
+		m, err := kv.lastMsg(op.Key)
+		if err != nil {
+			return err
+		}
+		if m != nil {
+			if kv.txnPending(m) {
+				return ErrTxnConflict
+			}
+			op.Revision, op.Created = m.Sequence, m.Time
+			op.Existed = m.Header.Get(kvop) == _EMPTY_
+			if op.Existed {
+				op.Old = m.Data
+			}
+		}
+	}
+	if err := txn.checkConds(nil); err != nil {
+		return err
+	}
+	if len(txn.ops) == 0 {
+		return nil
+	}
+
+	id := nuid.Next()
+	ikey := kvTxnPrefix + id
+	intent, err := json.Marshal(&kvTxnIntent{State: kvTxnPending, Ops: txn.ops})
+	if err != nil {
+		return err
+	}
+	irev, err := kv.Create(ikey, intent)
+	if err != nil {
+		return err
+	}
+	if err := kvTxnCrashed("intent"); err != nil {
+		return err
+	}
+
+	abort := func(cause error) error {
+		if err := kv.abortTxn(ikey, txn.ops); err != nil {
+			return err
+		}
+		return cause
+	}
+	for i, op := range txn.ops {
+		m := &Msg{Subject: kv.putSubject(op.Key), Header: Header{}, Data: op.Value}
+		m.Header.Set(kvTxnHdr, id)
+		m.Header.Set(ExpectedLastSubjSeqHdr, strconv.FormatUint(op.Revision, 10))
+		if op.Delete {
+			m.Data = nil
+			m.Header.Set(kvop, kvdel)
+		}
+		if _, err := kv.js.PublishMsg(m); err != nil {
+			if IsWrongLastSequence(err) {
+				err = ErrTxnConflict
+			}
+			return abort(err)
+		}
+		if err := kvTxnCrashed("op" + strconv.Itoa(i)); err != nil {
+			return err
+		}
+	}
+	// Conditions on keys not written may have changed in the meantime,
+	// the others are enforced by the revision-checked writes.
+	if err := txn.checkConds(seen); err != nil {
+		return abort(err)
+	}
+
+	// Commit point.
+	if intent, err = json.Marshal(&kvTxnIntent{State: kvTxnCommitted, Ops: txn.ops}); err != nil {
+		return abort(err)
+	}
+	if _, err := kv.Update(ikey, intent, irev); err != nil {
+		// Rolled back by RecoverTxns, finish the rollback of our writes.
+		if IsWrongLastSequence(err) {
+			err = ErrTxnConflict
+		}
+		return abort(err)
+	}
+	if err := kvTxnCrashed("commit"); err != nil {
+		return err
+	}
+	return kv.Purge(ikey)
+}
+
+// checkConds returns ErrTxnConflict if a condition is not met, skipping
+// the keys in skip.
+func (txn *kvTxn) checkConds(skip map[string]bool) error {
+	for _, c := range txn.conds {
+		if skip[c.key] {
+			continue
+		}
+		m, err := txn.kv.lastMsg(c.key)
+		if err != nil {
+			return err
+		}
+		var rev uint64
+		if m != nil && m.Header.Get(kvop) == _EMPTY_ {
+			rev = m.Sequence
+		}
+		if rev != c.revision || (m != nil && txn.kv.txnPending(m)) {
+			return ErrTxnConflict
+		}
+	}
+	return nil
+}
+
+func (kv *kvs) putSubject(key string) string {
+	var b strings.Builder
+	if kv.useJSPfx {
+		b.WriteString(kv.js.opts.pre)
+	}
+	b.WriteString(kv.pre)
+	b.WriteString(key)
+	return b.String()
+}
+
+// lastMsg returns the latest message of the key, including delete
+// markers, or nil if there is none.
+func (kv *kvs) lastMsg(key string) (*RawStreamMsg, error) {
+	m, err := kv.js.GetLastMsg(kv.stream, kv.pre+key)
+	if err == ErrMsgNotFound {
+		return nil, nil
+	}
+	return m, err
+}
+
+// txnIntent returns the intent record of a transaction and its revision,
+// or nil if the transaction is over.
+func (kv *kvs) txnIntent(ikey string) (*kvTxnIntent, uint64, time.Time, error) {
+	m, err := kv.lastMsg(ikey)
+	if err != nil || m == nil || m.Header.Get(kvop) != _EMPTY_ {
+		return nil, 0, time.Time{}, err
+	}
+	var intent kvTxnIntent
+	if err := json.Unmarshal(m.Data, &intent); err != nil {
+		return nil, 0, time.Time{}, err
+	}
+	return &intent, m.Sequence, m.Time, nil
+}
+
+// txnPending returns whether the message was written by a transaction
+// that is not committed. Errors are considered as pending.
+func (kv *kvs) txnPending(m *RawStreamMsg) bool {
+	id := m.Header.Get(kvTxnHdr)
+	if id == _EMPTY_ {
+		return false
+	}
+	intent, _, _, err := kv.txnIntent(kvTxnPrefix + id)
+	return err != nil || (intent != nil && intent.State != kvTxnCommitted)
+}
+
+// resolveTxn returns the entry of the key as it was before the transaction
+// that wrote the message of the given headers, if that transaction is not
+// committed, or nil.
+func (kv *kvs) resolveTxn(key string, hdr Header) (*kve, error) {
+	id := hdr.Get(kvTxnHdr)
+	if id == _EMPTY_ {
+		return nil, nil
+	}
+	intent, _, _, err := kv.txnIntent(kvTxnPrefix + id)
+	if err != nil || intent == nil || intent.State == kvTxnCommitted {
+		return nil, err
+	}
+	for _, op := range intent.Ops {
+		if op.Key != key {
+			continue
+		}
+		if !op.Existed {
+			return nil, ErrKeyNotFound
+		}
+		return &kve{bucket: kv.name, key: key, value: op.Old, revision: op.Revision, created: op.Created}, nil
+	}
+	return nil, nil
+}
+
+// abortTxn marks the transaction as aborted, restores the previous values
+// of the keys it wrote and removes its intent record. The operations are
+// taken from the intent record, or from ops if it was already removed.
+func (kv *kvs) abortTxn(ikey string, ops []kvTxnOp) error {
+	intent, rev, _, err := kv.txnIntent(ikey)
+	if err != nil {
+		return err
+	}
+	if intent != nil {
+		switch intent.State {
+		case kvTxnCommitted:
+			return kv.Purge(ikey)
+		case kvTxnPending:
+			intent.State = kvTxnAborted
+			data, err := json.Marshal(intent)
+			if err != nil {
+				return err
+			}
+			if _, err := kv.Update(ikey, data, rev); err != nil {
+				return err
+			}
+		}
+		ops = intent.Ops
+	}
+	id := ikey[len(kvTxnPrefix):]
+	for _, op := range ops {
+		m, err := kv.lastMsg(op.Key)
+		if err != nil {
+			return err
+		}
+		if m == nil || m.Header.Get(kvTxnHdr) != id {
+			continue
+		}
+		rm := &Msg{Subject: kv.putSubject(op.Key), Header: Header{}, Data: op.Old}
+		rm.Header.Set(ExpectedLastSubjSeqHdr, strconv.FormatUint(m.Sequence, 10))
+		if !op.Existed {
+			rm.Data = nil
+			rm.Header.Set(kvop, kvdel)
+		}
+		if _, err := kv.js.PublishMsg(rm); err != nil && !IsWrongLastSequence(err) {
+			return err
+		}
+	}
+	if intent == nil {
+		return nil
+	}
+	return kv.Purge(ikey)
+}
+
+// RecoverTxns completes the transactions left over by clients that
+// crashed: committed transactions are rolled forward by removing their
+// intent record, and uncommitted ones started more than olderThan ago
+// are rolled back. olderThan must be longer than transactions take to
+// commit, not to roll back transactions in progress.
+func (kv *kvs) RecoverTxns(olderThan time.Duration) error {
+	if err := kv.checkWritable(); err != nil {
+		return err
+	}
+	w, err := kv.Watch(kvTxnPrefix+AllKeys, IgnoreDeletes(), MetaOnly())
+	if err != nil {
+		return err
+	}
+	var ikeys []string
+	for e := range w.Updates() {
+		if e == nil {
+			break
+		}
+		ikeys = append(ikeys, e.Key())
+	}
+	w.Stop()
+
+	for _, ikey := range ikeys {
+		intent, _, created, err := kv.txnIntent(ikey)
+		if err != nil {
+			return err
+		}
+		if intent == nil || (intent.State == kvTxnPending && time.Since(created) < olderThan) {
+			continue
+		}
+		if err := kv.abortTxn(ikey, nil); err != nil && !IsWrongLastSequence(err) {
+			return err
+		}
+	}
+	return nil
+}
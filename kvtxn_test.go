@@ -0,0 +1,210 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errTxnCrashed = errors.New("nats: simulated transaction crash")
+
+// crashTxn commits the transaction, simulating a crash of the client at
+// the given stage of the commit.
+func crashTxn(t *testing.T, txn KeyValueTxn, stage string) {
+	t.Helper()
+	kvTxnCrash = func(s string) error {
+		if s == stage {
+			return errTxnCrashed
+		}
+		return nil
+	}
+	defer func() { kvTxnCrash = nil }()
+	if err := txn.Commit(); err != errTxnCrashed {
+		t.Fatalf("Expected crash, got %v", err)
+	}
+}
+
+func expectKV(t *testing.T, kv KeyValue, values map[string]string) {
+	t.Helper()
+	for k, v := range values {
+		e, err := kv.Get(k)
+		if v == _EMPTY_ {
+			if err != ErrKeyNotFound {
+				t.Fatalf("Expected %q to not be found, got %v, %v", k, e, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error getting %q: %v", k, err)
+		}
+		if string(e.Value()) != v {
+			t.Fatalf("Expected %q to be %q, got %q", k, v, e.Value())
+		}
+	}
+}
+
+func TestKeyValueTxn(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "CONFIG"})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	rev, _ := kv.Put("a", []byte("1"))
+	kv.Put("b", []byte("1"))
+	kv.Put("c", []byte("1"))
+
+	if err := kv.Txn().IfRevision("a", rev).IfRevision("new", 0).
+		Put("a", []byte("2")).Put("new", []byte("2")).Delete("c").Commit(); err != nil {
+		t.Fatalf("Error on commit: %v", err)
+	}
+	expectKV(t, kv, map[string]string{"a": "2", "b": "1", "c": "", "new": "2"})
+
+	// Failed conditions leave the bucket unchanged.
+	if err := kv.Txn().IfRevision("a", rev).Put("a", []byte("3")).Put("b", []byte("3")).Commit(); err != ErrTxnConflict {
+		t.Fatalf("Expected %v, got %v", ErrTxnConflict, err)
+	}
+	if err := kv.Txn().IfRevision("new", 0).Put("b", []byte("3")).Commit(); err != ErrTxnConflict {
+		t.Fatalf("Expected %v, got %v", ErrTxnConflict, err)
+	}
+	expectKV(t, kv, map[string]string{"a": "2", "b": "1"})
+
+	// A concurrent write in the middle of the commit rolls it back.
+	kvTxnCrash = func(stage string) error {
+		if stage == "op0" {
+			kv.Put("b", []byte("other"))
+		}
+		return nil
+	}
+	err = kv.Txn().Put("a", []byte("4")).Put("b", []byte("4")).Commit()
+	kvTxnCrash = nil
+	if err != ErrTxnConflict {
+		t.Fatalf("Expected %v, got %v", ErrTxnConflict, err)
+	}
+	expectKV(t, kv, map[string]string{"a": "2", "b": "other"})
+
+	// The intent records are hidden.
+	keys, err := kv.Keys()
+	if err != nil {
+		t.Fatalf("Error getting keys: %v", err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 3 || keys[0] != "a" || keys[1] != "b" || keys[2] != "new" {
+		t.Fatalf("Unexpected keys: %v", keys)
+	}
+
+	if err := kv.Txn().Put("a", nil).Put("a", nil).Commit(); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+	if err := kv.Txn().Put(kvTxnPrefix+"x", nil).Commit(); err != ErrInvalidKey {
+		t.Fatalf("Expected %v, got %v", ErrInvalidKey, err)
+	}
+}
+
+func TestKeyValueTxnRecovery(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	for _, test := range []struct {
+		stage     string
+		committed bool
+		written   []string
+	}{
+		{"intent", false, []string{"a=old"}},
+		{"op0", false, []string{"a=new"}},
+		{"op1", false, []string{"a=new", "b=new"}},
+		{"commit", true, []string{"a=new", "b=new"}},
+	} {
+		t.Run(test.stage, func(t *testing.T) {
+			kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "CRASH_" + test.stage, History: 5})
+			if err != nil {
+				t.Fatalf("Error creating bucket: %v", err)
+			}
+			kv.Put("a", []byte("old"))
+			before := map[string]string{"a": "old", "b": ""}
+			after := map[string]string{"a": "new", "b": "new"}
+
+			crashTxn(t, kv.Txn().Put("a", []byte("new")).Put("b", []byte("new")), test.stage)
+
+			// Readers see either the old or the new state.
+			expected := before
+			if test.committed {
+				expected = after
+			}
+			expectKV(t, kv, expected)
+
+			// Watchers receive the values as written.
+			w, _ := kv.WatchAll()
+			expectUpdates(t, w, append(test.written, "nil")...)
+			w.Stop()
+
+			// Keys and History leave the uncommitted writes out.
+			wantKeys, wantHistory := "a", 1
+			if test.committed {
+				wantKeys, wantHistory = "a,b", 2
+			}
+			keys, _ := kv.Keys()
+			sort.Strings(keys)
+			if strings.Join(keys, ",") != wantKeys {
+				t.Fatalf("Unexpected keys: %v", keys)
+			}
+			history, _ := kv.History("a")
+			if len(history) != wantHistory || string(history[len(history)-1].Value()) != expected["a"] {
+				t.Fatalf("Unexpected history: %+v", history)
+			}
+
+			// Keys of a pending transaction can not be written by another.
+			if !test.committed && test.stage != "intent" {
+				if err := kv.Txn().Put("a", []byte("other")).Commit(); err != ErrTxnConflict {
+					t.Fatalf("Expected %v, got %v", ErrTxnConflict, err)
+				}
+			}
+
+			// Recent transactions are left alone.
+			if err := kv.RecoverTxns(time.Minute); err != nil {
+				t.Fatalf("Error recovering: %v", err)
+			}
+			expectKV(t, kv, expected)
+			if err := kv.RecoverTxns(0); err != nil {
+				t.Fatalf("Error recovering: %v", err)
+			}
+			expectKV(t, kv, expected)
+			if keys, _ := kv.Keys(IgnoreDeletes()); len(keys) > 2 {
+				t.Fatalf("Unexpected keys: %v", keys)
+			}
+			w, _ = kv.Watch(kvTxnPrefix+AllKeys, IgnoreDeletes())
+			if e := <-w.Updates(); e != nil {
+				t.Fatalf("Intent record not removed: %+v", e)
+			}
+			w.Stop()
+
+			// The keys can be written again.
+			if err := kv.Txn().Put("a", []byte("again")).Put("b", []byte("again")).Commit(); err != nil {
+				t.Fatalf("Error on commit: %v", err)
+			}
+			expectKV(t, kv, map[string]string{"a": "again", "b": "again"})
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// expectUpdates reads the updates of the watcher, "key=value" or "nil" for
+// the initial values marker.
+func expectUpdates(t *testing.T, w KeyWatcher, updates ...string) {
+	t.Helper()
+	for _, u := range updates {
+		select {
+		case e := <-w.Updates():
+			got := "nil"
+			if e != nil {
+				got = fmt.Sprintf("%s=%s", e.Key(), e.Value())
+			}
+			if got != u {
+				t.Fatalf("Expected update %q, got %q", u, got)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Did not get update %q", u)
+		}
+	}
+}
+
+func TestKeyValueWatchResume(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "WATCH", History: 5})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	kv.Put("a", []byte("1"))
+	rev, _ := kv.Put("b", []byte("1"))
+	kv.Put("a", []byte("2"))
+
+	w, err := kv.WatchAll(ResumeFromRevision(rev))
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	defer w.Stop()
+	expectUpdates(t, w, "b=1", "a=2", "nil")
+	kv.Put("c", []byte("1"))
+	expectUpdates(t, w, "c=1")
+
+	w, err = kv.WatchAll(ResumeFromRevision(100))
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	defer w.Stop()
+	expectUpdates(t, w, "nil")
+
+	if _, err := kv.WatchAll(ResumeFromRevision(0)); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+}
+
+func TestKeyValueDurableWatcher(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "WATCH", History: 5})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	kv.Put("a", []byte("1"))
+	kv.Put("b", []byte("1"))
+	kv.Put("a", []byte("2"))
+
+	w, err := kv.WatchAll(DurableWatcher("svc"))
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	expectUpdates(t, w, "b=1", "a=2", "nil")
+	kv.Put("c", []byte("1"))
+	expectUpdates(t, w, "c=1")
+	if err := w.Stop(); err != nil {
+		t.Fatalf("Error on stop: %v", err)
+	}
+
+	// The updates missed while stopped are the initial values.
+	kv.Put("d", []byte("1"))
+	kv.Delete("b")
+	w, err = kv.WatchAll(DurableWatcher("svc"))
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	expectUpdates(t, w, "d=1", "b=", "nil")
+	w.Stop()
+
+	// Nothing missed.
+	w, err = kv.WatchAll(DurableWatcher("svc"))
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	expectUpdates(t, w, "nil")
+
+	// Updates not read are delivered to the next watcher.
+	kv.Put("e", []byte("1"))
+	time.Sleep(50 * time.Millisecond)
+	w.Stop()
+	w, err = kv.WatchAll(DurableWatcher("svc"))
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	expectUpdates(t, w, "e=1", "nil")
+	if _, err := kv.WatchAll(DurableWatcher("svc")); err == nil {
+		t.Fatal("Expected error with a running watcher of the same name")
+	}
+
+	// Updates read are acknowledged once the next one is read, or the
+	// watcher stops.
+	expectAckPending := func(n int) {
+		t.Helper()
+		time.Sleep(50 * time.Millisecond)
+		ci, err := js.ConsumerInfo("KV_WATCH", "svc")
+		if err != nil {
+			t.Fatalf("Error getting consumer info: %v", err)
+		}
+		if ci.NumAckPending != n {
+			t.Fatalf("Expected %d updates pending, got %d", n, ci.NumAckPending)
+		}
+	}
+	kv.Put("f", []byte("1"))
+	expectUpdates(t, w, "f=1")
+	expectAckPending(1)
+	kv.Put("g", []byte("1"))
+	expectUpdates(t, w, "g=1")
+	expectAckPending(1)
+	f, _ := kv.Get("f")
+	if ci, _ := js.ConsumerInfo("KV_WATCH", "svc"); ci.AckFloor.Stream != f.Revision() {
+		t.Fatalf("Expected f acknowledged, got %+v", ci.AckFloor)
+	}
+	w.Stop()
+	expectAckPending(0)
+
+	// Deleted watchers start over.
+	if err := kv.DeleteWatcher("svc"); err != nil {
+		t.Fatalf("Error deleting watcher: %v", err)
+	}
+	w, err = kv.Watch("a", DurableWatcher("svc"))
+	if err != nil {
+		t.Fatalf("Error on watch: %v", err)
+	}
+	expectUpdates(t, w, "a=2", "nil")
+	w.Stop()
+	if _, err := kv.Watch("b", DurableWatcher("svc")); err != ErrSubjectMismatch {
+		t.Fatalf("Expected %v, got %v", ErrSubjectMismatch, err)
+	}
+
+	if _, err := kv.WatchAll(DurableWatcher("a.b")); err != ErrInvalidDurableName {
+		t.Fatalf("Expected %v, got %v", ErrInvalidDurableName, err)
+	}
+	if err := kv.DeleteWatcher("missing"); err != ErrConsumerNotFound {
+		t.Fatalf("Expected %v, got %v", ErrConsumerNotFound, err)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"sync"
+)
+
+const (
+	// Initial (and minimum) capacity of a subscription's pending queue.
+	// Must be a power of 2.
+	minMsgQueueSize = 16
+
+	// Messages whose payload buffer grew past this size are not
+	// returned to the pool to avoid pinning large buffers.
+	maxPooledMsgBufSize = 64 * 1024
+)
+
+// msgQueue is a ring buffer of pending messages used by asynchronous
+// subscriptions. It grows by doubling when full and shrinks back by
+// half once the number of pending messages drops under a quarter of
+// its capacity, so a burst of messages does not pin memory forever.
+// The high-water marks are tracked by the subscription (pMsgsMax).
+//
+// It is not safe for concurrent use, the subscription's lock must be held.
+type msgQueue struct {
+	buf  []*Msg
+	head int
+	n    int
+}
+
+// len returns the number of pending messages.
+func (q *msgQueue) len() int {
+	return q.n
+}
+
+// push adds the message at the tail of the queue.
+func (q *msgQueue) push(m *Msg) {
+	if q.n == len(q.buf) {
+		size := len(q.buf) * 2
+		if size == 0 {
+			size = minMsgQueueSize
+		}
+		q.resize(size)
+	}
+	q.buf[(q.head+q.n)&(len(q.buf)-1)] = m
+	q.n++
+}
+
+// pop removes and returns the message at the head of the queue,
+// or nil if the queue is empty.
+func (q *msgQueue) pop() *Msg {
+	if q.n == 0 {
+		return nil
+	}
+	m := q.buf[q.head]
+	q.buf[q.head] = nil
+	q.head = (q.head + 1) & (len(q.buf) - 1)
+	q.n--
+	if len(q.buf) > minMsgQueueSize && q.n < len(q.buf)/4 {
+		q.resize(len(q.buf) / 2)
+	}
+	return m
+}
+
+// resize moves the pending messages into a new buffer of the given size,
+// which must be a power of 2 and at least the number of pending messages.
+func (q *msgQueue) resize(size int) {
+	buf := make([]*Msg, size)
+	if q.n > 0 {
+		if q.head+q.n <= len(q.buf) {
+			copy(buf, q.buf[q.head:q.head+q.n])
+		} else {
+			n := copy(buf, q.buf[q.head:])
+			copy(buf[n:], q.buf[:q.n-n])
+		}
+	}
+	q.buf = buf
+	q.head = 0
+}
+
+// global pool of *Msg's, used when the MsgPooling option is set.
+var globalMsgPool msgPool
+
+// msgPool provides GC-able pooling of *Msg's and their payload buffers.
+// can be used by multiple goroutines concurrently.
+type msgPool struct {
+	p sync.Pool
+}
+
+// Get returns a message whose Data is a copy of the given payload,
+// reusing a pooled message and its buffer when possible.
+func (mp *msgPool) Get(data []byte) *Msg {
+	m, _ := mp.p.Get().(*Msg)
+	if m == nil {
+		m = &Msg{}
+	}
+	m.buf = append(m.buf[:0], data...)
+	m.Data = m.buf
+	m.pooled = true
+	m.released = 0
+	return m
+}
+
+// Put resets and pools the given message, marked as released until it is
+// handed out again.
+func (mp *msgPool) Put(m *Msg) {
+	buf := m.buf
+	if cap(buf) > maxPooledMsgBufSize {
+		buf = nil
+	}
+	*m = Msg{buf: buf[:0], released: 1}
+	mp.p.Put(m)
+}
@@ -0,0 +1,198 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMsgQueue(t *testing.T) {
+	var q msgQueue
+
+	if m := q.pop(); m != nil {
+		t.Fatalf("Expected nil from empty queue, got %v", m)
+	}
+
+	// Interleave push and pop so that the head wraps around
+	// while the queue grows.
+	next := 0
+	for i := 0; i < 1000; i++ {
+		q.push(&Msg{Subject: fmt.Sprintf("%d", i)})
+		if i%3 == 0 {
+			m := q.pop()
+			if m.Subject != fmt.Sprintf("%d", next) {
+				t.Fatalf("Expected %d, got %s", next, m.Subject)
+			}
+			next++
+		}
+	}
+	if q.len() != 1000-next {
+		t.Fatalf("Expected len %d, got %d", 1000-next, q.len())
+	}
+	highWater := len(q.buf)
+	for m := q.pop(); m != nil; m = q.pop() {
+		if m.Subject != fmt.Sprintf("%d", next) {
+			t.Fatalf("Expected %d, got %s", next, m.Subject)
+		}
+		next++
+	}
+	if next != 1000 {
+		t.Fatalf("Expected to have popped 1000 messages, got %d", next)
+	}
+	// The queue should have shrunk back once drained.
+	if len(q.buf) >= highWater || len(q.buf) != minMsgQueueSize {
+		t.Fatalf("Expected queue to shrink to %d from %d, got %d", minMsgQueueSize, highWater, len(q.buf))
+	}
+}
+
+func TestMsgPool(t *testing.T) {
+	var mp msgPool
+
+	m := mp.Get([]byte("hello"))
+	if !m.pooled || string(m.Data) != "hello" {
+		t.Fatalf("Unexpected message: %+v", m)
+	}
+	m.Subject = "foo"
+	m.Header = Header{"a": []string{"b"}}
+	mp.Put(m)
+	if m.pooled || m.Subject != _EMPTY_ || m.Header != nil || m.Data != nil {
+		t.Fatalf("Message was not reset: %+v", m)
+	}
+
+	big := make([]byte, maxPooledMsgBufSize+1)
+	m = mp.Get(big)
+	mp.Put(m)
+	if m.buf != nil {
+		t.Fatalf("Large buffer should not have been retained")
+	}
+
+	// Releasing a message twice does not pool it twice.
+	m = globalMsgPool.Get([]byte("hello"))
+	m.Release()
+	m.pooled = true
+	m.Release()
+	if m.released != 1 || !m.pooled {
+		t.Fatalf("Message was released twice: %+v", m)
+	}
+
+	// Release on a message that does not come from the pool is a no-op.
+	m = &Msg{Subject: "foo"}
+	m.Release()
+	if m.Subject != "foo" {
+		t.Fatalf("Message should not have been reset")
+	}
+}
+
+func TestMsgPoolingDelivery(t *testing.T) {
+	s := RunServerOnPort(TEST_PORT)
+	defer s.Shutdown()
+
+	nc, err := Connect(fmt.Sprintf("127.0.0.1:%d", TEST_PORT), MsgPooling(true))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	total := 500
+	ch := make(chan error, 1)
+	received := 0
+	if _, err := nc.Subscribe("foo.*", func(m *Msg) {
+		expected := fmt.Sprintf("msg-%d", received)
+		if !m.pooled || string(m.Data) != expected || m.Subject != "foo.bar" {
+			ch <- fmt.Errorf("Unexpected message %q on %q, expected %q", m.Data, m.Subject, expected)
+			return
+		}
+		m.Release()
+		if received++; received == total {
+			ch <- nil
+		}
+	}); err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	for i := 0; i < total; i++ {
+		nc.Publish("foo.bar", []byte(fmt.Sprintf("msg-%d", i)))
+	}
+	select {
+	case err := <-ch:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Did not receive all messages: %d/%d", received, total)
+	}
+
+	// Messages dropped by a filter are returned to the pool.
+	var dropped *Msg
+	nc.addMsgFilter("foo.baz", func(m *Msg) *Msg {
+		dropped = m
+		return nil
+	})
+	nc.Publish("foo.baz", []byte("dropped"))
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+	if dropped == nil || dropped.released != 1 || dropped.Data != nil {
+		t.Fatalf("Filtered message was not released: %+v", dropped)
+	}
+}
+
+func benchmarkAsyncSubDelivery(b *testing.B, pooled bool) {
+	b.StopTimer()
+	s := RunServerOnPort(TEST_PORT)
+	defer s.Shutdown()
+	nc, err := Connect(fmt.Sprintf("127.0.0.1:%d", TEST_PORT), MsgPooling(pooled))
+	if err != nil {
+		b.Fatalf("Failed to connect: %v", err)
+	}
+	defer nc.Close()
+
+	ch := make(chan bool)
+	received := int32(0)
+
+	nc.Subscribe("foo", func(m *Msg) {
+		m.Release()
+		if nr := atomic.AddInt32(&received, 1); nr >= int32(b.N) {
+			ch <- true
+		}
+	})
+	// Make sure the subscription is registered before timing.
+	nc.Flush()
+
+	msg := []byte("Hello World")
+
+	b.ReportAllocs()
+	b.StartTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := nc.Publish("foo", msg); err != nil {
+			b.Fatalf("Error in benchmark during Publish: %v\n", err)
+		}
+	}
+
+	if err := WaitTime(ch, 10*time.Second); err != nil {
+		b.Fatal("Timed out waiting for messages")
+	}
+	b.StopTimer()
+}
+
+func BenchmarkAsyncSubDelivery(b *testing.B) {
+	benchmarkAsyncSubDelivery(b, false)
+}
+
+func BenchmarkAsyncSubDeliveryPooled(b *testing.B) {
+	benchmarkAsyncSubDelivery(b, true)
+}
@@ -1420,6 +1420,97 @@ func TestNoEcho(t *testing.T) {
 	}
 }
 
+func TestLocalDelivery(t *testing.T) {
+	s := RunServerOnPort(TEST_PORT)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://127.0.0.1:%d", TEST_PORT)
+
+	nc, err := Connect(url, LocalDelivery())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	other, err := Connect(url)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer other.Close()
+
+	sub, err := nc.SubscribeSync("foo.*")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	qsub, err := nc.QueueSubscribeSync("foo.*", "q")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	osub, err := other.SubscribeSync("foo.*")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	if err := other.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+
+	total := 100
+	for i := 0; i < total; i++ {
+		m := NewMsg("foo.bar")
+		m.Header.Set("Seq", fmt.Sprintf("%d", i))
+		m.Data = []byte("hello")
+		if err := nc.PublishMsg(m); err != nil {
+			t.Fatalf("Error on publish: %v", err)
+		}
+	}
+	// Local deliveries do not need a flush.
+	for i := 0; i < total; i++ {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Error on next msg: %v", err)
+		}
+		if seq := m.Header.Get("Seq"); seq != fmt.Sprintf("%d", i) || string(m.Data) != "hello" {
+			t.Fatalf("Unexpected message %d: %+v", i, m)
+		}
+	}
+	// Other connections still get the messages through the server.
+	for i := 0; i < total; i++ {
+		if _, err := osub.NextMsg(time.Second); err != nil {
+			t.Fatalf("Error on next msg: %v", err)
+		}
+	}
+	// The server did not echo the messages back, and queue subscribers
+	// are not eligible for local delivery.
+	nc.Flush()
+	if n, _, _ := sub.Pending(); n != 0 {
+		t.Fatalf("Expected no more messages, got %d", n)
+	}
+	if n, _, _ := qsub.Pending(); n != 0 {
+		t.Fatalf("Expected no message for queue subscriber, got %d", n)
+	}
+
+	// Messages from other connections are received normally.
+	other.Publish("foo.baz", []byte("from other"))
+	if m, err := sub.NextMsg(time.Second); err != nil || string(m.Data) != "from other" {
+		t.Fatalf("Unexpected message %+v, err: %v", m, err)
+	}
+
+	// No local delivery once unsubscribed.
+	sub.Unsubscribe()
+	nc.Publish("foo.bar", []byte("hello"))
+	if n := len(nc.lsubs.match("foo.bar")); n != 0 {
+		t.Fatalf("Expected no local subscription, got %d", n)
+	}
+
+	// Requests to a responder on the same connection.
+	nc.Subscribe("service", func(m *Msg) {
+		m.Respond([]byte("pong"))
+	})
+	if resp, err := nc.Request("service", []byte("ping"), time.Second); err != nil || string(resp.Data) != "pong" {
+		t.Fatalf("Unexpected response %+v, err: %v", resp, err)
+	}
+}
+
 func TestNoEchoOldServer(t *testing.T) {
 	opts := GetDefaultOptions()
 	opts.Url = DefaultURL
@@ -1445,6 +1536,60 @@ func TestNoEchoOldServer(t *testing.T) {
 	}
 }
 
+func TestConnectProtoFields(t *testing.T) {
+	opts := GetDefaultOptions()
+	opts.Url = DefaultURL
+	opts.Name = "myname"
+	opts.Guid = "myguid"
+
+	nc := &Conn{Opts: opts}
+	if err := nc.setupServerPool(); err != nil {
+		t.Fatalf("Problem setting up Server Pool: %v\n", err)
+	}
+	if err := nc.processInfo(`{"server_id":"22","version":"2.7.4","proto":1,"headers":true,"max_payload":1048576}`); err != nil {
+		t.Fatalf("Error processing INFO: %v\n", err)
+	}
+
+	connect := func() map[string]interface{} {
+		t.Helper()
+		proto, err := nc.connectProto()
+		if err != nil {
+			t.Fatalf("Error creating CONNECT: %v", err)
+		}
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(strings.TrimSuffix(strings.TrimPrefix(proto, "CONNECT "), _CRLF_)), &m); err != nil {
+			t.Fatalf("Error parsing %q: %v", proto, err)
+		}
+		return m
+	}
+	m := connect()
+	expected := map[string]interface{}{
+		"guid":          "myguid",
+		"name":          "myname",
+		"lang":          LangString,
+		"version":       Version,
+		"protocol":      float64(clientProtoInfo),
+		"echo":          true,
+		"headers":       true,
+		"no_responders": true,
+	}
+	for k, v := range expected {
+		if m[k] != v {
+			t.Fatalf("Expected %q to be %v, got %v in %v", k, v, m[k], m)
+		}
+	}
+
+	nc.Opts.NoEcho = true
+	if m := connect(); m["echo"] != false || m["protocol"] != float64(clientProtoInfo) {
+		t.Fatalf("Expected echo to be disabled, got %v", m)
+	}
+	nc.Opts.NoEcho = false
+	nc.Opts.LocalDelivery = true
+	if m := connect(); m["echo"] != false {
+		t.Fatalf("Expected echo to be disabled, got %v", m)
+	}
+}
+
 // Trust Server Tests
 
 var (
@@ -2883,3 +3028,119 @@ func TestRespInbox(t *testing.T) {
 		t.Fatalf("Error: %s", resp.Data)
 	}
 }
+
+func TestPublishBatch(t *testing.T) {
+	s := RunServerOnPort(TEST_PORT)
+	defer s.Shutdown()
+
+	nc, err := Connect(fmt.Sprintf("127.0.0.1:%d", TEST_PORT))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sub, err := nc.SubscribeSync("foo.*")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+
+	hm := NewMsg("foo.hdr")
+	hm.Header.Set("X", "Y")
+	msgs := []*Msg{
+		{Subject: "foo.1", Data: []byte("1")},
+		{Subject: "foo bar", Data: []byte("bad subject")},
+		nil,
+		{Subject: "foo.big", Data: make([]byte, nc.MaxPayload()+1)},
+		hm,
+		{Subject: "foo.2", Data: []byte("2")},
+	}
+	err = nc.PublishBatch(msgs)
+	berr, ok := err.(*PublishBatchError)
+	if !ok {
+		t.Fatalf("Expected a PublishBatchError, got %v", err)
+	}
+	expected := []BatchMsgError{
+		{Index: 1, Err: ErrBadSubject},
+		{Index: 2, Err: ErrInvalidMsg},
+		{Index: 3, Err: ErrMaxPayload},
+	}
+	if !reflect.DeepEqual(berr.Errors, expected) {
+		t.Fatalf("Expected errors %+v, got %+v", expected, berr.Errors)
+	}
+
+	// The other messages should have been published in order.
+	for _, subj := range []string{"foo.1", "foo.hdr", "foo.2"} {
+		m, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Error getting message: %v", err)
+		}
+		if m.Subject != subj {
+			t.Fatalf("Expected message on %q, got %q", subj, m.Subject)
+		}
+		if subj == "foo.hdr" && m.Header.Get("X") != "Y" {
+			t.Fatalf("Unexpected header: %v", m.Header)
+		}
+	}
+
+	if err := nc.PublishBatch(msgs[:1]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	nc.Close()
+	if err := nc.PublishBatch(msgs[:1]); err != ErrConnectionClosed {
+		t.Fatalf("Expected ErrConnectionClosed, got %v", err)
+	}
+}
+
+func TestValidateSubjects(t *testing.T) {
+	s := RunServerOnPort(TEST_PORT)
+	defer s.Shutdown()
+
+	// Without the option, these are not caught by the client.
+	nc, err := Connect(fmt.Sprintf("127.0.0.1:%d", TEST_PORT))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	if err := nc.Publish("foo.*", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	nc2, err := Connect(fmt.Sprintf("127.0.0.1:%d", TEST_PORT), ValidateSubjects())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer nc2.Close()
+
+	for _, subj := range []string{"foo.*", "foo.>", "foo..bar", "foo."} {
+		if err := nc2.Publish(subj, nil); err != ErrBadSubject {
+			t.Fatalf("Expected ErrBadSubject publishing to %q, got %v", subj, err)
+		}
+	}
+	if err := nc2.PublishRequest("foo", "bar.*", nil); err != ErrBadSubject {
+		t.Fatalf("Expected ErrBadSubject for wildcard reply, got %v", err)
+	}
+	if err := nc2.PublishBatch([]*Msg{{Subject: "foo.>"}}); err == nil {
+		t.Fatal("Expected batch error")
+	}
+	if _, err := nc2.SubscribeSync("foo.>.bar"); err != ErrBadSubject {
+		t.Fatalf("Expected ErrBadSubject subscribing to %q, got %v", "foo.>.bar", err)
+	}
+	if _, err := nc2.SubscribeSync("foo.*.bar.>"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := nc2.Publish("foo.bar", nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Wildcard characters within a token are literal.
+	sub, err := nc2.SubscribeSync("foo*bar.a>b")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := nc2.Publish("foo*bar.a>b", []byte("ok")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Error receiving message: %v", err)
+	}
+}
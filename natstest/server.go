@@ -0,0 +1,591 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package natstest provides an in-memory NATS server for unit tests.
+//
+// The server speaks the core client protocol: INFO, CONNECT, PUB, HPUB,
+// SUB, UNSUB, MSG, HMSG, PING and PONG, with wildcard subscriptions and
+// queue groups. Connections are made with net.Pipe through the custom
+// dialer of the client, so no network is involved:
+//
+//	s := natstest.NewServer(nil)
+//	defer s.Shutdown()
+//	nc, err := nats.Connect(s.ClientURL(), nats.SetCustomDialer(s))
+//
+// Faults are injected on demand: latency, dropped connections, -ERR
+// protocols, permission violations and lame duck mode. Queue members are
+// picked in turn, so that tests are deterministic.
+package natstest
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wutianze/nats.go/subject"
+)
+
+const (
+	// DefaultMaxPayload is the maximum payload advertised by default.
+	DefaultMaxPayload = 1024 * 1024
+
+	// Version is the server version advertised in the INFO protocol.
+	Version = "2.9.0"
+
+	// Address in a block reserved for documentation, so that a client
+	// not using the server as dialer does not reach a real server.
+	clientURL = "nats://192.0.2.1:4222"
+
+	noRespondersHeader = "NATS/1.0 503\r\n\r\n"
+)
+
+// ErrServerShutdown is returned when dialing a server that was shut down.
+var ErrServerShutdown = errors.New("natstest: server is shut down")
+
+// Options configure the server.
+type Options struct {
+	// ServerID and ServerName are reported in the INFO protocol.
+	ServerID   string
+	ServerName string
+	// MaxPayload defaults to DefaultMaxPayload.
+	MaxPayload int32
+	// NoHeaders makes the server advertise that it does not support
+	// headers, as servers before v2.2.0.
+	NoHeaders bool
+	// Latency delays everything sent to the clients.
+	Latency time.Duration
+}
+
+// Server is an in-memory NATS server.
+type Server struct {
+	mu       sync.Mutex
+	opts     Options
+	clients  map[uint64]*client
+	cid      uint64
+	queues   map[string]uint64
+	denyPub  []string
+	denySub  []string
+	ldm      bool
+	shutdown bool
+}
+
+type serverInfo struct {
+	ID           string `json:"server_id"`
+	Name         string `json:"server_name"`
+	Version      string `json:"version"`
+	Proto        int    `json:"proto"`
+	Host         string `json:"host"`
+	Port         int    `json:"port"`
+	Headers      bool   `json:"headers"`
+	MaxPayload   int32  `json:"max_payload"`
+	ClientID     uint64 `json:"client_id"`
+	LameDuckMode bool   `json:"ldm,omitempty"`
+}
+
+type connectInfo struct {
+	Verbose      bool   `json:"verbose"`
+	Name         string `json:"name"`
+	Echo         bool   `json:"echo"`
+	Headers      bool   `json:"headers"`
+	NoResponders bool   `json:"no_responders"`
+}
+
+// NewServer returns a server ready to accept connections. The options
+// can be nil.
+func NewServer(opts *Options) *Server {
+	s := &Server{
+		clients: make(map[uint64]*client),
+		queues:  make(map[string]uint64),
+	}
+	if opts != nil {
+		s.opts = *opts
+	}
+	if s.opts.ServerID == "" {
+		s.opts.ServerID = "NATSTEST"
+	}
+	if s.opts.MaxPayload <= 0 {
+		s.opts.MaxPayload = DefaultMaxPayload
+	}
+	return s
+}
+
+// ClientURL returns the URL to connect to, along with the server set as
+// custom dialer of the client.
+func (s *Server) ClientURL() string {
+	return clientURL
+}
+
+// Dial implements the CustomDialer interface of the client. The network
+// and address are ignored.
+func (s *Server) Dial(network, address string) (net.Conn, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shutdown {
+		return nil, ErrServerShutdown
+	}
+	cc, sc := net.Pipe()
+	s.cid++
+	c := &client{srv: s, id: s.cid, conn: sc, subs: make(map[string]*subscription)}
+	c.cond = sync.NewCond(&c.mu)
+	s.clients[c.id] = c
+	c.sendInfo(s.infoLocked(c.id))
+	go c.readLoop()
+	go c.writeLoop()
+	return cc, nil
+}
+
+func (s *Server) infoLocked(cid uint64) serverInfo {
+	return serverInfo{
+		ID:           s.opts.ServerID,
+		Name:         s.opts.ServerName,
+		Version:      Version,
+		Proto:        1,
+		Host:         "192.0.2.1",
+		Port:         4222,
+		Headers:      !s.opts.NoHeaders,
+		MaxPayload:   s.opts.MaxPayload,
+		ClientID:     cid,
+		LameDuckMode: s.ldm,
+	}
+}
+
+// Shutdown closes all the connections and rejects new ones.
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	s.shutdown = true
+	s.mu.Unlock()
+	s.DropConnections()
+}
+
+// DropConnections closes all the connections, as if the network failed.
+// The clients can reconnect.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		clients = append(clients, c)
+	}
+	s.mu.Unlock()
+	for _, c := range clients {
+		c.close()
+	}
+}
+
+// SetLatency delays everything sent to the clients from now on.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	s.opts.Latency = d
+	s.mu.Unlock()
+}
+
+// SendError sends an -ERR protocol with the given message to all the
+// clients. The clients close the connection, except for errors such as
+// "Stale Connection" or permission violations.
+func (s *Server) SendError(msg string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.clients {
+		c.sendErr(msg)
+	}
+}
+
+// DenyPublish rejects the publications on subjects matching the filters
+// with a permission violation.
+func (s *Server) DenyPublish(filters ...string) {
+	s.mu.Lock()
+	s.denyPub = append(s.denyPub, filters...)
+	s.mu.Unlock()
+}
+
+// DenySubscribe rejects the subscriptions on subjects matching the
+// filters with a permission violation.
+func (s *Server) DenySubscribe(filters ...string) {
+	s.mu.Lock()
+	s.denySub = append(s.denySub, filters...)
+	s.mu.Unlock()
+}
+
+// EnterLameDuckMode sends an INFO protocol announcing the lame duck mode
+// to all the clients. The connections are not closed.
+func (s *Server) EnterLameDuckMode() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ldm = true
+	for _, c := range s.clients {
+		c.sendInfo(s.infoLocked(c.id))
+	}
+}
+
+// NumClients returns the number of connected clients.
+func (s *Server) NumClients() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.clients)
+}
+
+// NumSubscriptions returns the number of subscriptions of all the clients.
+func (s *Server) NumSubscriptions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.clients {
+		n += len(c.subs)
+	}
+	return n
+}
+
+func (s *Server) removeClient(c *client) {
+	s.mu.Lock()
+	delete(s.clients, c.id)
+	s.mu.Unlock()
+	c.close()
+}
+
+func matchesAny(filters []string, subj string) bool {
+	for _, f := range filters {
+		if subject.SubjectMatches(f, subj) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeLocked delivers a message to the matching subscriptions, one
+// member per queue group. The lock is held.
+func (s *Server) routeLocked(from *client, subj, reply string, hdr, data []byte) {
+	var matched bool
+	queues := make(map[string][]*subscription)
+	for _, c := range s.clients {
+		if c == from && !from.opts.Echo {
+			continue
+		}
+		for _, sub := range c.subs {
+			if !subject.SubjectMatches(sub.subject, subj) {
+				continue
+			}
+			if sub.queue != "" {
+				queues[sub.queue] = append(queues[sub.queue], sub)
+				continue
+			}
+			matched = true
+			sub.deliver(subj, reply, hdr, data)
+		}
+	}
+	for queue, subs := range queues {
+		matched = true
+		sort.Slice(subs, func(i, j int) bool {
+			if subs[i].client.id != subs[j].client.id {
+				return subs[i].client.id < subs[j].client.id
+			}
+			return subs[i].sid < subs[j].sid
+		})
+		n := s.queues[queue]
+		s.queues[queue] = n + 1
+		subs[n%uint64(len(subs))].deliver(subj, reply, hdr, data)
+	}
+	// Requests with no responders get a status message back, provided
+	// that the client asked for it.
+	if !matched && reply != "" && from.opts.Headers && from.opts.NoResponders {
+		for _, sub := range from.subs {
+			if subject.SubjectMatches(sub.subject, reply) {
+				sub.deliver(reply, "", []byte(noRespondersHeader), nil)
+				break
+			}
+		}
+	}
+}
+
+type subscription struct {
+	client    *client
+	subject   string
+	queue     string
+	sid       string
+	max       uint64
+	delivered uint64
+}
+
+// deliver sends a message to the client of the subscription. The server
+// lock is held.
+func (sub *subscription) deliver(subj, reply string, hdr, data []byte) {
+	c := sub.client
+	var buf []byte
+	if reply != "" {
+		reply += " "
+	}
+	if hdr != nil && c.opts.Headers {
+		buf = make([]byte, 0, len(subj)+len(reply)+len(hdr)+len(data)+64)
+		buf = append(buf, fmt.Sprintf("HMSG %s %s %s%d %d\r\n", subj, sub.sid, reply, len(hdr), len(hdr)+len(data))...)
+		buf = append(buf, hdr...)
+	} else {
+		buf = make([]byte, 0, len(subj)+len(reply)+len(data)+64)
+		buf = append(buf, fmt.Sprintf("MSG %s %s %s%d\r\n", subj, sub.sid, reply, len(data))...)
+	}
+	buf = append(buf, data...)
+	buf = append(buf, "\r\n"...)
+	c.send(buf)
+	sub.delivered++
+	if sub.max > 0 && sub.delivered >= sub.max {
+		delete(c.subs, sub.sid)
+	}
+}
+
+// client is the server side of a connection. The subscriptions and the
+// options are protected by the server lock, the outbound queue by the
+// client lock.
+type client struct {
+	srv  *Server
+	id   uint64
+	conn net.Conn
+	opts connectInfo
+	subs map[string]*subscription
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	out    []outbound
+	closed bool
+}
+
+type outbound struct {
+	data  []byte
+	at    time.Time
+	close bool
+}
+
+// send queues data to the client, to be written after the latency. The
+// server lock is held.
+func (c *client) send(data []byte) {
+	c.enqueue(outbound{data: data, at: time.Now().Add(c.srv.opts.Latency)})
+}
+
+func (c *client) enqueue(o outbound) {
+	c.mu.Lock()
+	if !c.closed {
+		c.out = append(c.out, o)
+		c.cond.Signal()
+	}
+	c.mu.Unlock()
+}
+
+func (c *client) sendInfo(info serverInfo) {
+	b, _ := json.Marshal(info)
+	c.send([]byte(fmt.Sprintf("INFO %s\r\n", b)))
+}
+
+func (c *client) sendErr(msg string) {
+	c.send([]byte(fmt.Sprintf("-ERR '%s'\r\n", msg)))
+}
+
+// closeAfterFlush closes the connection once the queued data is written.
+func (c *client) closeAfterFlush() {
+	c.enqueue(outbound{close: true})
+}
+
+func (c *client) close() {
+	c.mu.Lock()
+	c.closed = true
+	c.cond.Signal()
+	c.mu.Unlock()
+	c.conn.Close()
+}
+
+func (c *client) writeLoop() {
+	for {
+		c.mu.Lock()
+		for len(c.out) == 0 && !c.closed {
+			c.cond.Wait()
+		}
+		out := c.out
+		c.out = nil
+		closed := c.closed
+		c.mu.Unlock()
+		if closed {
+			return
+		}
+		for _, o := range out {
+			if o.close {
+				c.close()
+				return
+			}
+			if d := time.Until(o.at); d > 0 {
+				time.Sleep(d)
+			}
+			if _, err := c.conn.Write(o.data); err != nil {
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+func (c *client) readLoop() {
+	defer c.srv.removeClient(c)
+	br := bufio.NewReaderSize(c.conn, 32768)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if err := c.processProto(br, strings.TrimRight(line, "\r\n")); err != nil {
+			c.srv.mu.Lock()
+			c.sendErr(err.Error())
+			c.srv.mu.Unlock()
+			c.closeAfterFlush()
+			// Wait for the connection to be closed by the writer.
+			io.Copy(io.Discard, br)
+			return
+		}
+	}
+}
+
+// processProto processes a protocol line, reading the payload if any.
+// The returned error is sent to the client before closing the connection.
+func (c *client) processProto(br *bufio.Reader, line string) error {
+	op, rest := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		op, rest = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	args := strings.Fields(rest)
+	s := c.srv
+	switch strings.ToUpper(op) {
+	case "PING":
+		s.mu.Lock()
+		c.send([]byte("PONG\r\n"))
+		s.mu.Unlock()
+		return nil
+	case "PONG":
+		return nil
+	case "CONNECT":
+		opts := connectInfo{Echo: true}
+		if err := json.Unmarshal([]byte(rest), &opts); err != nil {
+			return errors.New("Invalid Connect Protocol")
+		}
+		s.mu.Lock()
+		c.opts = opts
+		s.mu.Unlock()
+	case "PUB", "HPUB":
+		if err := c.processPub(br, strings.ToUpper(op) == "HPUB", args); err != nil {
+			return err
+		}
+	case "SUB":
+		if len(args) != 2 && len(args) != 3 {
+			return errors.New("Unknown Protocol Operation")
+		}
+		c.processSub(args[0], args[1:len(args)-1], args[len(args)-1])
+	case "UNSUB":
+		if len(args) != 1 && len(args) != 2 {
+			return errors.New("Unknown Protocol Operation")
+		}
+		var max uint64
+		if len(args) == 2 {
+			var err error
+			if max, err = strconv.ParseUint(args[1], 10, 64); err != nil {
+				return errors.New("Unknown Protocol Operation")
+			}
+		}
+		s.mu.Lock()
+		if sub := c.subs[args[0]]; sub != nil {
+			if max == 0 || sub.delivered >= max {
+				delete(c.subs, args[0])
+			} else {
+				sub.max = max
+			}
+		}
+		s.mu.Unlock()
+	default:
+		return errors.New("Unknown Protocol Operation")
+	}
+	s.mu.Lock()
+	if c.opts.Verbose {
+		c.send([]byte("+OK\r\n"))
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (c *client) processPub(br *bufio.Reader, headers bool, args []string) error {
+	n := 2
+	if headers {
+		n = 3
+	}
+	if len(args) != n && len(args) != n+1 {
+		return errors.New("Unknown Protocol Operation")
+	}
+	subj, reply := args[0], ""
+	if len(args) == n+1 {
+		reply = args[1]
+	}
+	hsize := -1
+	if headers {
+		var err error
+		if hsize, err = strconv.Atoi(args[len(args)-2]); err != nil || hsize < 0 {
+			return errors.New("Unknown Protocol Operation")
+		}
+	}
+	size, err := strconv.Atoi(args[len(args)-1])
+	if err != nil || size < 0 || hsize > size {
+		return errors.New("Unknown Protocol Operation")
+	}
+	s := c.srv
+	if size > int(s.opts.MaxPayload) {
+		return errors.New("Maximum Payload Violation")
+	}
+	buf := make([]byte, size+2)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return err
+	}
+	buf = buf[:size]
+	var hdr []byte
+	if headers {
+		hdr, buf = buf[:hsize], buf[hsize:]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !subject.IsValidPublish(subj) {
+		c.sendErr("Invalid Publish Subject")
+		return nil
+	}
+	if matchesAny(s.denyPub, subj) {
+		c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q", subj))
+		return nil
+	}
+	s.routeLocked(c, subj, reply, hdr, buf)
+	return nil
+}
+
+func (c *client) processSub(subj string, queue []string, sid string) {
+	s := c.srv
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !subject.IsValidSubscribe(subj) {
+		c.sendErr("Invalid Subject")
+		return
+	}
+	if matchesAny(s.denySub, subj) {
+		c.sendErr(fmt.Sprintf("Permissions Violation for Subscription to %q", subj))
+		return
+	}
+	sub := &subscription{client: c, subject: subj, sid: sid}
+	if len(queue) > 0 {
+		sub.queue = queue[0]
+	}
+	c.subs[sid] = sub
+}
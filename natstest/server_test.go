@@ -0,0 +1,227 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package natstest
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wutianze/nats.go"
+)
+
+func connect(t *testing.T, s *Server, opts ...nats.Option) *nats.Conn {
+	t.Helper()
+	nc, err := nats.Connect(s.ClientURL(), append([]nats.Option{nats.SetCustomDialer(s)}, opts...)...)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	return nc
+}
+
+func TestServerPubSub(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Shutdown()
+
+	nc := connect(t, s)
+	defer nc.Close()
+
+	wc, err := nc.SubscribeSync("foo.*.baz")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	fwc, err := nc.SubscribeSync("foo.>")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	if err := nc.Publish("foo.bar.baz", []byte("hello")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if err := nc.Publish("foo.bar", []byte("world")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	m, err := wc.NextMsg(time.Second)
+	if err != nil || m.Subject != "foo.bar.baz" || string(m.Data) != "hello" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+	for _, data := range []string{"hello", "world"} {
+		if m, err := fwc.NextMsg(time.Second); err != nil || string(m.Data) != data {
+			t.Fatalf("Unexpected message: %+v, %v", m, err)
+		}
+	}
+	if _, err := wc.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+
+	// Headers
+	msg := nats.NewMsg("foo.hdr")
+	msg.Header.Set("Key", "value")
+	msg.Data = []byte("data")
+	if err := nc.PublishMsg(msg); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if m, err := fwc.NextMsg(time.Second); err != nil || m.Header.Get("Key") != "value" || string(m.Data) != "data" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+
+	// Request/reply, and no responders.
+	if _, err := nc.Subscribe("service", func(m *nats.Msg) { m.Respond([]byte("reply")) }); err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	if resp, err := nc.Request("service", []byte("req"), time.Second); err != nil || string(resp.Data) != "reply" {
+		t.Fatalf("Unexpected response: %+v, %v", resp, err)
+	}
+	if _, err := nc.Request("nobody", nil, time.Second); err != nats.ErrNoResponders {
+		t.Fatalf("Expected %v, got %v", nats.ErrNoResponders, err)
+	}
+
+	// Unsubscribe, also with a max.
+	if err := wc.AutoUnsubscribe(1); err != nil {
+		t.Fatalf("Error on unsubscribe: %v", err)
+	}
+	if err := fwc.Unsubscribe(); err != nil {
+		t.Fatalf("Error on unsubscribe: %v", err)
+	}
+	nc.Publish("foo.bar.baz", []byte("1"))
+	nc.Publish("foo.bar.baz", []byte("2"))
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+	// The service and the response subscriptions remain.
+	if n := s.NumSubscriptions(); n != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %v", n)
+	}
+}
+
+func TestServerQueueGroups(t *testing.T) {
+	s := NewServer(nil)
+	defer s.Shutdown()
+
+	var conns []*nats.Conn
+	var subs []*nats.Subscription
+	for i := 0; i < 3; i++ {
+		nc := connect(t, s)
+		defer nc.Close()
+		sub, err := nc.QueueSubscribeSync("work", "workers")
+		if err != nil {
+			t.Fatalf("Error on subscribe: %v", err)
+		}
+		nc.Flush()
+		conns = append(conns, nc)
+		subs = append(subs, sub)
+	}
+	nc := connect(t, s, nats.NoEcho())
+	defer nc.Close()
+	for i := 0; i < 30; i++ {
+		nc.Publish("work", nil)
+	}
+	nc.Flush()
+	for i, c := range conns {
+		c.Flush()
+		if n, _, _ := subs[i].Pending(); n != 10 {
+			t.Fatalf("Expected queue member %d to get 10 messages, got %v", i, n)
+		}
+	}
+
+	// With no echo, the publisher does not get its own messages.
+	sub, err := nc.SubscribeSync("echo")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	nc.Publish("echo", nil)
+	if _, err := sub.NextMsg(50 * time.Millisecond); err != nats.ErrTimeout {
+		t.Fatalf("Expected timeout, got %v", err)
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	s := NewServer(&Options{MaxPayload: 1024})
+	defer s.Shutdown()
+
+	errCh := make(chan error, 10)
+	rch := make(chan bool, 10)
+	ldmCh := make(chan bool, 1)
+	nc := connect(t, s,
+		nats.ReconnectWait(10*time.Millisecond),
+		nats.ReconnectHandler(func(_ *nats.Conn) { rch <- true }),
+		nats.ErrorHandler(func(_ *nats.Conn, _ *nats.Subscription, err error) { errCh <- err }),
+		nats.LameDuckModeHandler(func(_ *nats.Conn) { ldmCh <- true }))
+	defer nc.Close()
+	if mp := nc.MaxPayload(); mp != 1024 {
+		t.Fatalf("Unexpected max payload: %v", mp)
+	}
+
+	// Latency
+	s.SetLatency(100 * time.Millisecond)
+	start := time.Now()
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+	if d := time.Since(start); d < 100*time.Millisecond {
+		t.Fatalf("Expected latency, flush took %v", d)
+	}
+	s.SetLatency(0)
+
+	// Dropped connections
+	s.DropConnections()
+	select {
+	case <-rch:
+	case <-time.After(time.Second):
+		t.Fatal("Did not reconnect")
+	}
+	if n := s.NumClients(); n != 1 {
+		t.Fatalf("Expected 1 client, got %v", n)
+	}
+
+	// Permissions
+	s.DenyPublish("secret.>")
+	nc.Publish("secret.plans", nil)
+	select {
+	case err := <-errCh:
+		if e := strings.ToLower(err.Error()); !strings.Contains(e, nats.PERMISSIONS_ERR) || !strings.Contains(e, `"secret.plans"`) {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Did not get the permission violation")
+	}
+
+	// Lame duck mode
+	s.EnterLameDuckMode()
+	select {
+	case <-ldmCh:
+	case <-time.After(time.Second):
+		t.Fatal("Lame duck mode not reported")
+	}
+
+	// Injected errors
+	s.SendError("Stale Connection")
+	select {
+	case <-rch:
+	case <-time.After(time.Second):
+		t.Fatal("Did not reconnect after stale connection")
+	}
+	s.SendError("Something Bad")
+	deadline := time.Now().Add(time.Second)
+	for !nc.IsClosed() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !nc.IsClosed() || nc.LastError() == nil || !strings.Contains(nc.LastError().Error(), "Something Bad") {
+		t.Fatalf("Expected connection to be closed with error, got %v", nc.LastError())
+	}
+
+	s.Shutdown()
+	if _, err := s.Dial("tcp", "127.0.0.1:4222"); err != ErrServerShutdown {
+		t.Fatalf("Expected %v, got %v", ErrServerShutdown, err)
+	}
+}
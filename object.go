@@ -43,6 +43,8 @@ type ObjectStoreManager interface {
 	CreateObjectStore(cfg *ObjectStoreConfig) (ObjectStore, error)
 	// DeleteObjectStore will delete the underlying stream for the named object.
 	DeleteObjectStore(bucket string) error
+	// RestoreObjectStore will create an object store from a snapshot.
+	RestoreObjectStore(r io.Reader, opts ...RestoreOpt) (ObjectStore, error)
 }
 
 // ObjectStore is a blob store capable of storing large objects efficiently in
@@ -97,6 +99,9 @@ type ObjectStore interface {
 
 	// Status retrieves run-time status about the backing store of the bucket.
 	Status() (ObjectStoreStatus, error)
+
+	// Snapshot writes an export of the object store.
+	Snapshot(w io.Writer) error
 }
 
 type ObjectOpt interface {
@@ -0,0 +1,324 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	proxySchemeHTTP    = "http"
+	proxySchemeSOCKS5  = "socks5"
+	proxySchemeSOCKS5H = "socks5h"
+
+	defaultHTTPProxyPort   = "80"
+	defaultSOCKS5ProxyPort = "1080"
+
+	socks5Version      = 5
+	socks5AuthNone     = 0
+	socks5AuthUserPass = 2
+	socks5CmdConnect   = 1
+	socks5AddrIPv4     = 1
+	socks5AddrDomain   = 3
+	socks5AddrIPv6     = 4
+)
+
+var errSOCKS5Reply = []string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// parseProxyURL parses and checks the URL of a proxy. The scheme defaults
+// to "http" and the port to the default of the scheme.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = proxySchemeHTTP + "://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	var port string
+	switch u.Scheme {
+	case proxySchemeHTTP:
+		port = defaultHTTPProxyPort
+	case proxySchemeSOCKS5, proxySchemeSOCKS5H:
+		port = defaultSOCKS5ProxyPort
+	default:
+		return nil, fmt.Errorf("nats: unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Hostname() == _EMPTY_ {
+		return nil, fmt.Errorf("nats: invalid proxy URL %q", proxy)
+	}
+	if u.Port() == _EMPTY_ {
+		u.Host = net.JoinHostPort(u.Hostname(), port)
+	}
+	return u, nil
+}
+
+// proxyURL returns the proxy to use to reach the given server URL,
+// or nil if the connection should be direct.
+func (nc *Conn) proxyURL(u *url.URL) (*url.URL, error) {
+	if nc.Opts.ProxyURL != _EMPTY_ {
+		return parseProxyURL(nc.Opts.ProxyURL)
+	}
+	if !nc.Opts.ProxyFromEnvironment {
+		return nil, nil
+	}
+	proxy := getEnvAny("HTTPS_PROXY", "https_proxy", "ALL_PROXY", "all_proxy")
+	if proxy == _EMPTY_ || !useProxy(u.Hostname(), getEnvAny("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+	return parseProxyURL(proxy)
+}
+
+func getEnvAny(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != _EMPTY_ {
+			return v
+		}
+	}
+	return _EMPTY_
+}
+
+// useProxy returns false if the host matches an entry of the NO_PROXY
+// list. Entries can be "*", a domain name, which also matches its
+// sub-domains, an IP address or a CIDR block. Ports are ignored.
+func useProxy(host, noProxy string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, p := range strings.Split(noProxy, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == _EMPTY_ {
+			continue
+		}
+		if p == "*" {
+			return false
+		}
+		if _, cidr, err := net.ParseCIDR(p); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return false
+			}
+			continue
+		}
+		if h, _, err := net.SplitHostPort(p); err == nil {
+			p = h
+		}
+		p = strings.TrimPrefix(p, ".")
+		if host == p || strings.HasSuffix(host, "."+p) {
+			return false
+		}
+	}
+	return true
+}
+
+// dialProxy connects to the proxy with the given dialer and asks it to
+// open a tunnel to addr. The returned connection is used as if it was
+// directly connected to the server, so TLS and websocket handshakes are
+// done through the tunnel.
+func (nc *Conn) dialProxy(dialer CustomDialer, proxy *url.URL, addr string) (net.Conn, error) {
+	conn, err := dialer.Dial("tcp", proxy.Host)
+	if err != nil {
+		return nil, err
+	}
+	if nc.Opts.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(nc.Opts.Timeout))
+	}
+	if proxy.Scheme == proxySchemeHTTP {
+		conn, err = httpProxyConnect(conn, proxy, addr)
+	} else {
+		err = socks5ProxyConnect(conn, proxy, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// httpProxyConnect opens a tunnel with an HTTP CONNECT request.
+func httpProxyConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("nats: proxy error: %s", resp.Status)
+	}
+	// The server may have sent data, such as the INFO protocol, right
+	// after the response.
+	if n := br.Buffered(); n > 0 {
+		buf, _ := br.Peek(n)
+		return &bufferedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(buf), conn)}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a net.Conn whose reads start with already buffered data.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// socks5ProxyConnect opens a tunnel as described in RFC 1928, with the
+// username/password authentication of RFC 1929 if the proxy URL has
+// user info. With the "socks5" scheme the host name is resolved locally,
+// with "socks5h" it is resolved by the proxy.
+func socks5ProxyConnect(conn net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return fmt.Errorf("nats: invalid port %q", portStr)
+	}
+	if proxy.Scheme == proxySchemeSOCKS5 && net.ParseIP(host) == nil {
+		addrs, err := net.LookupHost(host)
+		if err != nil {
+			return err
+		}
+		host = addrs[0]
+	}
+
+	methods := []byte{socks5AuthNone}
+	if proxy.User != nil {
+		methods = append(methods, socks5AuthUserPass)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var buf [4]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("nats: unexpected socks version %d", buf[0])
+	}
+	switch buf[1] {
+	case socks5AuthNone:
+	case socks5AuthUserPass:
+		if proxy.User == nil {
+			return errors.New("nats: socks5 proxy requires authentication")
+		}
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return errors.New("nats: socks5 username or password too long")
+		}
+		req := []byte{1, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != 0 {
+			return errors.New("nats: socks5 proxy authentication failed")
+		}
+	default:
+		return errors.New("nats: no acceptable socks5 authentication method")
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socks5AddrIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socks5AddrIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("nats: host name %q too long", host)
+		}
+		req = append(req, socks5AddrDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// The reply is VER REP RSV ATYP BND.ADDR BND.PORT
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != 0 {
+		msg := "unknown error"
+		if int(buf[1]) < len(errSOCKS5Reply) {
+			msg = errSOCKS5Reply[buf[1]]
+		}
+		return fmt.Errorf("nats: socks5 proxy error: %s", msg)
+	}
+	var n int
+	switch buf[3] {
+	case socks5AddrIPv4:
+		n = net.IPv4len
+	case socks5AddrIPv6:
+		n = net.IPv6len
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		n = int(buf[0])
+	default:
+		return fmt.Errorf("nats: unexpected socks5 address type %d", buf[3])
+	}
+	_, err = io.CopyN(io.Discard, conn, int64(n+2))
+	return err
+}
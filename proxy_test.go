@@ -0,0 +1,357 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	natsserver "github.com/nats-io/nats-server/v2/test"
+)
+
+// testProxy is an HTTP CONNECT or SOCKS5 proxy that reports the addresses
+// it opened tunnels to.
+type testProxy struct {
+	t       *testing.T
+	l       net.Listener
+	socks   bool
+	user    string
+	pass    string
+	targets chan string
+}
+
+func newTestProxy(t *testing.T, socks bool, user, pass string) *testProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	p := &testProxy{t: t, l: l, socks: socks, user: user, pass: pass, targets: make(chan string, 10)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go p.handle(c)
+		}
+	}()
+	return p
+}
+
+func (p *testProxy) url() string {
+	scheme := "http"
+	if p.socks {
+		scheme = "socks5h"
+	}
+	if p.user != _EMPTY_ {
+		return fmt.Sprintf("%s://%s:%s@%s", scheme, p.user, p.pass, p.l.Addr())
+	}
+	return fmt.Sprintf("%s://%s", scheme, p.l.Addr())
+}
+
+func (p *testProxy) handle(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	var target string
+	var ok bool
+	if p.socks {
+		target, ok = p.socksHandshake(c, br)
+	} else {
+		target, ok = p.httpHandshake(c, br)
+	}
+	if !ok {
+		return
+	}
+	p.targets <- target
+	sc, err := net.Dial("tcp", target)
+	if err != nil {
+		return
+	}
+	defer sc.Close()
+	if p.socks {
+		c.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	} else {
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	}
+	go io.Copy(sc, br)
+	io.Copy(c, sc)
+}
+
+func (p *testProxy) httpHandshake(c net.Conn, br *bufio.Reader) (string, bool) {
+	req, err := http.ReadRequest(br)
+	if err != nil || req.Method != http.MethodConnect {
+		return _EMPTY_, false
+	}
+	if p.user != _EMPTY_ {
+		auth := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.user+":"+p.pass))
+		if req.Header.Get("Proxy-Authorization") != auth {
+			c.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return _EMPTY_, false
+		}
+	}
+	return req.Host, true
+}
+
+func (p *testProxy) socksHandshake(c net.Conn, br *bufio.Reader) (string, bool) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(br, buf[:2]); err != nil {
+		return _EMPTY_, false
+	}
+	methods := make([]byte, buf[1])
+	if _, err := io.ReadFull(br, methods); err != nil {
+		return _EMPTY_, false
+	}
+	if p.user == _EMPTY_ {
+		c.Write([]byte{5, 0})
+	} else {
+		if !strings.Contains(string(methods), "\x02") {
+			c.Write([]byte{5, 0xff})
+			return _EMPTY_, false
+		}
+		c.Write([]byte{5, 2})
+		var creds []string
+		io.ReadFull(br, buf[:1])
+		for i := 0; i < 2; i++ {
+			io.ReadFull(br, buf[:1])
+			n := int(buf[0])
+			io.ReadFull(br, buf[:n])
+			creds = append(creds, string(buf[:n]))
+		}
+		if creds[0] != p.user || creds[1] != p.pass {
+			c.Write([]byte{1, 1})
+			return _EMPTY_, false
+		}
+		c.Write([]byte{1, 0})
+	}
+	if _, err := io.ReadFull(br, buf[:4]); err != nil {
+		return _EMPTY_, false
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		io.ReadFull(br, buf[:4])
+		host = net.IP(buf[:4]).String()
+	case 3:
+		io.ReadFull(br, buf[:1])
+		n := int(buf[0])
+		io.ReadFull(br, buf[:n])
+		host = string(buf[:n])
+	default:
+		c.Write([]byte{5, 8, 0, 1, 0, 0, 0, 0, 0, 0})
+		return _EMPTY_, false
+	}
+	io.ReadFull(br, buf[:2])
+	port := binary.BigEndian.Uint16(buf[:2])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), true
+}
+
+func (p *testProxy) checkTarget(expected string) {
+	p.t.Helper()
+	select {
+	case target := <-p.targets:
+		if target != expected {
+			p.t.Fatalf("Expected tunnel to %q, got %q", expected, target)
+		}
+	case <-time.After(2 * time.Second):
+		p.t.Fatal("Proxy was not used")
+	}
+}
+
+func TestProxyConnect(t *testing.T) {
+	sopts := testWSGetDefaultOptions(t, false)
+	s := RunServerWithOptions(sopts)
+	defer s.Shutdown()
+
+	natsAddr := fmt.Sprintf("127.0.0.1:%d", sopts.Port)
+	wsAddr := fmt.Sprintf("127.0.0.1:%d", sopts.Websocket.Port)
+
+	for _, test := range []struct {
+		name  string
+		socks bool
+		user  string
+		url   string
+		addr  string
+	}{
+		{"http", false, _EMPTY_, "nats://" + natsAddr, natsAddr},
+		{"http auth", false, "user", "nats://" + natsAddr, natsAddr},
+		{"http websocket", false, "user", "ws://" + wsAddr, wsAddr},
+		{"socks5", true, _EMPTY_, "nats://" + natsAddr, natsAddr},
+		{"socks5 auth", true, "user", "nats://" + natsAddr, natsAddr},
+		{"socks5 websocket", true, "user", "ws://" + wsAddr, wsAddr},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTestProxy(t, test.socks, test.user, "pwd")
+			defer p.l.Close()
+
+			nc, err := Connect(test.url, ProxyURL(p.url()))
+			if err != nil {
+				t.Fatalf("Error on connect: %v", err)
+			}
+			defer nc.Close()
+			p.checkTarget(test.addr)
+
+			sub, err := nc.SubscribeSync("foo")
+			if err != nil {
+				t.Fatalf("Error on subscribe: %v", err)
+			}
+			if err := nc.Publish("foo", []byte("hello")); err != nil {
+				t.Fatalf("Error on publish: %v", err)
+			}
+			if _, err := sub.NextMsg(time.Second); err != nil {
+				t.Fatalf("Error getting message: %v", err)
+			}
+
+			if test.user != _EMPTY_ {
+				bad := strings.Replace(p.url(), ":pwd@", ":bad@", 1)
+				if _, err := Connect(test.url, ProxyURL(bad)); err == nil {
+					t.Fatal("Expected error with bad proxy credentials")
+				}
+			}
+		})
+	}
+}
+
+func TestProxyWithTLS(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	tc := &server.TLSConfigOpts{
+		CertFile: "./test/configs/certs/server.pem",
+		KeyFile:  "./test/configs/certs/key.pem",
+	}
+	var err error
+	if opts.TLSConfig, err = server.GenTLSConfig(tc); err != nil {
+		t.Fatalf("Can't build TLCConfig: %v", err)
+	}
+	s := RunServerWithOptions(&opts)
+	defer s.Shutdown()
+
+	p := newTestProxy(t, false, "user", "pwd")
+	defer p.l.Close()
+
+	addr := fmt.Sprintf("localhost:%d", opts.Port)
+	// The test certificates use SHA1 signatures, which are no longer
+	// accepted, but this is about the handshake going through the proxy.
+	nc, err := Connect("tls://"+addr, ProxyURL(p.url()), Secure(&tls.Config{InsecureSkipVerify: true}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	p.checkTarget(addr)
+	if !nc.TLSRequired() {
+		t.Fatal("Expected a TLS connection")
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+}
+
+func TestProxyFromEnvironment(t *testing.T) {
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	addr := s.Addr().String()
+	p := newTestProxy(t, false, _EMPTY_, _EMPTY_)
+	defer p.l.Close()
+
+	t.Setenv("HTTPS_PROXY", p.l.Addr().String())
+	t.Setenv("NO_PROXY", _EMPTY_)
+
+	// The environment is used only if asked for.
+	nc, err := Connect("nats://" + addr)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+
+	nc, err = Connect("nats://"+addr, ProxyFromEnvironment())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+	p.checkTarget(addr)
+
+	t.Setenv("NO_PROXY", "example.com,127.0.0.0/8")
+	nc, err = Connect("nats://"+addr, ProxyFromEnvironment())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+	select {
+	case target := <-p.targets:
+		t.Fatalf("Proxy should not have been used, got tunnel to %q", target)
+	default:
+	}
+}
+
+func TestProxyURLAndNoProxy(t *testing.T) {
+	for _, test := range []struct {
+		proxy string
+		url   string
+		err   bool
+	}{
+		{"proxy:3128", "http://proxy:3128", false},
+		{"http://proxy", "http://proxy:80", false},
+		{"socks5://u:p@proxy", "socks5://u:p@proxy:1080", false},
+		{"socks5h://proxy:1081", "socks5h://proxy:1081", false},
+		{"ftp://proxy", _EMPTY_, true},
+		{"http://", _EMPTY_, true},
+	} {
+		u, err := parseProxyURL(test.proxy)
+		if test.err {
+			if err == nil {
+				t.Fatalf("Expected error for %q", test.proxy)
+			}
+			continue
+		}
+		if err != nil || u.String() != test.url {
+			t.Fatalf("Expected %q for %q, got %v (%v)", test.url, test.proxy, u, err)
+		}
+	}
+	if _, err := Connect("nats://127.0.0.1:4222", ProxyURL("ftp://proxy")); err == nil {
+		t.Fatal("Expected error for invalid proxy scheme")
+	}
+
+	for _, test := range []struct {
+		host    string
+		noProxy string
+		use     bool
+	}{
+		{"nats.example.com", _EMPTY_, true},
+		{"nats.example.com", "*", false},
+		{"nats.example.com", "other.com, example.com", false},
+		{"nats.example.com", ".example.com", false},
+		{"example.com", ".example.com", false},
+		{"badexample.com", "example.com", true},
+		{"NATS.Example.com", "example.com:4222", false},
+		{"10.1.2.3", "10.0.0.0/8", false},
+		{"11.1.2.3", "10.0.0.0/8", true},
+		{"10.1.2.3", "10.1.2.3", false},
+	} {
+		if use := useProxy(test.host, test.noProxy); use != test.use {
+			t.Fatalf("Expected useProxy(%q, %q) to be %v", test.host, test.noProxy, test.use)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/wutianze/nats.go/subject"
+)
+
+// A capture is a sequence of records, each prefixed with its length as
+// an unsigned varint, so that captures can be appended to. A record is:
+//
+//	version     byte
+//	direction   byte
+//	time        varint, Unix time in nanoseconds
+//	subject     uvarint length + bytes
+//	reply       uvarint length + bytes
+//	headers     uvarint length + bytes, in the NATS/1.0 wire format
+//	payload     uvarint length + bytes
+const captureVersion = 1
+
+// Maximum size of a record, to detect corrupted captures before
+// allocating their size.
+const maxCaptureRecord = 64 * 1024 * 1024
+
+// ErrBadCapture is returned when reading an invalid capture.
+var ErrBadCapture = errors.New("nats: invalid capture")
+
+// Recorder writes the messages published and received by connections to a
+// capture, which can be read with a CaptureReader and replayed with Replay
+// or ReplayToStream. The capture is buffered, Flush or Close must be called
+// to write it.
+type Recorder struct {
+	mu      sync.Mutex
+	w       *bufio.Writer
+	closer  io.Closer
+	filters []string
+	detach  []func()
+	buf     []byte
+	err     error
+	closed  bool
+}
+
+// NewRecorder returns a recorder writing to w, which is closed by Close if
+// it is an io.Closer. If subjects are given, only the messages matching one
+// of these subjects, which can have wildcards, are recorded.
+func NewRecorder(w io.Writer, subjects ...string) (*Recorder, error) {
+	for _, s := range subjects {
+		if !subject.IsValidSubscribe(s) {
+			return nil, ErrBadSubject
+		}
+	}
+	r := &Recorder{w: bufio.NewWriter(w), filters: subjects}
+	if c, ok := w.(io.Closer); ok {
+		r.closer = c
+	}
+	return r, nil
+}
+
+// Attach records the messages published and received by the connection
+// from now on, until the recorder is closed.
+func (r *Recorder) Attach(nc *Conn) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return ErrInvalidArg
+	}
+	r.detach = append(r.detach, nc.AddInterceptor(r.record))
+	return nil
+}
+
+func (r *Recorder) record(m *Msg, dir MsgDirection) {
+	if !subjectMatchesAny(r.filters, m.Subject) {
+		return
+	}
+	hdr, err := m.headerBytes()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.err != nil {
+		return
+	}
+	if err != nil {
+		r.err = err
+		return
+	}
+	var vb [binary.MaxVarintLen64]byte
+	b := r.buf[:0]
+	b = append(b, captureVersion, byte(dir))
+	b = append(b, vb[:binary.PutVarint(vb[:], time.Now().UnixNano())]...)
+	b = appendUvarintBytes(b, []byte(m.Subject))
+	b = appendUvarintBytes(b, []byte(m.Reply))
+	b = appendUvarintBytes(b, hdr)
+	b = appendUvarintBytes(b, m.Data)
+	r.buf = b
+
+	if _, r.err = r.w.Write(vb[:binary.PutUvarint(vb[:], uint64(len(b)))]); r.err == nil {
+		_, r.err = r.w.Write(b)
+	}
+}
+
+func appendUvarintBytes(b, data []byte) []byte {
+	var lb [binary.MaxVarintLen64]byte
+	b = append(b, lb[:binary.PutUvarint(lb[:], uint64(len(data)))]...)
+	return append(b, data...)
+}
+
+func subjectMatchesAny(filters []string, subj string) bool {
+	if len(filters) == 0 {
+		return true
+	}
+	for _, f := range filters {
+		if subject.SubjectMatches(f, subj) {
+			return true
+		}
+	}
+	return false
+}
+
+// Flush writes the buffered records, returning the first error that
+// happened while recording, if any.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return r.err
+	}
+	r.err = r.w.Flush()
+	return r.err
+}
+
+// Close detaches the recorder from the connections, flushes it and
+// closes the underlying writer.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	detach := r.detach
+	r.detach = nil
+	r.mu.Unlock()
+
+	for _, f := range detach {
+		f()
+	}
+	err := r.Flush()
+	if r.closer != nil {
+		if cerr := r.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// RecordedMsg is a message read from a capture.
+type RecordedMsg struct {
+	Time      time.Time
+	Direction MsgDirection
+	Subject   string
+	Reply     string
+	Header    Header
+	Data      []byte
+}
+
+// Msg returns a message to publish the recorded message again.
+func (rm *RecordedMsg) Msg() *Msg {
+	return &Msg{Subject: rm.Subject, Reply: rm.Reply, Header: rm.Header, Data: rm.Data}
+}
+
+// CaptureReader reads the messages of a capture written by a Recorder.
+type CaptureReader struct {
+	r       *bufio.Reader
+	filters []string
+}
+
+// NewCaptureReader returns a reader of the capture. If subjects are given,
+// only the messages matching one of these subjects, which can have
+// wildcards, are returned.
+func NewCaptureReader(r io.Reader, subjects ...string) (*CaptureReader, error) {
+	for _, s := range subjects {
+		if !subject.IsValidSubscribe(s) {
+			return nil, ErrBadSubject
+		}
+	}
+	return &CaptureReader{r: bufio.NewReader(r), filters: subjects}, nil
+}
+
+// Next returns the next message of the capture, or io.EOF at the end. A
+// truncated last record, as left by a process that did not close its
+// recorder, returns io.ErrUnexpectedEOF.
+func (cr *CaptureReader) Next() (*RecordedMsg, error) {
+	for {
+		size, err := binary.ReadUvarint(cr.r)
+		if err != nil {
+			return nil, err
+		}
+		if size > maxCaptureRecord {
+			return nil, ErrBadCapture
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(cr.r, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		rm, err := decodeCaptureRecord(b)
+		if err != nil {
+			return nil, err
+		}
+		if subjectMatchesAny(cr.filters, rm.Subject) {
+			return rm, nil
+		}
+	}
+}
+
+func decodeCaptureRecord(b []byte) (*RecordedMsg, error) {
+	if len(b) < 2 || b[0] != captureVersion {
+		return nil, ErrBadCapture
+	}
+	rm := &RecordedMsg{Direction: MsgDirection(b[1])}
+	b = b[2:]
+	ts, n := binary.Varint(b)
+	if n <= 0 {
+		return nil, ErrBadCapture
+	}
+	rm.Time = time.Unix(0, ts)
+	b = b[n:]
+	var fields [4][]byte
+	for i := range fields {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return nil, ErrBadCapture
+		}
+		fields[i], b = b[n:n+int(l)], b[n+int(l):]
+	}
+	rm.Subject, rm.Reply, rm.Data = string(fields[0]), string(fields[1]), fields[3]
+	if len(fields[2]) > 0 {
+		h, err := decodeHeadersMsg(fields[2])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadCapture, err)
+		}
+		rm.Header = h
+	}
+	return rm, nil
+}
+
+// ReplayOpt configures Replay and ReplayToStream.
+type ReplayOpt func(*replayOpts) error
+
+type replayOpts struct {
+	ctx   context.Context
+	speed float64
+	dir   MsgDirection
+}
+
+// ReplaySpeed sets the speed of the replay relative to the capture: 1,
+// the default, keeps the original pace, 10 replays ten times faster, and
+// 0 replays the messages without waiting.
+func ReplaySpeed(speed float64) ReplayOpt {
+	return func(o *replayOpts) error {
+		if speed < 0 {
+			return ErrInvalidArg
+		}
+		o.speed = speed
+		return nil
+	}
+}
+
+// ReplayDirection sets the direction of the messages replayed, MsgOutbound
+// by default, or MsgInbound to re-inject what an application received.
+// The messages of the other direction are skipped, since a message both
+// published and received by the recorded connection is captured twice.
+func ReplayDirection(dir MsgDirection) ReplayOpt {
+	return func(o *replayOpts) error {
+		if dir != MsgInbound && dir != MsgOutbound {
+			return ErrInvalidArg
+		}
+		o.dir = dir
+		return nil
+	}
+}
+
+// ReplayContext stops the replay when the context is done.
+func ReplayContext(ctx context.Context) ReplayOpt {
+	return func(o *replayOpts) error {
+		if ctx == nil {
+			return ErrInvalidArg
+		}
+		o.ctx = ctx
+		return nil
+	}
+}
+
+// Replay publishes the outbound messages of the capture on the connection,
+// or those of the direction set with ReplayDirection, returning the
+// number of messages published.
+func Replay(cr *CaptureReader, nc *Conn, opts ...ReplayOpt) (int, error) {
+	return replay(cr, opts, func(_ context.Context, m *Msg) error {
+		return nc.PublishMsg(m)
+	})
+}
+
+// ReplayToStream publishes the outbound messages of the capture to
+// JetStream, or those of the direction set with ReplayDirection, waiting
+// for each to be stored. The reply subjects are not kept. It
+// returns the number of messages stored.
+func ReplayToStream(cr *CaptureReader, js JetStreamContext, opts ...ReplayOpt) (int, error) {
+	return replay(cr, opts, func(ctx context.Context, m *Msg) error {
+		m.Reply = _EMPTY_
+		var err error
+		if ctx != nil {
+			_, err = js.PublishMsg(m, Context(ctx))
+		} else {
+			_, err = js.PublishMsg(m)
+		}
+		return err
+	})
+}
+
+func replay(cr *CaptureReader, opts []ReplayOpt, publish func(context.Context, *Msg) error) (int, error) {
+	o := replayOpts{speed: 1, dir: MsgOutbound}
+	for _, opt := range opts {
+		if err := opt(&o); err != nil {
+			return 0, err
+		}
+	}
+	var done <-chan struct{}
+	if o.ctx != nil {
+		done = o.ctx.Done()
+	}
+	var first time.Time
+	start := time.Now()
+	n := 0
+	for {
+		rm, err := cr.Next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if rm.Direction != o.dir {
+			continue
+		}
+		if first.IsZero() {
+			first = rm.Time
+		}
+		if o.speed > 0 {
+			at := start.Add(time.Duration(float64(rm.Time.Sub(first)) / o.speed))
+			if d := time.Until(at); d > 0 {
+				t := time.NewTimer(d)
+				select {
+				case <-t.C:
+				case <-done:
+					t.Stop()
+					return n, o.ctx.Err()
+				}
+			}
+		}
+		if done != nil {
+			select {
+			case <-done:
+				return n, o.ctx.Err()
+			default:
+			}
+		}
+		if err := publish(o.ctx, rm.Msg()); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
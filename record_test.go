@@ -0,0 +1,266 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readCapture(t *testing.T, data []byte, subjects ...string) []*RecordedMsg {
+	t.Helper()
+	cr, err := NewCaptureReader(bytes.NewReader(data), subjects...)
+	if err != nil {
+		t.Fatalf("Error creating reader: %v", err)
+	}
+	var msgs []*RecordedMsg
+	for {
+		rm, err := cr.Next()
+		if err == io.EOF {
+			return msgs
+		}
+		if err != nil {
+			t.Fatalf("Error reading capture: %v", err)
+		}
+		msgs = append(msgs, rm)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	nc, err := Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	path := filepath.Join(t.TempDir(), "capture")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	if _, err := NewRecorder(f, "foo..bar"); err != ErrBadSubject {
+		t.Fatalf("Expected %v, got %v", ErrBadSubject, err)
+	}
+	rec, err := NewRecorder(f, "orders.>")
+	if err != nil {
+		t.Fatalf("Error creating recorder: %v", err)
+	}
+	if err := rec.Attach(nc); err != nil {
+		t.Fatalf("Error attaching recorder: %v", err)
+	}
+
+	sub, err := nc.SubscribeSync("orders.*")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	before := time.Now()
+	msg := NewMsg("orders.new")
+	msg.Reply = "reply"
+	msg.Header.Set("Id", "1")
+	msg.Data = []byte("order 1")
+	if err := nc.PublishMsg(msg); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if err := nc.PublishBatch([]*Msg{{Subject: "orders.paid", Data: []byte("order 2")}, {Subject: "other", Data: []byte("skipped")}}); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := sub.NextMsg(time.Second); err != nil {
+			t.Fatalf("Error getting message: %v", err)
+		}
+	}
+	if err := rec.Close(); err != nil {
+		t.Fatalf("Error closing recorder: %v", err)
+	}
+	// Nothing is recorded after close.
+	nc.Publish("orders.late", nil)
+	nc.Flush()
+	if err := rec.Attach(nc); err == nil {
+		t.Fatal("Expected error attaching a closed recorder")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+	msgs := readCapture(t, data)
+	if len(msgs) != 4 {
+		t.Fatalf("Expected 4 messages, got %v", len(msgs))
+	}
+	var out, in []*RecordedMsg
+	for _, rm := range msgs {
+		if rm.Time.Before(before) || rm.Time.After(time.Now()) {
+			t.Fatalf("Unexpected time: %v", rm.Time)
+		}
+		if rm.Direction == MsgOutbound {
+			out = append(out, rm)
+		} else {
+			in = append(in, rm)
+		}
+	}
+	if len(out) != 2 || len(in) != 2 {
+		t.Fatalf("Expected 2 messages in each direction, got %v and %v", len(out), len(in))
+	}
+	for _, rms := range [][]*RecordedMsg{out, in} {
+		rm := rms[0]
+		if rm.Subject != "orders.new" || rm.Reply != "reply" || rm.Header.Get("Id") != "1" || string(rm.Data) != "order 1" {
+			t.Fatalf("Unexpected message: %+v", rm)
+		}
+		if rm := rms[1]; rm.Subject != "orders.paid" || string(rm.Data) != "order 2" {
+			t.Fatalf("Unexpected message: %+v", rm)
+		}
+	}
+	if msgs := readCapture(t, data, "orders.paid"); len(msgs) != 2 {
+		t.Fatalf("Expected 2 filtered messages, got %v", len(msgs))
+	}
+
+	// A truncated capture.
+	cr, _ := NewCaptureReader(bytes.NewReader(data[:len(data)-3]))
+	var rerr error
+	for rerr == nil {
+		_, rerr = cr.Next()
+	}
+	if rerr != io.ErrUnexpectedEOF {
+		t.Fatalf("Expected %v, got %v", io.ErrUnexpectedEOF, rerr)
+	}
+	cr, _ = NewCaptureReader(bytes.NewReader([]byte{3, 9, 0, 0}))
+	if _, err := cr.Next(); err != ErrBadCapture {
+		t.Fatalf("Expected %v, got %v", ErrBadCapture, err)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	var capture bytes.Buffer
+	rec, err := NewRecorder(&capture)
+	if err != nil {
+		t.Fatalf("Error creating recorder: %v", err)
+	}
+	rec.Attach(nc)
+	for i := 0; i < 5; i++ {
+		nc.Publish("events", []byte{byte('0' + i)})
+		time.Sleep(40 * time.Millisecond)
+	}
+	nc.Flush()
+	rec.Close()
+
+	sub, err := nc.SubscribeSync("events")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+
+	// At the original pace, and 4 times faster.
+	for _, test := range []struct {
+		speed float64
+		min   time.Duration
+		max   time.Duration
+	}{
+		{1, 150 * time.Millisecond, time.Second},
+		{4, 40 * time.Millisecond, 150 * time.Millisecond},
+		{0, 0, 40 * time.Millisecond},
+	} {
+		cr, _ := NewCaptureReader(bytes.NewReader(capture.Bytes()))
+		start := time.Now()
+		n, err := Replay(cr, nc, ReplaySpeed(test.speed), ReplayDirection(MsgOutbound))
+		if err != nil || n != 5 {
+			t.Fatalf("Unexpected replay result: %v, %v", n, err)
+		}
+		if d := time.Since(start); d < test.min || d > test.max {
+			t.Fatalf("Replay at speed %v took %v", test.speed, d)
+		}
+		for i := 0; i < 5; i++ {
+			m, err := sub.NextMsg(time.Second)
+			if err != nil || m.Data[0] != byte('0'+i) {
+				t.Fatalf("Unexpected message: %v, %v", m, err)
+			}
+		}
+	}
+
+	// Canceled replay
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cr, _ := NewCaptureReader(bytes.NewReader(capture.Bytes()))
+	if n, err := Replay(cr, nc, ReplayContext(ctx)); n != 0 || err != context.Canceled {
+		t.Fatalf("Unexpected replay result: %v, %v", n, err)
+	}
+	if _, err := Replay(cr, nc, ReplaySpeed(-1)); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+	if _, err := Replay(cr, nc, ReplayDirection(MsgDirection(5))); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+
+	// Messages both sent and received are replayed once.
+	var both bytes.Buffer
+	rec, err = NewRecorder(&both)
+	if err != nil {
+		t.Fatalf("Error creating recorder: %v", err)
+	}
+	rec.Attach(nc)
+	for i := 0; i < 5; i++ {
+		nc.Publish("events", []byte{byte('0' + i)})
+		if _, err := sub.NextMsg(time.Second); err != nil {
+			t.Fatalf("Error getting message: %v", err)
+		}
+	}
+	rec.Close()
+	for _, dir := range []ReplayOpt{nil, ReplayDirection(MsgOutbound), ReplayDirection(MsgInbound)} {
+		opts := []ReplayOpt{ReplaySpeed(0)}
+		if dir != nil {
+			opts = append(opts, dir)
+		}
+		cr, _ := NewCaptureReader(bytes.NewReader(both.Bytes()))
+		if n, err := Replay(cr, nc, opts...); err != nil || n != 5 {
+			t.Fatalf("Unexpected replay result: %v, %v", n, err)
+		}
+		for i := 0; i < 5; i++ {
+			if _, err := sub.NextMsg(time.Second); err != nil {
+				t.Fatalf("Error getting message: %v", err)
+			}
+		}
+		if m, err := sub.NextMsg(50 * time.Millisecond); err == nil {
+			t.Fatalf("Unexpected message: %v", m)
+		}
+	}
+
+	// Into a stream.
+	if _, err := js.AddStream(&StreamConfig{Name: "EVENTS", Subjects: []string{"events"}}); err != nil {
+		t.Fatalf("Error adding stream: %v", err)
+	}
+	cr, _ = NewCaptureReader(bytes.NewReader(capture.Bytes()))
+	n, err := ReplayToStream(cr, js, ReplaySpeed(0), ReplayDirection(MsgOutbound))
+	if err != nil || n != 5 {
+		t.Fatalf("Unexpected replay result: %v, %v", n, err)
+	}
+	si, err := js.StreamInfo("EVENTS")
+	if err != nil {
+		t.Fatalf("Error getting stream info: %v", err)
+	}
+	if si.State.Msgs != 5 {
+		t.Fatalf("Expected 5 messages in the stream, got %v", si.State.Msgs)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+
+	"github.com/nats-io/nkeys"
+	"github.com/wutianze/nats.go/subject"
+)
+
+// Headers of the signed messages. The signature covers the subject, the
+// headers listed in SignedHeadersHdr and the payload.
+const (
+	SignatureHdr     = "Nats-Signature"
+	SignerHdr        = "Nats-Signer"
+	SignedHeadersHdr = "Nats-Signed-Headers"
+)
+
+var (
+	ErrMsgNotSigned     = errors.New("nats: message is not signed")
+	ErrInvalidSignature = errors.New("nats: invalid message signature")
+	ErrUntrustedSigner  = errors.New("nats: message signed by an untrusted key")
+)
+
+// SignatureErrHandler is invoked with the messages that are not signed, or
+// not by a trusted key, which are not delivered to the subscription.
+type SignatureErrHandler func(nc *Conn, sub *Subscription, m *Msg, err error)
+
+// MessageSigning is an Option to sign the messages published with
+// Conn.PublishMsg and the JetStream publish calls, which includes the
+// KeyValue and ObjectStore puts, with the given key pair. The signature
+// covers the subject, the given headers and the payload. Messages that are
+// already signed, for instance when republished, are left as is.
+func MessageSigning(kp nkeys.KeyPair, headers ...string) Option {
+	return func(o *Options) error {
+		if kp == nil {
+			return ErrInvalidArg
+		}
+		if _, err := kp.PublicKey(); err != nil {
+			return err
+		}
+		for _, h := range headers {
+			if h == _EMPTY_ || strings.ContainsAny(h, ", :\r\n") {
+				return fmt.Errorf("nats: invalid signed header %q", h)
+			}
+		}
+		o.MessageSigning = kp
+		o.SignedHeaders = headers
+		return nil
+	}
+}
+
+// MessageSigningFromSeed is an Option to sign the messages with the key
+// pair of the given seed file. Unlike NkeyOptionFromSeed, the key is kept
+// in memory for the lifetime of the connection. See MessageSigning for
+// more details.
+func MessageSigningFromSeed(seedFile string, headers ...string) Option {
+	return func(o *Options) error {
+		kp, err := nkeyPairFromSeedFile(seedFile)
+		if err != nil {
+			return err
+		}
+		return MessageSigning(kp, headers...)(o)
+	}
+}
+
+// VerifySignatures is an Option to only deliver to subscriptions the
+// messages signed by one of the trusted public keys. If subjects are
+// given, only the messages on subjects matching one of them are verified.
+// Otherwise, all the messages are, except the responses to the requests
+// made by the connection, including the JetStream API and publish
+// acknowledgements, and the JetStream flow control, heartbeats and pull
+// requests statuses. Messages received on an inbox by other
+// subscriptions are verified. Stored
+// messages fetched with JetStreamContext.GetMsg or KeyValue.Get fail with
+// the verification error. Other messages failing the verification are
+// passed to the handler, or reported to the ErrorHandler if it is nil.
+// Note that JetStream messages not delivered must still be acknowledged
+// to not be redelivered.
+func VerifySignatures(trusted []string, cb SignatureErrHandler, subjects ...string) Option {
+	return func(o *Options) error {
+		if len(trusted) == 0 {
+			return ErrInvalidArg
+		}
+		for _, pub := range trusted {
+			if _, err := nkeys.FromPublicKey(pub); err != nil {
+				return fmt.Errorf("nats: invalid trusted key %q: %v", pub, err)
+			}
+		}
+		for _, s := range subjects {
+			if !subject.IsValidSubscribe(s) {
+				return ErrBadSubject
+			}
+		}
+		o.TrustedSigners = trusted
+		o.SignatureErrCB = cb
+		o.VerifySubjects = subjects
+		return nil
+	}
+}
+
+// signedContent returns the data covered by the signature, each part
+// being prefixed by its length so that they can not be confused.
+func signedContent(subj string, hdr Header, names []string, data []byte) []byte {
+	b := make([]byte, 0, len(subj)+len(data)+64)
+	b = appendUvarintBytes(b, []byte(subj))
+	for _, name := range names {
+		b = appendUvarintBytes(b, []byte(name))
+		for _, v := range hdr.Values(name) {
+			b = appendUvarintBytes(b, []byte(v))
+		}
+		b = append(b, 0)
+	}
+	return appendUvarintBytes(b, data)
+}
+
+// signMsg returns a signed copy of the message, or the message itself if
+// signing is not enabled or it is already signed.
+func (nc *Conn) signMsg(m *Msg) (*Msg, error) {
+	kp := nc.Opts.MessageSigning
+	if kp == nil || m.Header.Get(SignatureHdr) != _EMPTY_ {
+		return m, nil
+	}
+	pub, err := kp.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(nc.Opts.SignedHeaders))
+	for i, h := range nc.Opts.SignedHeaders {
+		names[i] = textproto.CanonicalMIMEHeaderKey(h)
+	}
+	sig, err := kp.Sign(signedContent(m.Subject, m.Header, names, m.Data))
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make(Header, len(m.Header)+3)
+	for k, v := range m.Header {
+		hdr[k] = v
+	}
+	hdr.Set(SignerHdr, pub)
+	hdr.Set(SignatureHdr, base64.RawURLEncoding.EncodeToString(sig))
+	if len(names) > 0 {
+		hdr.Set(SignedHeadersHdr, strings.Join(names, ","))
+	}
+	return &Msg{Subject: m.Subject, Reply: m.Reply, Header: hdr, Data: m.Data, Sub: m.Sub}, nil
+}
+
+// verifyMsg checks the signature of a message, if it is to be verified.
+func (nc *Conn) verifyMsg(subj string, hdr Header, data []byte) error {
+	o := &nc.Opts
+	if len(o.TrustedSigners) == 0 {
+		return nil
+	}
+	if len(o.VerifySubjects) > 0 && !subjectMatchesAny(o.VerifySubjects, subj) {
+		return nil
+	}
+
+	signer, sig := hdr.Get(SignerHdr), hdr.Get(SignatureHdr)
+	if signer == _EMPTY_ || sig == _EMPTY_ {
+		return ErrMsgNotSigned
+	}
+	trusted := false
+	for _, pub := range o.TrustedSigners {
+		if pub == signer {
+			trusted = true
+			break
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("%w: %s", ErrUntrustedSigner, signer)
+	}
+	kp, err := nkeys.FromPublicKey(signer)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	rawSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return ErrInvalidSignature
+	}
+	var names []string
+	if v := hdr.Get(SignedHeadersHdr); v != _EMPTY_ {
+		names = strings.Split(v, ",")
+	}
+	if kp.Verify(signedContent(subj, hdr, names, data), rawSig) != nil {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// verifiedSub returns whether the messages received by the subscription
+// are verified, which excludes the responses to the requests made by the
+// connection and the JetStream control messages.
+func verifiedSub(sub *Subscription, m *Msg) bool {
+	sub.mu.Lock()
+	resp, jsi := sub.resp, sub.jsi
+	sub.mu.Unlock()
+	if resp {
+		return false
+	}
+	if jsi == nil {
+		return true
+	}
+	if jsi.pull {
+		usrMsg, _ := checkMsg(m, false)
+		return usrMsg
+	}
+	ctrl, _ := isJSControlMessage(m)
+	return !ctrl
+}
+
+// setResponseSub marks the subscription as receiving the responses to the
+// requests made by the connection, which are not verified.
+func setResponseSub(sub *Subscription) {
+	sub.mu.Lock()
+	sub.resp = true
+	sub.mu.Unlock()
+}
+
+// checkSignature returns whether a received message can be delivered,
+// reporting the ones failing the verification.
+func (nc *Conn) checkSignature(sub *Subscription, m *Msg) bool {
+	if !verifiedSub(sub, m) {
+		return true
+	}
+	err := nc.verifyMsg(m.Subject, m.Header, m.Data)
+	if err == nil {
+		return true
+	}
+	nc.mu.Lock()
+	if cb := nc.Opts.SignatureErrCB; cb != nil {
+		nc.ach.push(func() { cb(nc, sub, m, err) })
+	} else if nc.Opts.AsyncErrorCB != nil {
+		nc.ach.push(func() { nc.Opts.AsyncErrorCB(nc, sub, err) })
+	}
+	nc.mu.Unlock()
+	return false
+}
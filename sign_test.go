@@ -0,0 +1,315 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nkeys"
+)
+
+func TestMessageSigning(t *testing.T) {
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	seed, _ := kp.Seed()
+	other, _ := nkeys.CreateUser()
+
+	seedFile := filepath.Join(t.TempDir(), "user.nk")
+	if err := os.WriteFile(seedFile, seed, 0600); err != nil {
+		t.Fatalf("Error writing seed: %v", err)
+	}
+	pnc, err := Connect(s.ClientURL(), MessageSigningFromSeed(seedFile, "Order-Id"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer pnc.Close()
+	onc, err := Connect(s.ClientURL(), MessageSigning(other))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer onc.Close()
+
+	type rejected struct {
+		m   *Msg
+		err error
+	}
+	rch := make(chan rejected, 10)
+	snc, err := Connect(s.ClientURL(), VerifySignatures([]string{pub}, func(_ *Conn, _ *Subscription, m *Msg, err error) {
+		rch <- rejected{m, err}
+	}, "orders.>"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer snc.Close()
+
+	sub, err := snc.SubscribeSync(">")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	snc.Flush()
+
+	msg := NewMsg("orders.new")
+	msg.Header.Set("Order-Id", "1")
+	msg.Data = []byte("order")
+	if err := pnc.PublishMsg(msg); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if msg.Header.Get(SignatureHdr) != _EMPTY_ {
+		t.Fatal("Published message was modified")
+	}
+	m, err := sub.NextMsg(time.Second)
+	if err != nil {
+		t.Fatalf("Error getting message: %v", err)
+	}
+	if string(m.Data) != "order" || m.Header.Get(SignerHdr) != pub || m.Header.Get(SignedHeadersHdr) != "Order-Id" {
+		t.Fatalf("Unexpected message: %+v", m)
+	}
+	// Not verified.
+	pnc.Publish("other", []byte("unsigned"))
+	if m, err := sub.NextMsg(time.Second); err != nil || string(m.Data) != "unsigned" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		publish func() error
+		err     error
+	}{
+		{"unsigned", func() error { return pnc.Publish("orders.new", []byte("order")) }, ErrMsgNotSigned},
+		{"untrusted", func() error { return onc.PublishMsg(&Msg{Subject: "orders.new", Data: []byte("order")}) }, ErrUntrustedSigner},
+		{"tampered payload", func() error {
+			tm := &Msg{Subject: "orders.new", Header: m.Header, Data: []byte("tampered")}
+			return onc.PublishMsg(tm)
+		}, ErrInvalidSignature},
+		{"tampered header", func() error {
+			tm := &Msg{Subject: "orders.new", Header: Header{}, Data: m.Data}
+			for k, v := range m.Header {
+				tm.Header[k] = v
+			}
+			tm.Header.Set("Order-Id", "2")
+			return onc.PublishMsg(tm)
+		}, ErrInvalidSignature},
+		{"other subject", func() error {
+			return onc.PublishMsg(&Msg{Subject: "orders.old", Header: m.Header, Data: m.Data})
+		}, ErrInvalidSignature},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.publish(); err != nil {
+				t.Fatalf("Error on publish: %v", err)
+			}
+			select {
+			case r := <-rch:
+				if !errors.Is(r.err, test.err) || r.m.Subject == _EMPTY_ {
+					t.Fatalf("Unexpected rejection: %+v, %v", r.m, r.err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Message not rejected")
+			}
+			if m, err := sub.NextMsg(50 * time.Millisecond); err != ErrTimeout {
+				t.Fatalf("Unexpected message: %+v, %v", m, err)
+			}
+		})
+	}
+
+	// The original message republished as is is still valid.
+	if err := onc.PublishMsg(&Msg{Subject: m.Subject, Header: m.Header, Data: m.Data}); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Error getting message: %v", err)
+	}
+
+	if _, err := Connect(s.ClientURL(), VerifySignatures(nil, nil)); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+	if _, err := Connect(s.ClientURL(), VerifySignatures([]string{"bad"}, nil)); err == nil {
+		t.Fatal("Expected error with invalid trusted key")
+	}
+}
+
+func TestMessageSigningResponses(t *testing.T) {
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	rch := make(chan error, 10)
+	snc, err := Connect(s.ClientURL(), VerifySignatures([]string{pub}, func(_ *Conn, _ *Subscription, _ *Msg, err error) {
+		rch <- err
+	}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer snc.Close()
+	raw, err := Connect(s.ClientURL())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer raw.Close()
+
+	// The responses to the requests of the connection are not verified.
+	raw.Subscribe("service", func(m *Msg) { m.Respond([]byte("unsigned")) })
+	raw.Flush()
+	if m, err := snc.Request("service", nil, time.Second); err != nil || string(m.Data) != "unsigned" {
+		t.Fatalf("Unexpected response: %+v, %v", m, err)
+	}
+	if m, err := snc.oldRequest("service", nil, nil, time.Second); err != nil || string(m.Data) != "unsigned" {
+		t.Fatalf("Unexpected response: %+v, %v", m, err)
+	}
+
+	// Other subscriptions are, regardless of the subject or content.
+	sub, err := snc.SubscribeSync(">")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	snc.Flush()
+	status := NewMsg("orders")
+	status.Header.Set(statusHdr, controlMsg)
+	status.Header.Set(descrHdr, "Idle Heartbeat")
+	for _, m := range []*Msg{{Subject: "_INBOX.x", Data: []byte("forged")}, status} {
+		if err := raw.PublishMsg(m); err != nil {
+			t.Fatalf("Error on publish: %v", err)
+		}
+		select {
+		case err := <-rch:
+			if err != ErrMsgNotSigned {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Message on %q not rejected", m.Subject)
+		}
+	}
+	if m, err := sub.NextMsg(50 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+}
+
+func TestMessageSigningJetStream(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	kr, _ := NewKeyRing(testAESKey("data", 1))
+	errCh := make(chan error, 10)
+	nc, js := jsClient(t, s, MessageSigning(kp), Encryption(kr), VerifySignatures([]string{pub}, nil),
+		ErrorHandler(func(_ *Conn, _ *Subscription, err error) { errCh <- err }))
+	defer nc.Close()
+	raw, rjs := jsClient(t, s)
+	defer raw.Close()
+
+	if _, err := js.AddStream(&StreamConfig{Name: "ORDERS", Subjects: []string{"orders"}}); err != nil {
+		t.Fatalf("Error adding stream: %v", err)
+	}
+	if _, err := js.Publish("orders", []byte("order 1")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if _, err := rjs.Publish("orders", []byte("forged")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if rm, err := js.GetMsg("ORDERS", 1); err != nil || string(rm.Data) != "order 1" {
+		t.Fatalf("Unexpected message: %+v, %v", rm, err)
+	}
+	if _, err := js.GetMsg("ORDERS", 2); err != ErrMsgNotSigned {
+		t.Fatalf("Expected %v, got %v", ErrMsgNotSigned, err)
+	}
+
+	// Only the signed message is delivered, and the error reported.
+	sub, err := js.SubscribeSync("orders", AckNone())
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	if m, err := sub.NextMsg(time.Second); err != nil || string(m.Data) != "order 1" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+	if m, err := sub.NextMsg(100 * time.Millisecond); err != ErrTimeout {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+	select {
+	case err := <-errCh:
+		if err != ErrMsgNotSigned {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Error not reported")
+	}
+
+	// Publish acknowledgements, heartbeats and flow control messages are
+	// not verified.
+	paf, err := js.PublishAsync("orders", []byte("order 3"))
+	if err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	select {
+	case <-paf.Ok():
+	case err := <-paf.Err():
+		t.Fatalf("Error on publish: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Did not get the ack")
+	}
+	hsub, err := js.SubscribeSync("orders", AckNone(), IdleHeartbeat(100*time.Millisecond), EnableFlowControl())
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	defer hsub.Unsubscribe()
+	if m, err := hsub.NextMsg(time.Second); err != nil || string(m.Data) != "order 1" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	select {
+	case err := <-errCh:
+		if err != ErrMsgNotSigned {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Error not reported")
+	}
+	if m, err := hsub.NextMsg(time.Second); err != nil || string(m.Data) != "order 3" {
+		t.Fatalf("Unexpected message: %+v, %v", m, err)
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	default:
+	}
+
+	// KeyValue
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "CONFIG"})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	if _, err := kv.Put("name", []byte("value")); err != nil {
+		t.Fatalf("Error on put: %v", err)
+	}
+	if e, err := kv.Get("name"); err != nil || string(e.Value()) != "value" {
+		t.Fatalf("Unexpected entry: %+v, %v", e, err)
+	}
+	rkv, err := rjs.KeyValue("CONFIG")
+	if err != nil {
+		t.Fatalf("Error getting bucket: %v", err)
+	}
+	if _, err := rkv.Put("name", []byte("forged")); err != nil {
+		t.Fatalf("Error on put: %v", err)
+	}
+	if _, err := kv.Get("name"); err != ErrMsgNotSigned {
+		t.Fatalf("Expected %v, got %v", ErrMsgNotSigned, err)
+	}
+}
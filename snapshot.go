@@ -0,0 +1,426 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// A snapshot is a sequence of JSON documents, one per line. The first one
+// describes the bucket:
+//
+//	{"version":1,"kind":"kv","kv":{...},"messages":2,"last_seq":7,"created":"..."}
+//
+// where kind is "kv" or "object" and the "kv" or "object" field holds the
+// KeyValueConfig or ObjectStoreConfig of the bucket. Messages is the number
+// of messages in the bucket when the snapshot was taken, and last_seq the
+// last sequence of its stream. Every message of the stream up to last_seq
+// follows, in order, including history and delete markers:
+//
+//	{"subject":"foo","seq":3,"time":"...","hdr":{"KV-Operation":["DEL"]},"data":"..."}
+//
+// where subject is relative to the bucket, "$KV.<bucket>." or
+// "$O.<bucket>.", and data is base64 encoded. The values of mirrors are
+// relative to the bucket they mirror, so that they are restored as values
+// of a regular bucket.
+const (
+	snapshotVersion    = 1
+	snapshotKindKV     = "kv"
+	snapshotKindObject = "object"
+)
+
+var (
+	ErrBadSnapshot    = errors.New("nats: invalid snapshot")
+	ErrBucketNotEmpty = errors.New("nats: bucket is not empty")
+)
+
+type bucketSnapshot struct {
+	Version  int                `json:"version"`
+	Kind     string             `json:"kind"`
+	KeyValue *KeyValueConfig    `json:"kv,omitempty"`
+	Object   *ObjectStoreConfig `json:"object,omitempty"`
+	Messages uint64             `json:"messages"`
+	LastSeq  uint64             `json:"last_seq"`
+	Created  time.Time          `json:"created"`
+}
+
+type snapshotMsg struct {
+	Subject string    `json:"subject"`
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Header  Header    `json:"hdr,omitempty"`
+	Data    []byte    `json:"data,omitempty"`
+}
+
+// RestoreOpt configures RestoreKeyValue and RestoreObjectStore.
+type RestoreOpt interface {
+	configureRestore(opts *restoreOpts) error
+}
+
+type restoreOpts struct {
+	ctx      context.Context
+	progress func(restored, total uint64)
+}
+
+type restoreOptFn func(opts *restoreOpts) error
+
+func (opt restoreOptFn) configureRestore(opts *restoreOpts) error {
+	return opt(opts)
+}
+
+// For nats.Context() support.
+func (ctx ContextOpt) configureRestore(opts *restoreOpts) error {
+	opts.ctx = ctx
+	return nil
+}
+
+// RestoreProgress sets a callback invoked after each message restored,
+// with the number of messages restored so far and the number of messages
+// of the snapshot.
+func RestoreProgress(cb func(restored, total uint64)) RestoreOpt {
+	return restoreOptFn(func(opts *restoreOpts) error {
+		opts.progress = cb
+		return nil
+	})
+}
+
+// Snapshot writes a point-in-time export of the bucket to w, with all the
+// values of the keys kept in history. Values written while the snapshot
+// is taken are not included. Values encrypted with the Encryption option
+// are written in plaintext, decrypted with the keys of the connection,
+// and encrypted again when restored by a connection with the option.
+func (kv *kvs) Snapshot(w io.Writer) error {
+	si, err := kv.js.StreamInfo(kv.stream)
+	if err != nil {
+		return err
+	}
+	cfg := &KeyValueConfig{
+		Bucket:       kv.name,
+		Description:  si.Config.Description,
+		MaxValueSize: si.Config.MaxMsgSize,
+		History:      uint8(si.Config.MaxMsgsPerSubject),
+		TTL:          si.Config.MaxAge,
+		MaxBytes:     si.Config.MaxBytes,
+		Storage:      si.Config.Storage,
+		Replicas:     si.Config.Replicas,
+		Placement:    si.Config.Placement,
+	}
+	if cfg.MaxValueSize < 0 {
+		cfg.MaxValueSize = 0
+	}
+	if cfg.MaxBytes < 0 {
+		cfg.MaxBytes = 0
+	}
+	return kv.js.snapshotStream(w, &bucketSnapshot{Kind: snapshotKindKV, KeyValue: cfg}, si, kv.pre+AllKeys)
+}
+
+// Snapshot writes a point-in-time export of the object store to w.
+// Objects put while the snapshot is taken are not included. As for
+// buckets, encrypted objects are written in plaintext.
+func (obs *obs) Snapshot(w io.Writer) error {
+	si, err := obs.js.StreamInfo(obs.stream)
+	if err != nil {
+		return err
+	}
+	cfg := &ObjectStoreConfig{
+		Bucket:      obs.name,
+		Description: si.Config.Description,
+		TTL:         si.Config.MaxAge,
+		Storage:     si.Config.Storage,
+		Replicas:    si.Config.Replicas,
+		Placement:   si.Config.Placement,
+	}
+	filter := fmt.Sprintf("$O.%s.%s", obs.name, AllKeys)
+	return obs.js.snapshotStream(w, &bucketSnapshot{Kind: snapshotKindObject, Object: cfg}, si, filter)
+}
+
+// snapshotStream writes the snapshot header, then the messages of the
+// stream matching filter up to its last sequence in si with an ordered
+// consumer.
+func (js *js) snapshotStream(w io.Writer, snap *bucketSnapshot, si *StreamInfo, filter string) error {
+	snap.Version = snapshotVersion
+	snap.Messages = si.State.Msgs
+	snap.LastSeq = si.State.LastSeq
+	snap.Created = time.Now().UTC()
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(snap); err != nil {
+		return err
+	}
+	if snap.Messages == 0 {
+		return nil
+	}
+
+	sub, err := js.SubscribeSync(filter, OrderedConsumer(), DeliverAll(), BindStream(si.Config.Name))
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+	// The messages may all have been removed since the stream info was
+	// taken, leaving nothing to deliver.
+	if ci, err := sub.ConsumerInfo(); err == nil && ci.NumPending == 0 && ci.Delivered.Consumer == 0 {
+		return nil
+	}
+	for {
+		m, err := sub.NextMsg(js.opts.wait)
+		if err == ErrTimeout {
+			if ci, cerr := sub.ConsumerInfo(); cerr == nil && ci.NumPending == 0 {
+				return nil
+			}
+		}
+		if err != nil {
+			return err
+		}
+		meta, err := m.Metadata()
+		if err != nil {
+			return err
+		}
+		// The messages at the end of the stream may have been removed
+		// and others added since the stream info was taken.
+		if meta.Sequence.Stream > snap.LastSeq {
+			return nil
+		}
+		// Strip the "$KV.<bucket>." or "$O.<bucket>." prefix.
+		tokens := strings.SplitN(m.Subject, ".", 3)
+		if len(tokens) < 3 {
+			continue
+		}
+		hdr := m.Header
+		// Payloads decrypted by the connection are written as such.
+		if js.nc.Opts.Encryption != nil && len(m.Data) > 0 && hdr.Get(EncryptionHdr) != _EMPTY_ {
+			hdr = stripHeaders(hdr, encryptionHdrs...)
+		}
+		sm := &snapshotMsg{
+			Subject: tokens[2],
+			Seq:     meta.Sequence.Stream,
+			Time:    meta.Timestamp.UTC(),
+			Header:  hdr,
+			Data:    m.Data,
+		}
+		if err := enc.Encode(sm); err != nil {
+			return err
+		}
+		if meta.Sequence.Stream == snap.LastSeq || meta.NumPending == 0 {
+			return nil
+		}
+	}
+}
+
+// encryptionHdrs are the headers of encrypted messages.
+var encryptionHdrs = []string{EncryptionHdr, EncryptionKeyHdr, EncryptionKeyVersionHdr, EncryptionDataKeyHdr, EncryptionSenderHdr}
+
+// stripHeaders returns a copy of hdr without the given headers.
+func stripHeaders(hdr Header, names ...string) Header {
+	h := make(Header, len(hdr))
+	for k, v := range hdr {
+		h[k] = v
+	}
+	for _, name := range names {
+		delete(h, name)
+	}
+	return h
+}
+
+// RestoreKeyValue creates the bucket of a snapshot written by
+// KeyValue.Snapshot and writes its values. The bucket must not exist or
+// be empty. The values get new revisions and creation times. The values
+// with a TTL keep their expiry time, those expired in the meantime being
+// restored expired, and the expiry index and the intent records of the
+// transactions in progress refer to the new revisions.
+func (js *js) RestoreKeyValue(r io.Reader, opts ...RestoreOpt) (KeyValue, error) {
+	dec := json.NewDecoder(r)
+	snap, err := readSnapshotHeader(dec, snapshotKindKV)
+	if err != nil {
+		return nil, err
+	}
+	kv, err := js.CreateKeyValue(snap.KeyValue)
+	if err != nil {
+		return nil, err
+	}
+	kvs := kv.(*kvs)
+	if err := js.restoreStream(dec, snap, kvs.stream, kvs.putSubject, newKVRestorer().restore, opts); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+// kvRestorer updates the messages of a KeyValue snapshot that depend on
+// the revisions and times of the original bucket.
+type kvRestorer struct {
+	// revs are the new revisions of the values restored, ttls their
+	// remaining TTL, by original revision.
+	revs map[uint64]uint64
+	ttls map[uint64]time.Duration
+}
+
+func newKVRestorer() *kvRestorer {
+	return &kvRestorer{revs: make(map[uint64]uint64), ttls: make(map[uint64]time.Duration)}
+}
+
+// restore updates the message before it is restored and returns a func
+// to record its new revision.
+func (r *kvRestorer) restore(sm *snapshotMsg) (func(uint64), error) {
+	switch {
+	case strings.HasPrefix(sm.Subject, kvExpPrefix) && len(sm.Data) > 0:
+		var exp kvExpiry
+		if err := json.Unmarshal(sm.Data, &exp); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+		}
+		// Stale entries are removed by ReapExpired.
+		exp.Revision, exp.TTL = r.revs[exp.Revision], r.ttls[exp.Revision]
+		data, err := json.Marshal(&exp)
+		if err != nil {
+			return nil, err
+		}
+		sm.Data = data
+
+	case strings.HasPrefix(sm.Subject, kvTxnPrefix) && len(sm.Data) > 0:
+		var intent kvTxnIntent
+		if err := json.Unmarshal(sm.Data, &intent); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+		}
+		for i := range intent.Ops {
+			intent.Ops[i].Revision = r.revs[intent.Ops[i].Revision]
+		}
+		data, err := json.Marshal(&intent)
+		if err != nil {
+			return nil, err
+		}
+		sm.Data = data
+
+	default:
+		if expires, ok := kvMsgExpires(sm.Header, sm.Time); ok {
+			// Values expired before being restored are past their TTL
+			// right away.
+			ttl := time.Until(expires)
+			if ttl <= 0 {
+				ttl = time.Nanosecond
+			}
+			sm.Header.Set(kvTTLHdr, ttl.String())
+			r.ttls[sm.Seq] = ttl
+		}
+	}
+	seq := sm.Seq
+	return func(rev uint64) { r.revs[seq] = rev }, nil
+}
+
+// RestoreObjectStore creates the object store of a snapshot written by
+// ObjectStore.Snapshot and writes its objects. The object store must not
+// exist or be empty.
+func (js *js) RestoreObjectStore(r io.Reader, opts ...RestoreOpt) (ObjectStore, error) {
+	dec := json.NewDecoder(r)
+	snap, err := readSnapshotHeader(dec, snapshotKindObject)
+	if err != nil {
+		return nil, err
+	}
+	obs, err := js.CreateObjectStore(snap.Object)
+	if err != nil {
+		return nil, err
+	}
+	pre := fmt.Sprintf("$O.%s.", snap.Object.Bucket)
+	subj := func(rel string) string { return pre + rel }
+	if err := js.restoreStream(dec, snap, fmt.Sprintf(objNameTmpl, snap.Object.Bucket), subj, nil, opts); err != nil {
+		return nil, err
+	}
+	return obs, nil
+}
+
+func readSnapshotHeader(dec *json.Decoder, kind string) (*bucketSnapshot, error) {
+	var snap bucketSnapshot
+	if err := dec.Decode(&snap); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+	}
+	if snap.Version != snapshotVersion || snap.Kind != kind {
+		return nil, fmt.Errorf("%w: unexpected %s snapshot version %d", ErrBadSnapshot, snap.Kind, snap.Version)
+	}
+	if (kind == snapshotKindKV && snap.KeyValue == nil) || (kind == snapshotKindObject && snap.Object == nil) {
+		return nil, fmt.Errorf("%w: missing configuration", ErrBadSnapshot)
+	}
+	return &snap, nil
+}
+
+// restoreStream publishes the messages of the snapshot to the subjects
+// returned by subj for their relative subject. If set, update is invoked
+// with every message before it is published, and the func it returns with
+// the new sequence of the message.
+func (js *js) restoreStream(dec *json.Decoder, snap *bucketSnapshot, stream string, subj func(string) string,
+	update func(*snapshotMsg) (func(uint64), error), opts []RestoreOpt) error {
+	var o restoreOpts
+	for _, opt := range opts {
+		if opt != nil {
+			if err := opt.configureRestore(&o); err != nil {
+				return err
+			}
+		}
+	}
+	si, err := js.StreamInfo(stream)
+	if err != nil {
+		return err
+	}
+	if si.State.Msgs > 0 {
+		return ErrBucketNotEmpty
+	}
+
+	var restored uint64
+	for {
+		var sm snapshotMsg
+		if err := dec.Decode(&sm); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("%w: %v", ErrBadSnapshot, err)
+		}
+		if sm.Subject == _EMPTY_ {
+			return fmt.Errorf("%w: missing subject", ErrBadSnapshot)
+		}
+		if o.ctx != nil {
+			if err := o.ctx.Err(); err != nil {
+				return err
+			}
+		}
+		// The expectations were met when the message was first stored,
+		// and the signature does not match the restored message, which is
+		// signed again with the MessageSigning option.
+		for k := range sm.Header {
+			switch {
+			case strings.HasPrefix(k, "Nats-Expected-"), k == MsgIdHdr,
+				k == SignerHdr, k == SignatureHdr, k == SignedHeadersHdr:
+				delete(sm.Header, k)
+			}
+		}
+		var done func(uint64)
+		if update != nil {
+			var err error
+			if done, err = update(&sm); err != nil {
+				return err
+			}
+		}
+		m := &Msg{Subject: subj(sm.Subject), Header: sm.Header, Data: sm.Data}
+		pa, err := js.PublishMsg(m)
+		if err != nil {
+			return err
+		}
+		if done != nil {
+			done(pa.Sequence)
+		}
+		restored++
+		if o.progress != nil {
+			o.progress(restored, snap.Messages)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nkeys"
+)
+
+func TestKeyValueSnapshot(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "SNAP", History: 5, Description: "backup"})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	kv.Put("a", []byte("1"))
+	kv.Put("a", []byte("2"))
+	kv.Put("b", []byte("1"))
+	kv.Delete("b")
+	rev, _ := kv.Put("c", []byte("1"))
+	kv.Update("c", []byte("2"), rev)
+
+	var buf bytes.Buffer
+	if err := kv.Snapshot(&buf); err != nil {
+		t.Fatalf("Error on snapshot: %v", err)
+	}
+	kv.Put("a", []byte("after"))
+
+	var snap bucketSnapshot
+	if err := json.NewDecoder(bytes.NewReader(buf.Bytes())).Decode(&snap); err != nil {
+		t.Fatalf("Error decoding snapshot header: %v", err)
+	}
+	if snap.Kind != snapshotKindKV || snap.Messages != 6 || snap.LastSeq != 6 || snap.KeyValue.History != 5 {
+		t.Fatalf("Unexpected snapshot header: %+v", snap)
+	}
+
+	if err := js.DeleteKeyValue("SNAP"); err != nil {
+		t.Fatalf("Error deleting bucket: %v", err)
+	}
+	var restored, total uint64
+	kv, err = js.RestoreKeyValue(bytes.NewReader(buf.Bytes()), RestoreProgress(func(n, of uint64) {
+		restored, total = n, of
+	}))
+	if err != nil {
+		t.Fatalf("Error on restore: %v", err)
+	}
+	if restored != 6 || total != 6 {
+		t.Fatalf("Unexpected progress: %v/%v", restored, total)
+	}
+	expectKV(t, kv, map[string]string{"a": "2", "b": "", "c": "2"})
+	history, err := kv.History("a")
+	if err != nil || len(history) != 2 || string(history[0].Value()) != "1" {
+		t.Fatalf("Unexpected history: %v, %v", history, err)
+	}
+	if e, err := kv.History("b"); err != nil || len(e) != 2 || e[1].Operation() != KeyValueDelete {
+		t.Fatalf("Unexpected history: %v, %v", e, err)
+	}
+	if status, err := kv.Status(); err != nil || status.History() != 5 {
+		t.Fatalf("Unexpected status: %v, %v", status, err)
+	}
+
+	if _, err := js.RestoreKeyValue(bytes.NewReader(buf.Bytes())); err != ErrBucketNotEmpty {
+		t.Fatalf("Expected %v, got %v", ErrBucketNotEmpty, err)
+	}
+	if _, err := js.RestoreKeyValue(strings.NewReader("junk")); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("Expected %v, got %v", ErrBadSnapshot, err)
+	}
+	if _, err := js.RestoreObjectStore(bytes.NewReader(buf.Bytes())); !errors.Is(err, ErrBadSnapshot) {
+		t.Fatalf("Expected %v, got %v", ErrBadSnapshot, err)
+	}
+
+	// Empty buckets.
+	empty, _ := js.CreateKeyValue(&KeyValueConfig{Bucket: "EMPTY"})
+	buf.Reset()
+	if err := empty.Snapshot(&buf); err != nil {
+		t.Fatalf("Error on snapshot: %v", err)
+	}
+	js.DeleteKeyValue("EMPTY")
+	if _, err := js.RestoreKeyValue(&buf); err != nil {
+		t.Fatalf("Error on restore: %v", err)
+	}
+
+	// Buckets emptied since the stream info was taken.
+	gone, _ := js.CreateKeyValue(&KeyValueConfig{Bucket: "GONE"})
+	gone.Put("a", []byte("1"))
+	si, err := js.StreamInfo("KV_GONE")
+	if err != nil {
+		t.Fatalf("Error getting stream info: %v", err)
+	}
+	js.PurgeStream("KV_GONE")
+	buf.Reset()
+	start := time.Now()
+	if err := gone.(*kvs).js.snapshotStream(&buf, &bucketSnapshot{Kind: snapshotKindKV}, si, "$KV.GONE.>"); err != nil {
+		t.Fatalf("Error on snapshot: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Snapshot took too long: %v", time.Since(start))
+	}
+}
+
+func TestKeyValueSnapshotReservedKeys(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "SNAP", History: 5})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	// Removed values make the restored revisions differ.
+	kv.Put("x", []byte("1"))
+	kv.Put("x", []byte("2"))
+	kv.Purge("x")
+	kv.Put("a", []byte("1"))
+	crashTxn(t, kv.Txn().Put("a", []byte("2")), "op0")
+	kv.PutWithTTL("short", []byte("1"), 500*time.Millisecond)
+	kv.PutWithTTL("long", []byte("1"), time.Minute)
+
+	var buf bytes.Buffer
+	if err := kv.Snapshot(&buf); err != nil {
+		t.Fatalf("Error on snapshot: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if err := js.DeleteKeyValue("SNAP"); err != nil {
+		t.Fatalf("Error deleting bucket: %v", err)
+	}
+	if kv, err = js.RestoreKeyValue(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Error on restore: %v", err)
+	}
+
+	// The uncommitted transaction resolves to the restored revision.
+	e, err := kv.Get("a")
+	if err != nil {
+		t.Fatalf("Error getting key: %v", err)
+	}
+	history, _ := kv.History("a")
+	if string(e.Value()) != "1" || len(history) != 1 || e.Revision() != history[0].Revision() {
+		t.Fatalf("Unexpected entry: %+v, history: %+v", e, history)
+	}
+
+	// The expiry index refers to the restored values, which keep their
+	// expiry time.
+	long, _ := kv.Get("long")
+	ix, _ := kv.Watch(kvExpPrefix + "long")
+	ie := <-ix.Updates()
+	ix.Stop()
+	var exp kvExpiry
+	if ie == nil || json.Unmarshal(ie.Value(), &exp) != nil || exp.Revision != long.Revision() || exp.TTL > time.Minute {
+		t.Fatalf("Unexpected index entry: %+v", ie)
+	}
+	time.Sleep(250 * time.Millisecond)
+	expectKV(t, kv, map[string]string{"short": "", "long": "1"})
+	if n, err := kv.ReapExpired(); err != nil || n != 1 {
+		t.Fatalf("Unexpected reap: %v, %v", n, err)
+	}
+}
+
+func TestKeyValueSnapshotEncryptedAndSigned(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	kp, _ := nkeys.CreateUser()
+	pub, _ := kp.PublicKey()
+	kr, _ := NewKeyRing(testAESKey("data", 1))
+	errCh := make(chan error, 10)
+	nc, js := jsClient(t, s, MessageSigning(kp), Encryption(kr), VerifySignatures([]string{pub}, nil),
+		ErrorHandler(func(_ *Conn, _ *Subscription, err error) { errCh <- err }))
+	defer nc.Close()
+	raw, rjs := jsClient(t, s)
+	defer raw.Close()
+
+	kv, err := js.CreateKeyValue(&KeyValueConfig{Bucket: "SECRET"})
+	if err != nil {
+		t.Fatalf("Error creating bucket: %v", err)
+	}
+	kv.Put("a", []byte("secret"))
+	kv.PutWithTTL("t", []byte("secret"), time.Minute)
+
+	// Written in plaintext.
+	var buf bytes.Buffer
+	if err := kv.Snapshot(&buf); err != nil {
+		t.Fatalf("Error on snapshot: %v", err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("c2VjcmV0")) || bytes.Contains(buf.Bytes(), []byte(EncryptionHdr)) {
+		t.Fatalf("Unexpected snapshot: %s", buf.Bytes())
+	}
+
+	// Restored encrypted and signed again.
+	js.DeleteKeyValue("SECRET")
+	if kv, err = js.RestoreKeyValue(&buf); err != nil {
+		t.Fatalf("Error on restore: %v", err)
+	}
+	expectKV(t, kv, map[string]string{"a": "secret", "t": "secret"})
+	for seq := uint64(1); seq <= 3; seq++ {
+		rm, err := rjs.GetMsg("KV_SECRET", seq)
+		if err != nil {
+			t.Fatalf("Error getting message: %v", err)
+		}
+		if bytes.Contains(rm.Data, []byte("secret")) || rm.Header.Get(SignatureHdr) == _EMPTY_ {
+			t.Fatalf("Unexpected stored message: %+v", rm)
+		}
+	}
+	select {
+	case err := <-errCh:
+		t.Fatalf("Unexpected error: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestObjectStoreSnapshot(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	defer shutdownJSServerAndRemoveStorage(t, s)
+
+	nc, js := jsClient(t, s)
+	defer nc.Close()
+
+	obs, err := js.CreateObjectStore(&ObjectStoreConfig{Bucket: "FILES"})
+	if err != nil {
+		t.Fatalf("Error creating object store: %v", err)
+	}
+	blob := make([]byte, 300*1024)
+	rand.Read(blob)
+	if _, err := obs.PutBytes("blob", blob); err != nil {
+		t.Fatalf("Error on put: %v", err)
+	}
+	obs.PutString("small", "hello")
+	obs.PutString("gone", "bye")
+	obs.Delete("gone")
+
+	var buf bytes.Buffer
+	if err := obs.Snapshot(&buf); err != nil {
+		t.Fatalf("Error on snapshot: %v", err)
+	}
+	if err := js.DeleteObjectStore("FILES"); err != nil {
+		t.Fatalf("Error deleting object store: %v", err)
+	}
+	obs, err = js.RestoreObjectStore(&buf)
+	if err != nil {
+		t.Fatalf("Error on restore: %v", err)
+	}
+	if data, err := obs.GetBytes("blob"); err != nil || !bytes.Equal(data, blob) {
+		t.Fatalf("Unexpected object: %d bytes, %v", len(data), err)
+	}
+	if data, err := obs.GetString("small"); err != nil || data != "hello" {
+		t.Fatalf("Unexpected object: %q, %v", data, err)
+	}
+	if info, err := obs.GetInfo("gone"); err != nil || !info.Deleted {
+		t.Fatalf("Unexpected info: %+v, %v", info, err)
+	}
+}
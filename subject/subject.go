@@ -0,0 +1,222 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package subject provides validation, matching and building of NATS
+// subjects, following the rules applied by the NATS server.
+package subject
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// Separator between the tokens of a subject.
+	Separator = "."
+	// PartialWildcard matches exactly one token.
+	PartialWildcard = "*"
+	// FullWildcard matches one or more tokens, and must be the last token.
+	FullWildcard = ">"
+
+	sep  = '.'
+	pwc  = '*'
+	fwc  = '>'
+	esc  = '%'
+	hexd = "0123456789ABCDEF"
+)
+
+// Errors
+var (
+	ErrEmpty               = errors.New("nats: subject is empty")
+	ErrWhitespace          = errors.New("nats: subject contains whitespace")
+	ErrEmptyToken          = errors.New("nats: subject contains an empty token")
+	ErrWildcard            = errors.New("nats: wildcards not allowed in a publish subject")
+	ErrFullWildcardNotLast = errors.New("nats: full wildcard must be the last token")
+	ErrInvalidName         = errors.New("nats: name can not contain '.', '*', '>' or whitespace")
+)
+
+// Mode selects the rules used by Validate.
+type Mode int
+
+const (
+	// Publish is for subjects messages are published to. Wildcards are not allowed.
+	Publish Mode = iota
+	// Subscribe is for subjects of subscriptions and filters. Wildcards are
+	// allowed, and '>' only as the last token.
+	Subscribe
+	// StreamName is for JetStream stream names, which are a single token
+	// without wildcards.
+	StreamName
+	// ConsumerName is for JetStream consumer (durable) names, which follow
+	// the same rules as stream names.
+	ConsumerName
+)
+
+// Validate checks that s is valid for the given mode.
+func Validate(s string, mode Mode) error {
+	if s == "" {
+		return ErrEmpty
+	}
+	if strings.ContainsAny(s, " \t\r\n\f") {
+		return ErrWhitespace
+	}
+	switch mode {
+	case StreamName, ConsumerName:
+		if strings.ContainsAny(s, ".*>") {
+			return ErrInvalidName
+		}
+		return nil
+	}
+	start := 0
+	for i := 0; i <= len(s); i++ {
+		if i < len(s) && s[i] != sep {
+			continue
+		}
+		tok := s[start:i]
+		if tok == "" {
+			return ErrEmptyToken
+		}
+		// Wildcards are whole tokens, "foo*bar" is a literal token.
+		if tok == PartialWildcard || tok == FullWildcard {
+			if mode == Publish {
+				return ErrWildcard
+			}
+			if tok[0] == fwc && i != len(s) {
+				return ErrFullWildcardNotLast
+			}
+		}
+		start = i + 1
+	}
+	return nil
+}
+
+// IsValidPublish returns true if s can be published to.
+func IsValidPublish(s string) bool {
+	return Validate(s, Publish) == nil
+}
+
+// IsValidSubscribe returns true if s can be subscribed to.
+func IsValidSubscribe(s string) bool {
+	return Validate(s, Subscribe) == nil
+}
+
+// HasWildcards returns true if any token of s is a wildcard.
+func HasWildcards(s string) bool {
+	for _, t := range strings.Split(s, Separator) {
+		if t == PartialWildcard || t == FullWildcard {
+			return true
+		}
+	}
+	return false
+}
+
+// SubjectMatches returns true if all the subjects matched by subject are also
+// matched by filter. When subject is a literal subject, this is the
+// usual check of whether a message published on subject would be
+// received by a subscription on filter. As in the server, a wildcard
+// in subject is only matched by a wildcard in filter that covers it,
+// so "foo.>" matches "foo.*" but "foo.*" does not match "foo.>".
+func SubjectMatches(filter, subject string) bool {
+	ft := strings.Split(filter, Separator)
+	st := strings.Split(subject, Separator)
+	for i, f := range ft {
+		if i >= len(st) {
+			return false
+		}
+		if f == FullWildcard {
+			return true
+		}
+		s := st[i]
+		if s == FullWildcard {
+			return false
+		}
+		if f == PartialWildcard {
+			continue
+		}
+		if s != f {
+			return false
+		}
+	}
+	return len(ft) == len(st)
+}
+
+// EscapeToken returns a version of s that can be used as a single token,
+// percent-encoding the separator, wildcards, whitespace and the escape
+// character itself. The result of an empty string is empty, which is not
+// a valid token.
+func EscapeToken(s string) string {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if needsEscape(s[i]) {
+			n++
+		}
+	}
+	if n == 0 {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s) + 2*n)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if needsEscape(c) {
+			sb.WriteByte(esc)
+			sb.WriteByte(hexd[c>>4])
+			sb.WriteByte(hexd[c&0xF])
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// UnescapeToken reverses EscapeToken. Invalid escape sequences are
+// left as-is.
+func UnescapeToken(s string) string {
+	if strings.IndexByte(s, esc) < 0 {
+		return s
+	}
+	var sb strings.Builder
+	sb.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == esc && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			sb.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+			continue
+		}
+		sb.WriteByte(s[i])
+	}
+	return sb.String()
+}
+
+func needsEscape(c byte) bool {
+	switch c {
+	case sep, pwc, fwc, esc, ' ', '\t', '\r', '\n', '\f':
+		return true
+	}
+	return false
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('A' <= c && c <= 'F') || ('a' <= c && c <= 'f')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subject
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	for _, test := range []struct {
+		s    string
+		mode Mode
+		err  error
+	}{
+		{"foo.bar", Publish, nil},
+		{"", Publish, ErrEmpty},
+		{"foo bar", Publish, ErrWhitespace},
+		{"foo..bar", Publish, ErrEmptyToken},
+		{".foo", Publish, ErrEmptyToken},
+		{"foo.", Publish, ErrEmptyToken},
+		{"foo.*", Publish, ErrWildcard},
+		{"foo.>", Publish, ErrWildcard},
+		{"foo.*.bar.>", Subscribe, nil},
+		{"foo.>.bar", Subscribe, ErrFullWildcardNotLast},
+		{"foo.b*", Subscribe, nil},
+		{"foo*bar.a>b", Publish, nil},
+		{"foo*bar.>", Subscribe, nil},
+		{"a>b.bar", Subscribe, nil},
+		{"foo..*", Subscribe, ErrEmptyToken},
+		{"ORDERS", StreamName, nil},
+		{"ORDERS.eu", StreamName, ErrInvalidName},
+		{"dur*", ConsumerName, ErrInvalidName},
+		{"dur\t", ConsumerName, ErrWhitespace},
+	} {
+		t.Run(test.s, func(t *testing.T) {
+			if err := Validate(test.s, test.mode); err != test.err {
+				t.Fatalf("Expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestSubjectMatches(t *testing.T) {
+	for _, test := range []struct {
+		filter  string
+		subject string
+		match   bool
+	}{
+		{"foo.bar", "foo.bar", true},
+		{"foo.bar", "foo.baz", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo.bar.baz", false},
+		{"foo.*", "foo", false},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo", false},
+		{">", "foo", true},
+		{"*.bar.>", "foo.bar.baz", true},
+		{"foo.>", "foo.*", true},
+		{"foo.*", "foo.*", true},
+		{"foo.*", "foo.>", false},
+		{"foo.bar", "foo.*", false},
+	} {
+		if m := SubjectMatches(test.filter, test.subject); m != test.match {
+			t.Fatalf("Expected SubjectMatches(%q, %q) to be %v", test.filter, test.subject, test.match)
+		}
+	}
+}
+
+func TestEscapeToken(t *testing.T) {
+	for _, s := range []string{"plain", "a.b", "*", ">", "100%", "with space", "%2E", ""} {
+		e := EscapeToken(s)
+		if s != "" && Validate(e, StreamName) != nil {
+			t.Fatalf("Escaped %q is not a valid token: %q", s, e)
+		}
+		if u := UnescapeToken(e); u != s {
+			t.Fatalf("Expected %q after round trip, got %q", s, u)
+		}
+	}
+	if e := EscapeToken("a.b"); e != "a%2Eb" {
+		t.Fatalf("Unexpected escaped value %q", e)
+	}
+	if u := UnescapeToken("50%"); u != "50%" {
+		t.Fatalf("Unexpected unescaped value %q", u)
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	for _, p := range []string{"", "orders.{id}.{id}", "orders.{region", "orders.>.{id}", "orders..{id}"} {
+		if _, err := NewTemplate(p); err == nil {
+			t.Fatalf("Expected error for pattern %q", p)
+		}
+	}
+
+	tmpl := MustTemplate("orders.{region}.{id}")
+	if vars := tmpl.Vars(); !reflect.DeepEqual(vars, []string{"region", "id"}) {
+		t.Fatalf("Unexpected vars: %v", vars)
+	}
+	subj, err := tmpl.Subject(map[string]string{"region": "eu.west", "id": "42"})
+	if err != nil || subj != "orders.eu%2Ewest.42" {
+		t.Fatalf("Unexpected subject %q, err: %v", subj, err)
+	}
+	if _, err := tmpl.Subject(map[string]string{"region": "eu"}); err == nil {
+		t.Fatal("Expected error for missing value")
+	}
+	if subj, err := tmpl.Values("us", "1"); err != nil || subj != "orders.us.1" {
+		t.Fatalf("Unexpected subject %q, err: %v", subj, err)
+	}
+	if _, err := tmpl.Values("us"); err == nil {
+		t.Fatal("Expected error for wrong number of values")
+	}
+	if f := tmpl.Filter(map[string]string{"region": "eu"}); f != "orders.eu.*" {
+		t.Fatalf("Unexpected filter %q", f)
+	}
+	values, ok := tmpl.Extract("orders.eu%2Ewest.42")
+	if !ok || !reflect.DeepEqual(values, map[string]string{"region": "eu.west", "id": "42"}) {
+		t.Fatalf("Unexpected values: %v", values)
+	}
+	if _, ok := tmpl.Extract("invoices.eu.42"); ok {
+		t.Fatal("Expected no match")
+	}
+	if _, ok := tmpl.Extract("orders.eu"); ok {
+		t.Fatal("Expected no match")
+	}
+}
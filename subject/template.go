@@ -0,0 +1,154 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package subject
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Template is a subject pattern where some tokens are named variables,
+// such as "orders.{region}.{id}". It can build the subjects to publish to,
+// the filters to subscribe with, and extract the variables from a subject.
+// A Template is safe for concurrent use.
+type Template struct {
+	pattern string
+	tokens  []string
+	// Index of the variable for each token, -1 for literal tokens.
+	vars  []int
+	names []string
+}
+
+// NewTemplate parses the given pattern. Variables are written as a whole
+// token between braces. Literal tokens must be valid subscribe tokens and
+// variable names must be unique.
+func NewTemplate(pattern string) (*Template, error) {
+	if pattern == "" {
+		return nil, ErrEmpty
+	}
+	t := &Template{pattern: pattern, tokens: strings.Split(pattern, Separator)}
+	t.vars = make([]int, len(t.tokens))
+	seen := make(map[string]bool)
+	for i, tok := range t.tokens {
+		if len(tok) > 2 && tok[0] == '{' && tok[len(tok)-1] == '}' {
+			name := tok[1 : len(tok)-1]
+			if seen[name] {
+				return nil, fmt.Errorf("nats: duplicate variable %q in subject template", name)
+			}
+			seen[name] = true
+			t.vars[i] = len(t.names)
+			t.names = append(t.names, name)
+			continue
+		}
+		if strings.ContainsAny(tok, "{}") {
+			return nil, fmt.Errorf("nats: invalid token %q in subject template", tok)
+		}
+		t.vars[i] = -1
+	}
+	// Validate the literal parts, with variables standing as partial wildcards.
+	if err := Validate(t.Filter(nil), Subscribe); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// MustTemplate is like NewTemplate but panics if the pattern is invalid.
+func MustTemplate(pattern string) *Template {
+	t, err := NewTemplate(pattern)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// String returns the pattern of the template.
+func (t *Template) String() string {
+	return t.pattern
+}
+
+// Vars returns the names of the variables, in order.
+func (t *Template) Vars() []string {
+	return append([]string(nil), t.names...)
+}
+
+// Subject returns the subject to publish to, for the given variable values.
+// All variables must have a non empty value, which is escaped with EscapeToken.
+func (t *Template) Subject(values map[string]string) (string, error) {
+	for _, name := range t.names {
+		if values[name] == "" {
+			return "", fmt.Errorf("nats: missing value for variable %q of subject template", name)
+		}
+	}
+	subj := t.build(values, "")
+	if err := Validate(subj, Publish); err != nil {
+		return "", err
+	}
+	return subj, nil
+}
+
+// Values returns the subject for the variable values given in order.
+func (t *Template) Values(values ...string) (string, error) {
+	if len(values) != len(t.names) {
+		return "", fmt.Errorf("nats: subject template expects %d values, got %d", len(t.names), len(values))
+	}
+	m := make(map[string]string, len(values))
+	for i, v := range values {
+		m[t.names[i]] = v
+	}
+	return t.Subject(m)
+}
+
+// Filter returns a subject to subscribe with, where the variables that
+// have no value in the map are replaced by a partial wildcard.
+func (t *Template) Filter(values map[string]string) string {
+	return t.build(values, PartialWildcard)
+}
+
+// Extract returns the unescaped variable values of the given subject, and
+// false if the subject does not match the template.
+func (t *Template) Extract(subject string) (map[string]string, bool) {
+	tokens := strings.Split(subject, Separator)
+	if len(tokens) != len(t.tokens) {
+		return nil, false
+	}
+	values := make(map[string]string, len(t.names))
+	for i, tok := range tokens {
+		if vi := t.vars[i]; vi >= 0 {
+			values[t.names[vi]] = UnescapeToken(tok)
+		} else if !SubjectMatches(t.tokens[i], tok) {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+func (t *Template) build(values map[string]string, missing string) string {
+	var sb strings.Builder
+	sb.Grow(len(t.pattern))
+	for i, tok := range t.tokens {
+		if i > 0 {
+			sb.WriteByte(sep)
+		}
+		if vi := t.vars[i]; vi >= 0 {
+			if v, ok := values[t.names[vi]]; ok && v != "" {
+				sb.WriteString(EscapeToken(v))
+			} else {
+				sb.WriteString(missing)
+			}
+			continue
+		}
+		sb.WriteString(tok)
+	}
+	return sb.String()
+}
@@ -0,0 +1,182 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// sublist is a trie of subscriptions keyed by the tokens of their subject,
+// used to find the subscriptions matching a published subject when the
+// LocalDelivery option is set. As for the server's, partial and full
+// wildcard tokens have their own branch at each level.
+//
+// It is not safe for concurrent use, the connection's subsMu must be held.
+type sublist struct {
+	root slNode
+}
+
+type slNode struct {
+	next map[string]*slNode
+	pwc  *slNode
+	fwc  *slNode
+	subs map[*Subscription]struct{}
+}
+
+func (n *slNode) isEmpty() bool {
+	return len(n.next) == 0 && n.pwc == nil && n.fwc == nil && len(n.subs) == 0
+}
+
+// insert adds the subscription under its subject.
+func (sl *sublist) insert(sub *Subscription) {
+	n := &sl.root
+	for _, t := range strings.Split(sub.Subject, ".") {
+		var c **slNode
+		switch t {
+		case "*":
+			c = &n.pwc
+		case ">":
+			c = &n.fwc
+		default:
+			if n.next == nil {
+				n.next = make(map[string]*slNode)
+			}
+			nn := n.next[t]
+			if nn == nil {
+				nn = &slNode{}
+				n.next[t] = nn
+			}
+			n = nn
+			continue
+		}
+		if *c == nil {
+			*c = &slNode{}
+		}
+		n = *c
+	}
+	if n.subs == nil {
+		n.subs = make(map[*Subscription]struct{})
+	}
+	n.subs[sub] = struct{}{}
+}
+
+// remove removes the subscription, pruning the nodes left empty.
+// It is a no-op if the subscription is not present.
+func (sl *sublist) remove(sub *Subscription) {
+	sl.root.remove(strings.Split(sub.Subject, "."), sub)
+}
+
+func (n *slNode) remove(tokens []string, sub *Subscription) {
+	if len(tokens) == 0 {
+		delete(n.subs, sub)
+		return
+	}
+	t := tokens[0]
+	switch t {
+	case "*":
+		if n.pwc != nil {
+			n.pwc.remove(tokens[1:], sub)
+			if n.pwc.isEmpty() {
+				n.pwc = nil
+			}
+		}
+	case ">":
+		if n.fwc != nil {
+			n.fwc.remove(tokens[1:], sub)
+			if n.fwc.isEmpty() {
+				n.fwc = nil
+			}
+		}
+	default:
+		if c := n.next[t]; c != nil {
+			c.remove(tokens[1:], sub)
+			if c.isEmpty() {
+				delete(n.next, t)
+			}
+		}
+	}
+}
+
+// match returns the subscriptions whose subject matches the given
+// literal subject.
+func (sl *sublist) match(subj string) []*Subscription {
+	var subs []*Subscription
+	sl.root.match(strings.Split(subj, "."), &subs)
+	return subs
+}
+
+func (n *slNode) match(tokens []string, subs *[]*Subscription) {
+	if len(tokens) == 0 {
+		for sub := range n.subs {
+			*subs = append(*subs, sub)
+		}
+		return
+	}
+	// Full wildcard matches one or more remaining tokens.
+	if n.fwc != nil {
+		for sub := range n.fwc.subs {
+			*subs = append(*subs, sub)
+		}
+	}
+	if n.pwc != nil {
+		n.pwc.match(tokens[1:], subs)
+	}
+	if c := n.next[tokens[0]]; c != nil {
+		c.match(tokens[1:], subs)
+	}
+}
+
+// deliverLocal delivers a message published by this connection to the
+// matching local subscriptions, when the LocalDelivery option is set.
+// Each subscription gets its own copy of the message. The permissions of
+// the user are not checked, see the LocalDelivery option.
+func (nc *Conn) deliverLocal(subj, reply string, hdr, data []byte) {
+	nc.subsMu.RLock()
+	if nc.lsubs == nil {
+		nc.subsMu.RUnlock()
+		return
+	}
+	subs := nc.lsubs.match(subj)
+	ics := nc.interceptors
+	nc.subsMu.RUnlock()
+
+	for _, sub := range subs {
+		var m *Msg
+		if nc.Opts.MsgPooling {
+			m = globalMsgPool.Get(data)
+		} else {
+			m = &Msg{Data: make([]byte, len(data))}
+			copy(m.Data, data)
+		}
+		if len(hdr) > 0 {
+			// Headers were encoded by us, so this can not fail.
+			m.Header, _ = decodeHeadersMsg(hdr)
+		}
+		m.Subject, m.Reply, m.Sub = subj, reply, sub
+
+		atomic.AddUint64(&nc.InMsgs, 1)
+		atomic.AddUint64(&nc.InBytes, uint64(len(hdr)+len(data)))
+		if len(ics) > 0 {
+			interceptInbound(ics, m)
+		}
+		if len(nc.Opts.TrustedSigners) > 0 && !nc.checkSignature(sub, m) {
+			continue
+		}
+		if nc.Opts.Encryption != nil && !nc.decryptMsg(sub, m) {
+			continue
+		}
+		nc.deliverMsg(sub, m)
+	}
+}
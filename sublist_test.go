@@ -0,0 +1,64 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"sort"
+	"testing"
+)
+
+func TestSublist(t *testing.T) {
+	var sl sublist
+
+	subjects := []string{"foo.bar", "foo.*", "foo.>", "*.bar", ">", "foo.bar.baz", "bar"}
+	subs := make(map[string]*Subscription)
+	for _, subj := range subjects {
+		sub := &Subscription{Subject: subj}
+		subs[subj] = sub
+		sl.insert(sub)
+	}
+
+	check := func(subj string, expected ...string) {
+		t.Helper()
+		var got []string
+		for _, sub := range sl.match(subj) {
+			got = append(got, sub.Subject)
+		}
+		sort.Strings(got)
+		sort.Strings(expected)
+		if len(got) != len(expected) {
+			t.Fatalf("Expected %q to match %v, got %v", subj, expected, got)
+		}
+		for i := range got {
+			if got[i] != expected[i] {
+				t.Fatalf("Expected %q to match %v, got %v", subj, expected, got)
+			}
+		}
+	}
+	check("foo.bar", "foo.bar", "foo.*", "foo.>", "*.bar", ">")
+	check("foo.bar.baz", "foo.>", ">", "foo.bar.baz")
+	check("foo", ">")
+	check("bar", ">", "bar")
+	check("baz.bar", "*.bar", ">")
+
+	for _, subj := range subjects {
+		sl.remove(subs[subj])
+	}
+	// Removing again is a no-op.
+	sl.remove(subs["foo.bar"])
+	check("foo.bar")
+	if !sl.root.isEmpty() {
+		t.Fatalf("Expected trie to be pruned, got %+v", sl.root)
+	}
+}
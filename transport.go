@@ -0,0 +1,223 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+)
+
+// Transport establishes the connections to the servers whose URLs use
+// one of its schemes. TCP ("nats" and "tls"), websocket ("ws" and "wss")
+// and Unix domain sockets ("nats+unix") are built in, other transports
+// are added with RegisterTransport.
+//
+// All the URLs of a connection must use the same transport. URLs
+// without a scheme, such as the ones discovered from the servers,
+// get the scheme of the transport.
+type Transport interface {
+	// Schemes returns the URL schemes of plain and secure connections.
+	// The secure scheme is empty if the transport does not support TLS.
+	Schemes() (plain, secure string)
+
+	// DefaultPort returns the port added to the URLs without one,
+	// or an empty string if no port is needed.
+	DefaultPort(secure bool) string
+
+	// Dial connects to tc.URL and sets tc.Conn. A transport that frames
+	// the NATS protocol also sets tc.Reader and tc.Writer, which are
+	// then used instead of tc.Conn. Dial returns once the server INFO
+	// can be read.
+	Dial(tc *TransportConn) error
+
+	// Upgrade is invoked after the server INFO has been received and
+	// before the CONNECT is sent, typically to start TLS with
+	// tc.StartTLS. The transport can replace tc.Conn.
+	Upgrade(tc *TransportConn) error
+}
+
+// TransportCloser can be implemented by the writer of a transport that
+// needs to send a last message when the connection is closed by the user.
+// PrepareClose is invoked with the connection lock held, and the writer
+// is flushed right after.
+type TransportCloser interface {
+	PrepareClose()
+}
+
+// TransportConn is the connection to a server made by a Transport.
+type TransportConn struct {
+	// URL of the server.
+	URL *url.URL
+	// Conn is the underlying connection.
+	Conn net.Conn
+	// Reader and Writer, if set, are used to read and write the
+	// NATS protocol instead of Conn.
+	Reader io.Reader
+	Writer io.Writer
+
+	nc *Conn
+}
+
+// Options returns a copy of the options of the connection.
+func (tc *TransportConn) Options() Options {
+	return tc.nc.Opts
+}
+
+// DialTCP connects to the host and port of tc.URL the way the built-in
+// TCP transport does, using the dialer and proxy options.
+func (tc *TransportConn) DialTCP() error {
+	conn, err := tc.nc.dialTCP(tc.URL)
+	if err != nil {
+		return err
+	}
+	tc.Conn = conn
+	return nil
+}
+
+// HandshakeTLS performs a client TLS handshake over tc.Conn, with the
+// TLS configuration of the connection, and replaces tc.Conn with the
+// TLS connection. tc.Reader and tc.Writer are reset since they refer to
+// the previous connection.
+func (tc *TransportConn) HandshakeTLS() error {
+	conn, err := tc.nc.makeTLSConn(tc.Conn)
+	if err != nil {
+		return err
+	}
+	tc.Conn, tc.Reader, tc.Writer = conn, nil, nil
+	return nil
+}
+
+// StartTLS performs the TLS handshake if the options or the server INFO
+// require it, or returns an error if the options require TLS but the
+// server does not support it. It can only be invoked from Upgrade.
+func (tc *TransportConn) StartTLS() error {
+	return tc.nc.checkForSecure()
+}
+
+// framed returns true if the transport frames the NATS protocol.
+func (tc *TransportConn) framed() bool {
+	return tc != nil && (tc.Reader != nil || tc.Writer != nil)
+}
+
+// tcpTransport is the built-in transport of the "nats" and "tls" schemes.
+// The TLS handshake is done after the server INFO.
+type tcpTransport struct{}
+
+func (tcpTransport) Schemes() (string, string) {
+	return "nats", tlsScheme
+}
+
+func (tcpTransport) DefaultPort(bool) string {
+	return defaultPortString
+}
+
+func (tcpTransport) Dial(tc *TransportConn) error {
+	return tc.DialTCP()
+}
+
+func (tcpTransport) Upgrade(tc *TransportConn) error {
+	return tc.StartTLS()
+}
+
+// wsTransport is the built-in transport of the "ws" and "wss" schemes.
+// The TLS handshake, if any, is done before the websocket handshake.
+type wsTransport struct{}
+
+func (wsTransport) Schemes() (string, string) {
+	return wsScheme, wsSchemeTLS
+}
+
+func (wsTransport) DefaultPort(secure bool) string {
+	if secure {
+		return defaultWSSPortString
+	}
+	return defaultWSPortString
+}
+
+func (wsTransport) Dial(tc *TransportConn) error {
+	if err := tc.DialTCP(); err != nil {
+		return err
+	}
+	return tc.nc.wsInitHandshake(tc)
+}
+
+func (wsTransport) Upgrade(*TransportConn) error {
+	return nil
+}
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]Transport{
+		"nats":      tcpTransport{},
+		tlsScheme:   tcpTransport{},
+		wsScheme:    wsTransport{},
+		wsSchemeTLS: wsTransport{},
+		unixScheme:  unixTransport{},
+	}
+)
+
+// RegisterTransport makes a transport available for the URLs using its
+// schemes. Registering a transport for a scheme that already has one
+// replaces it, except for the built-in schemes.
+func RegisterTransport(t Transport) error {
+	if t == nil {
+		return ErrInvalidArg
+	}
+	plain, secure := t.Schemes()
+	if plain == _EMPTY_ {
+		return ErrInvalidArg
+	}
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	for _, scheme := range []string{plain, secure} {
+		switch transports[scheme].(type) {
+		case tcpTransport, wsTransport, unixTransport:
+			return fmt.Errorf("nats: can not replace the transport of the %q scheme", scheme)
+		}
+	}
+	transports[plain] = t
+	if secure != _EMPTY_ {
+		transports[secure] = t
+	}
+	return nil
+}
+
+// transportForScheme returns the transport registered for the scheme.
+// The TCP transport is used for unknown schemes.
+func transportForScheme(scheme string) Transport {
+	transportsMu.RLock()
+	t, ok := transports[scheme]
+	transportsMu.RUnlock()
+	if !ok {
+		return tcpTransport{}
+	}
+	return t
+}
+
+// transportClose gives the transport a chance to send its last message
+// before the connection is closed by the user.
+func (nc *Conn) transportClose() {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.bw == nil {
+		return
+	}
+	if c, ok := nc.bw.w.(TransportCloser); ok {
+		c.PrepareClose()
+		nc.bw.flush()
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTransport dials the server over TCP and records the traffic it
+// frames, along with a last message sent on close.
+type testTransport struct {
+	scheme   string
+	mu       sync.Mutex
+	dials    int
+	upgrades int
+	out      bytes.Buffer
+}
+
+func (t *testTransport) Schemes() (string, string) {
+	return t.scheme, _EMPTY_
+}
+
+func (t *testTransport) DefaultPort(bool) string {
+	return defaultPortString
+}
+
+func (t *testTransport) Dial(tc *TransportConn) error {
+	t.mu.Lock()
+	t.dials++
+	t.mu.Unlock()
+	if err := tc.DialTCP(); err != nil {
+		return err
+	}
+	tc.Reader = tc.Conn
+	tc.Writer = &testTransportWriter{t: t, w: tc.Conn}
+	return nil
+}
+
+func (t *testTransport) Upgrade(tc *TransportConn) error {
+	t.mu.Lock()
+	t.upgrades++
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *testTransport) sent() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.out.String()
+}
+
+type testTransportWriter struct {
+	t *testTransport
+	w io.Writer
+}
+
+func (w *testTransportWriter) Write(p []byte) (int, error) {
+	w.t.mu.Lock()
+	w.t.out.Write(p)
+	w.t.mu.Unlock()
+	return w.w.Write(p)
+}
+
+func (w *testTransportWriter) PrepareClose() {
+	w.t.mu.Lock()
+	w.t.out.WriteString("BYE\r\n")
+	w.t.mu.Unlock()
+}
+
+func TestTransportRegistered(t *testing.T) {
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	tr := &testTransport{scheme: "test-transport"}
+	if err := RegisterTransport(tr); err != nil {
+		t.Fatalf("Error registering transport: %v", err)
+	}
+
+	rch := make(chan bool, 1)
+	nc, err := Connect("test-transport://"+s.Addr().String(),
+		ReconnectWait(50*time.Millisecond),
+		ReconnectHandler(func(_ *Conn) { rch <- true }))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	sub, err := nc.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	if err := nc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Error getting message: %v", err)
+	}
+	if out := tr.sent(); !strings.Contains(out, "CONNECT ") || !strings.Contains(out, "PUB foo 5") {
+		t.Fatalf("Traffic did not go through the transport: %q", out)
+	}
+
+	// Reconnects use the transport too.
+	nc.mu.Lock()
+	nc.conn.Close()
+	nc.mu.Unlock()
+	select {
+	case <-rch:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not reconnect")
+	}
+	tr.mu.Lock()
+	dials, upgrades := tr.dials, tr.upgrades
+	tr.mu.Unlock()
+	if dials != 2 || upgrades != 2 {
+		t.Fatalf("Expected 2 dials and upgrades, got %v and %v", dials, upgrades)
+	}
+
+	nc.Close()
+	if out := tr.sent(); !strings.HasSuffix(out, "BYE\r\n") {
+		t.Fatalf("Transport was not closed: %q", out)
+	}
+
+	// URLs without scheme get the scheme of the transport.
+	nc = &Conn{Opts: GetDefaultOptions()}
+	nc.Opts.Servers = []string{"test-transport://127.0.0.1:1234", "127.0.0.1:1235"}
+	if err := nc.setupServerPool(); err != nil {
+		t.Fatalf("Error setting up pool: %v", err)
+	}
+	for _, srv := range nc.srvPool {
+		if srv.url.Scheme != "test-transport" {
+			t.Fatalf("Unexpected URL: %v", srv.url)
+		}
+	}
+}
+
+func TestTransportRegisterErrors(t *testing.T) {
+	if err := RegisterTransport(nil); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+	for _, scheme := range []string{_EMPTY_, "nats", "tls", "ws", "wss"} {
+		if err := RegisterTransport(&testTransport{scheme: scheme}); err == nil {
+			t.Fatalf("Expected error registering scheme %q", scheme)
+		}
+	}
+	if _, ok := transportForScheme("tcp").(tcpTransport); !ok {
+		t.Fatal("Expected unknown schemes to use TCP")
+	}
+
+	if err := RegisterTransport(&testTransport{scheme: "test-mixing"}); err != nil {
+		t.Fatalf("Error registering transport: %v", err)
+	}
+	_, err := Connect("test-mixing://127.0.0.1:4222,nats://127.0.0.1:4223")
+	if err == nil || !strings.Contains(err.Error(), "mixing") {
+		t.Fatalf("Expected error about mixing, got %v", err)
+	}
+}
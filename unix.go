@@ -0,0 +1,100 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// unixScheme is the scheme of the URLs of Unix domain sockets, such as
+// "nats+unix:///var/run/nats.sock".
+const unixScheme = "nats+unix"
+
+// unixTransport is the built-in transport of the "nats+unix" scheme.
+// There is no server discovery since the servers advertise host and port
+// URLs, and proxies do not apply. TLS is still started if the options or
+// the server require it. Since there is no host name, the name of the
+// server certificate is not checked unless the TLS configuration sets
+// the expected ServerName, but its chain is still verified.
+type unixTransport struct{}
+
+func (unixTransport) Schemes() (string, string) {
+	return unixScheme, _EMPTY_
+}
+
+func (unixTransport) DefaultPort(bool) string {
+	return _EMPTY_
+}
+
+func (unixTransport) Dial(tc *TransportConn) error {
+	path := unixSocketPath(tc.URL)
+	if path == _EMPTY_ {
+		return fmt.Errorf("nats: missing socket path in URL %q", tc.URL.Redacted())
+	}
+	nc := tc.nc
+	dialer := nc.Opts.CustomDialer
+	if dialer == nil {
+		dialer = nc.Opts.Dialer
+	}
+	conn, err := dialer.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	tc.Conn = conn
+	return nil
+}
+
+func (unixTransport) Upgrade(tc *TransportConn) error {
+	return tc.StartTLS()
+}
+
+// unixSocketPath returns the path of the socket, which is the path of
+// the URL, or host and path for relative paths such as
+// "nats+unix://run/nats.sock".
+func unixSocketPath(u *url.URL) string {
+	return u.Host + u.Path
+}
+
+// verifyTLSChainOnly configures the TLS handshake to verify the chain of
+// the server certificate, but not its name.
+func verifyTLSChainOnly(cfg *tls.Config) {
+	verify := cfg.VerifyConnection
+	cfg.InsecureSkipVerify = true
+	cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("nats: no server certificate")
+		}
+		opts := x509.VerifyOptions{
+			Roots:         cfg.RootCAs,
+			Intermediates: x509.NewCertPool(),
+		}
+		if cfg.Time != nil {
+			opts.CurrentTime = cfg.Time()
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+			return err
+		}
+		if verify != nil {
+			return verify(cs)
+		}
+		return nil
+	}
+}
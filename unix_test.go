@@ -0,0 +1,268 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+)
+
+// testUnixForwarder listens on a Unix domain socket and forwards the
+// connections to a server, which can only listen on TCP.
+type testUnixForwarder struct {
+	l     net.Listener
+	path  string
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestUnixForwarder(t *testing.T, srv string) *testUnixForwarder {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "nats.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	f := &testUnixForwarder{l: l, path: path}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			sc, err := net.Dial("tcp", srv)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			f.mu.Lock()
+			f.conns = append(f.conns, c, sc)
+			f.mu.Unlock()
+			go func() {
+				io.Copy(sc, c)
+				sc.Close()
+			}()
+			go func() {
+				io.Copy(c, sc)
+				c.Close()
+			}()
+		}
+	}()
+	return f
+}
+
+func (f *testUnixForwarder) url() string {
+	return unixScheme + "://" + f.path
+}
+
+func (f *testUnixForwarder) dropConns() {
+	f.mu.Lock()
+	for _, c := range f.conns {
+		c.Close()
+	}
+	f.conns = nil
+	f.mu.Unlock()
+}
+
+func (f *testUnixForwarder) close() {
+	f.l.Close()
+	f.dropConns()
+}
+
+func TestUnixSocketConnect(t *testing.T) {
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	f := newTestUnixForwarder(t, s.Addr().String())
+	defer f.close()
+
+	rch := make(chan bool, 1)
+	nc, err := Connect(f.url(),
+		ReconnectWait(50*time.Millisecond),
+		ReconnectHandler(func(_ *Conn) { rch <- true }))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	if u := nc.ConnectedUrl(); u != f.url() {
+		t.Fatalf("Unexpected connected URL: %q", u)
+	}
+	if _, ok := nc.conn.(*net.UnixConn); !ok {
+		t.Fatalf("Expected a Unix domain socket, got %T", nc.conn)
+	}
+	sub, err := nc.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	if err := nc.Publish("foo", []byte("hello")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Error getting message: %v", err)
+	}
+
+	f.dropConns()
+	select {
+	case <-rch:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not reconnect")
+	}
+	if err := nc.Publish("foo", []byte("again")); err != nil {
+		t.Fatalf("Error on publish: %v", err)
+	}
+	if m, err := sub.NextMsg(time.Second); err != nil || string(m.Data) != "again" {
+		t.Fatalf("Error getting message after reconnect: %v %v", m, err)
+	}
+}
+
+func TestUnixSocketServerPool(t *testing.T) {
+	s := RunServerOnPort(-1)
+	defer s.Shutdown()
+
+	f := newTestUnixForwarder(t, s.Addr().String())
+	defer f.close()
+
+	// The first socket does not exist, the second is used.
+	missing := unixScheme + "://" + filepath.Join(t.TempDir(), "missing.sock")
+	nc, err := Connect(missing+", "+f.url(), DontRandomize())
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	if u := nc.ConnectedUrl(); u != f.url() {
+		t.Fatalf("Unexpected connected URL: %q", u)
+	}
+
+	// Host and port URLs sent by the server are not added to the pool.
+	nc.mu.Lock()
+	err = nc.processInfo(`{"connect_urls":["127.0.0.1:4222","127.0.0.1:4223"]}`)
+	pool := len(nc.srvPool)
+	nc.mu.Unlock()
+	if err != nil {
+		t.Fatalf("Error processing INFO: %v", err)
+	}
+	if pool != 2 {
+		t.Fatalf("Expected 2 servers in the pool, got %v", pool)
+	}
+	if servers := nc.DiscoveredServers(); len(servers) != 0 {
+		t.Fatalf("Unexpected discovered servers: %v", servers)
+	}
+
+	if _, err := Connect(unixScheme + "://" + f.path + ",nats://127.0.0.1:4222"); err == nil {
+		t.Fatal("Expected error mixing Unix domain sockets and TCP")
+	}
+	if _, err := Connect(unixScheme + "://"); err == nil {
+		t.Fatal("Expected error with missing socket path")
+	}
+}
+
+// newTestCert returns a certificate for localhost, signed by a new CA
+// returned as a pool.
+func newTestCert(t *testing.T) (tls.Certificate, *x509.CertPool) {
+	t.Helper()
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Error creating CA: %v", err)
+	}
+	caCert, _ := x509.ParseCertificate(caDER)
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, leaf, caCert, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(caCert)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func TestUnixSocketTLS(t *testing.T) {
+	cert, pool := newTestCert(t)
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	opts.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	opts.TLSTimeout = 2
+	s := RunServerWithOptions(&opts)
+	defer s.Shutdown()
+
+	f := newTestUnixForwarder(t, s.Addr().String())
+	defer f.close()
+
+	// The name is not checked, the chain is.
+	nc, err := Connect(f.url(), Secure(&tls.Config{RootCAs: pool}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	if !nc.TLSRequired() {
+		t.Fatal("Expected a TLS connection")
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+
+	_, other := newTestCert(t)
+	if _, err := Connect(f.url(), Secure(&tls.Config{RootCAs: other})); err == nil {
+		t.Fatal("Expected error with an unknown certificate authority")
+	}
+
+	// The name is checked when given.
+	if _, err := Connect(f.url(), Secure(&tls.Config{RootCAs: pool, ServerName: "other"})); err == nil {
+		t.Fatal("Expected error with a wrong server name")
+	}
+	nc2, err := Connect(f.url(), Secure(&tls.Config{RootCAs: pool, ServerName: "localhost"}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc2.Close()
+
+	// Custom verification still applies.
+	verr := errors.New("rejected")
+	if _, err := Connect(f.url(), Secure(&tls.Config{RootCAs: pool,
+		VerifyConnection: func(tls.ConnectionState) error { return verr }})); err == nil {
+		t.Fatal("Expected error from custom verification")
+	}
+}
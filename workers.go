@@ -0,0 +1,165 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"sync"
+)
+
+// DeliveryOrder is the ordering guarantee of a subscription whose
+// messages are processed by concurrent workers.
+type DeliveryOrder int
+
+const (
+	// UnorderedDelivery hands each message to the first available worker,
+	// so messages may be processed in any order.
+	UnorderedDelivery DeliveryOrder = iota
+
+	// PerSubjectOrderedDelivery preserves the order of messages that have
+	// the same subject. Messages are assigned to a worker based on their
+	// subject, so a single subject will not be processed concurrently.
+	PerSubjectOrderedDelivery
+)
+
+// ConcurrentSubscribe will express interest in the given subject, like
+// Subscribe, but the messages will be delivered to the MsgHandler by
+// `workers` concurrent Go routines. The `order` parameter controls
+// whether the ordering of messages with the same subject is preserved.
+//
+// Pending() accounts for the messages until the handler has returned,
+// Drain() waits for all handlers to complete and the limit set by
+// AutoUnsubscribe() applies to the messages handed to all workers.
+func (nc *Conn) ConcurrentSubscribe(subj string, workers int, order DeliveryOrder, cb MsgHandler) (*Subscription, error) {
+	return nc.subscribeConcurrent(subj, _EMPTY_, workers, order, cb)
+}
+
+// ConcurrentQueueSubscribe creates an asynchronous queue subscriber on the
+// given subject whose messages are delivered to `workers` concurrent
+// invocations of the MsgHandler. See ConcurrentSubscribe for details.
+func (nc *Conn) ConcurrentQueueSubscribe(subj, queue string, workers int, order DeliveryOrder, cb MsgHandler) (*Subscription, error) {
+	return nc.subscribeConcurrent(subj, queue, workers, order, cb)
+}
+
+func (nc *Conn) subscribeConcurrent(subj, queue string, workers int, order DeliveryOrder, cb MsgHandler) (*Subscription, error) {
+	if nc == nil {
+		return nil, ErrInvalidConnection
+	}
+	if workers < 1 || (order != UnorderedDelivery && order != PerSubjectOrderedDelivery) {
+		return nil, ErrInvalidArg
+	}
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	return nc.subscribeLockedWithWorkers(subj, queue, cb, nil, false, nil, workers, order)
+}
+
+// subWorkers dispatches the messages of an async subscription to
+// concurrent workers. It is owned by the subscription's waitForMsgs
+// Go routine.
+type subWorkers struct {
+	chs      []chan *Msg
+	wg       sync.WaitGroup
+	inflight sync.WaitGroup
+	// quit is closed when the subscription is closed, to stop handing
+	// out messages.
+	quit     chan struct{}
+	quitOnce sync.Once
+}
+
+// newSubWorkers starts the workers for the given subscription.
+// With UnorderedDelivery all workers share a single channel, otherwise
+// each worker has its own and messages are routed by subject.
+func newSubWorkers(s *Subscription, mcb MsgHandler, workers int, order DeliveryOrder) *subWorkers {
+	sw := &subWorkers{quit: make(chan struct{})}
+	if order == UnorderedDelivery {
+		sw.chs = []chan *Msg{make(chan *Msg)}
+	} else {
+		sw.chs = make([]chan *Msg, workers)
+		for i := range sw.chs {
+			sw.chs[i] = make(chan *Msg)
+		}
+	}
+	sw.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go sw.run(s, mcb, sw.chs[i%len(sw.chs)])
+	}
+	return sw
+}
+
+// run invokes the handler for each message received on the given channel
+// and then does the pending accounting, as waitForMsgs does for serial
+// delivery.
+func (sw *subWorkers) run(s *Subscription, mcb MsgHandler, ch chan *Msg) {
+	defer sw.wg.Done()
+	for m := range ch {
+		// Capture the size now since the handler may release the message.
+		msgLen := len(m.Data)
+		mcb(m)
+		s.mu.Lock()
+		s.pMsgs--
+		s.pBytes -= msgLen
+		s.mu.Unlock()
+		sw.inflight.Done()
+	}
+}
+
+// dispatch hands the message to a worker, blocking until one accepts it.
+// It returns false if the subscription was closed in the meantime, as
+// serial delivery does not deliver messages after that either.
+func (sw *subWorkers) dispatch(m *Msg) bool {
+	ch := sw.chs[0]
+	if len(sw.chs) > 1 {
+		ch = sw.chs[subjectHash(m.Subject)%uint32(len(sw.chs))]
+	}
+	select {
+	case <-sw.quit:
+		return false
+	default:
+	}
+	sw.inflight.Add(1)
+	select {
+	case ch <- m:
+		return true
+	case <-sw.quit:
+		sw.inflight.Done()
+		return false
+	}
+}
+
+// close stops handing out messages.
+func (sw *subWorkers) close() {
+	sw.quitOnce.Do(func() { close(sw.quit) })
+}
+
+// wait blocks until all dispatched messages have been processed.
+func (sw *subWorkers) wait() {
+	sw.inflight.Wait()
+}
+
+// stop waits for in-flight messages to be processed and the workers to exit.
+func (sw *subWorkers) stop() {
+	for _, ch := range sw.chs {
+		close(ch)
+	}
+	sw.wg.Wait()
+}
+
+// subjectHash is FNV-1a, inlined to avoid allocations.
+func subjectHash(subj string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(subj); i++ {
+		h ^= uint32(subj[i])
+		h *= 16777619
+	}
+	return h
+}
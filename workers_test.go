@@ -0,0 +1,343 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package nats
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, totalWait, sleepDur time.Duration, f func() error) {
+	t.Helper()
+	timeout := time.Now().Add(totalWait)
+	var err error
+	for time.Now().Before(timeout) {
+		err = f()
+		if err == nil {
+			return
+		}
+		time.Sleep(sleepDur)
+	}
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func TestSubjectHash(t *testing.T) {
+	// FNV-1a reference values.
+	for subj, h := range map[string]uint32{
+		"":    2166136261,
+		"a":   0xe40c292c,
+		"foo": 0xa9f37ed7,
+	} {
+		if got := subjectHash(subj); got != h {
+			t.Fatalf("Expected hash of %q to be %x, got %x", subj, h, got)
+		}
+	}
+}
+
+func TestSubWorkers(t *testing.T) {
+	workers := 4
+	total := 100
+	subjects := []string{"foo.a", "foo.b", "foo.c", "foo.d", "foo.e", "foo.f"}
+
+	// Messages of a subject are always processed by the same worker, in
+	// order.
+	var mu sync.Mutex
+	worker := make(map[string]chan *Msg)
+	last := make(map[string]int)
+	var errs []string
+	s := &Subscription{pMsgs: total * len(subjects), pBytes: total * len(subjects)}
+	sw := newSubWorkers(s, func(m *Msg) {
+		var seq int
+		fmt.Sscanf(m.Reply, "%d", &seq)
+		mu.Lock()
+		if prev, ok := last[m.Subject]; ok && seq != prev+1 {
+			errs = append(errs, fmt.Sprintf("%q: %d after %d", m.Subject, seq, prev))
+		}
+		last[m.Subject] = seq
+		mu.Unlock()
+	}, workers, PerSubjectOrderedDelivery)
+	if len(sw.chs) != workers {
+		t.Fatalf("Expected %d channels, got %d", workers, len(sw.chs))
+	}
+	for i := 0; i < total; i++ {
+		for _, subj := range subjects {
+			ch := sw.chs[subjectHash(subj)%uint32(workers)]
+			if prev, ok := worker[subj]; ok && prev != ch {
+				t.Fatalf("Subject %q moved to another worker", subj)
+			}
+			worker[subj] = ch
+			sw.dispatch(&Msg{Subject: subj, Reply: fmt.Sprintf("%d", i), Data: []byte("x")})
+		}
+	}
+	sw.wait()
+	if s.pMsgs != 0 || s.pBytes != 0 {
+		t.Fatalf("Expected nothing pending, got %d msgs, %d bytes", s.pMsgs, s.pBytes)
+	}
+	if len(errs) > 0 {
+		t.Fatalf("Messages out of order: %v", errs)
+	}
+
+	// Stop waits for the workers to exit.
+	done := make(chan struct{})
+	go func() {
+		sw.stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Workers did not stop")
+	}
+
+	// Unordered delivery shares a single channel.
+	sw = newSubWorkers(&Subscription{}, func(_ *Msg) {}, workers, UnorderedDelivery)
+	if len(sw.chs) != 1 {
+		t.Fatalf("Expected a single channel, got %d", len(sw.chs))
+	}
+	sw.stop()
+}
+
+func TestConcurrentSubscribe(t *testing.T) {
+	s := RunServerOnPort(TEST_PORT)
+	defer s.Shutdown()
+
+	nc, err := Connect(fmt.Sprintf("127.0.0.1:%d", TEST_PORT))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	if _, err := nc.ConcurrentSubscribe("foo", 0, UnorderedDelivery, func(_ *Msg) {}); err != ErrInvalidArg {
+		t.Fatalf("Expected invalid argument error, got %v", err)
+	}
+	if _, err := nc.ConcurrentSubscribe("foo", 2, DeliveryOrder(5), func(_ *Msg) {}); err != ErrInvalidArg {
+		t.Fatalf("Expected invalid argument error, got %v", err)
+	}
+
+	workers := 4
+	var active, maxActive int32
+	block := make(chan bool)
+	sub, err := nc.ConcurrentSubscribe("foo", workers, UnorderedDelivery, func(_ *Msg) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		<-block
+		atomic.AddInt32(&active, -1)
+	})
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	defer sub.Unsubscribe()
+
+	total := 20
+	for i := 0; i < total; i++ {
+		nc.Publish("foo", []byte("hello"))
+	}
+	nc.Flush()
+
+	// All workers should be busy and messages they hold still pending.
+	waitFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := atomic.LoadInt32(&active); n != int32(workers) {
+			return fmt.Errorf("Expected %d active handlers, got %d", workers, n)
+		}
+		return nil
+	})
+	if m, _, _ := sub.Pending(); m != total {
+		t.Fatalf("Expected %d pending messages, got %d", total, m)
+	}
+
+	close(block)
+	waitFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if d, _ := sub.Delivered(); d != int64(total) {
+			return fmt.Errorf("Wrong delivered count: %v vs %v", d, total)
+		}
+		if m, b, _ := sub.Pending(); m != 0 || b != 0 {
+			return fmt.Errorf("Expected nothing pending, got %d msgs, %d bytes", m, b)
+		}
+		return nil
+	})
+	if n := atomic.LoadInt32(&maxActive); n != int32(workers) {
+		t.Fatalf("Expected at most %d concurrent handlers, got %d", workers, n)
+	}
+}
+
+func TestConcurrentSubscribePerSubjectOrder(t *testing.T) {
+	s := RunServerOnPort(TEST_PORT)
+	defer s.Shutdown()
+
+	nc, err := Connect(fmt.Sprintf("127.0.0.1:%d", TEST_PORT))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	subjects := 8
+	total := 100
+	var mu sync.Mutex
+	last := make(map[string]int)
+	errCh := make(chan error, 1)
+	done := make(chan bool)
+	received := int32(0)
+
+	if _, err := nc.ConcurrentSubscribe("foo.*", 4, PerSubjectOrderedDelivery, func(m *Msg) {
+		var seq int
+		fmt.Sscanf(string(m.Data), "%d", &seq)
+		mu.Lock()
+		if prev, ok := last[m.Subject]; ok && seq != prev+1 {
+			select {
+			case errCh <- fmt.Errorf("Out of order on %q: %d after %d", m.Subject, seq, prev):
+			default:
+			}
+		}
+		last[m.Subject] = seq
+		mu.Unlock()
+		if atomic.AddInt32(&received, 1) == int32(subjects*total) {
+			done <- true
+		}
+	}); err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+
+	for i := 0; i < total; i++ {
+		for j := 0; j < subjects; j++ {
+			nc.Publish(fmt.Sprintf("foo.%d", j), []byte(fmt.Sprintf("%d", i)))
+		}
+	}
+	nc.Flush()
+
+	if err := Wait(done); err != nil {
+		t.Fatalf("Did not receive all messages: %d", atomic.LoadInt32(&received))
+	}
+	select {
+	case err := <-errCh:
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestConcurrentSubscribeAutoUnsubAndDrain(t *testing.T) {
+	s := RunServerOnPort(TEST_PORT)
+	defer s.Shutdown()
+
+	nc, err := Connect(fmt.Sprintf("127.0.0.1:%d", TEST_PORT))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	received := int32(0)
+	max := 10
+	sub, err := nc.ConcurrentSubscribe("foo", 4, UnorderedDelivery, func(_ *Msg) {
+		atomic.AddInt32(&received, 1)
+	})
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	sub.AutoUnsubscribe(max)
+	for i := 0; i < 100; i++ {
+		nc.Publish("foo", []byte("hello"))
+	}
+	nc.Flush()
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&received); n != int32(max) {
+		t.Fatalf("Received %d msgs, wanted only %d", n, max)
+	}
+
+	// Drain must wait for all handlers to complete.
+	completed := int32(0)
+	sub, err = nc.ConcurrentQueueSubscribe("bar", "q", 4, UnorderedDelivery, func(_ *Msg) {
+		time.Sleep(10 * time.Millisecond)
+		atomic.AddInt32(&completed, 1)
+	})
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	total := 20
+	for i := 0; i < total; i++ {
+		nc.Publish("bar", []byte("hello"))
+	}
+	nc.Flush()
+	if err := sub.Drain(); err != nil {
+		t.Fatalf("Error on drain: %v", err)
+	}
+	waitFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if sub.IsValid() {
+			return fmt.Errorf("Subscription still valid")
+		}
+		return nil
+	})
+	if n := atomic.LoadInt32(&completed); n != int32(total) {
+		t.Fatalf("Expected %d completed handlers after drain, got %d", total, n)
+	}
+}
+
+func TestConcurrentSubscribeUnsubscribe(t *testing.T) {
+	s := RunServerOnPort(TEST_PORT)
+	defer s.Shutdown()
+
+	nc, err := Connect(fmt.Sprintf("127.0.0.1:%d", TEST_PORT))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	workers := 3
+	var started, completed int32
+	block := make(chan bool)
+	sub, err := nc.ConcurrentSubscribe("foo", workers, UnorderedDelivery, func(_ *Msg) {
+		atomic.AddInt32(&started, 1)
+		<-block
+		atomic.AddInt32(&completed, 1)
+	})
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		nc.Publish("foo", []byte("hello"))
+	}
+	nc.Flush()
+	waitFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := atomic.LoadInt32(&started); n != int32(workers) {
+			return fmt.Errorf("Expected %d started handlers, got %d", workers, n)
+		}
+		return nil
+	})
+
+	// The handlers in progress complete, no other message is delivered.
+	if err := sub.Unsubscribe(); err != nil {
+		t.Fatalf("Error on unsubscribe: %v", err)
+	}
+	close(block)
+	waitFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := atomic.LoadInt32(&completed); n != int32(workers) {
+			return fmt.Errorf("Expected %d completed handlers, got %d", workers, n)
+		}
+		return nil
+	})
+	nc.Publish("foo", []byte("hello"))
+	nc.Flush()
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&started); n != int32(workers) {
+		t.Fatalf("Expected no more handlers after unsubscribe, got %d", n)
+	}
+}
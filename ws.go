@@ -28,7 +28,9 @@ import (
 	mrand "math/rand"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 )
@@ -67,7 +69,10 @@ const (
 	wsPMCExtension      = "permessage-deflate" // per-message compression
 	wsPMCSrvNoCtx       = "server_no_context_takeover"
 	wsPMCCliNoCtx       = "client_no_context_takeover"
+	wsPMCSrvMaxWindow   = "server_max_window_bits"
 	wsPMCReqHeaderValue = wsPMCExtension + "; " + wsPMCSrvNoCtx + "; " + wsPMCCliNoCtx
+	wsPMCMinWindowBits  = 8
+	wsPMCMaxWindowBits  = 15
 )
 
 // From https://tools.ietf.org/html/rfc6455#section-1.3
@@ -75,6 +80,17 @@ var wsGUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
 
 var compressFinalBlock = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
 
+// compressSyncTail ends the output of a sync flush, it is removed from
+// compressed messages as per https://tools.ietf.org/html/rfc7692#section-7.2.1
+var compressSyncTail = compressFinalBlock[:4]
+
+// wsPMCParams are the permessage-deflate parameters accepted by the server.
+type wsPMCParams struct {
+	srvNoCtxTakeover bool
+	cliNoCtxTakeover bool
+	srvMaxWindowBits int
+}
+
 type websocketReader struct {
 	r       io.Reader
 	pending [][]byte
@@ -84,18 +100,27 @@ type websocketReader struct {
 	nl      bool
 	dc      *wsDecompressor
 	nc      *Conn
+	stats   *CompressionStats
 }
 
 type wsDecompressor struct {
 	flate io.ReadCloser
 	bufs  [][]byte
 	off   int
+	clen  int // size of the compressed buffers
+	// With context takeover, the size of the sliding window and the last
+	// decompressed bytes, used as the dictionary for the next message.
+	window int
+	dict   []byte
 }
 
 type websocketWriter struct {
 	w          io.Writer
 	compress   bool
+	noCtx      bool // compress each message with a new context
 	compressor *flate.Writer
+	cbuf       bytes.Buffer
+	stats      *CompressionStats
 	ctrlFrames [][]byte // pending frames that should be sent at the next Write()
 	cm         []byte   // close message that needs to be sent when everything else has been sent
 	cmDone     bool     // a close message has been added or sent (never going back to false)
@@ -154,6 +179,7 @@ func (d *wsDecompressor) ReadByte() (byte, error) {
 
 func (d *wsDecompressor) addBuf(b []byte) {
 	d.bufs = append(d.bufs, b)
+	d.clen += len(b)
 }
 
 func (d *wsDecompressor) decompress() ([]byte, error) {
@@ -164,16 +190,23 @@ func (d *wsDecompressor) decompress() ([]byte, error) {
 	d.bufs = append(d.bufs, compressFinalBlock)
 	// Create or reset the decompressor with his object (wsDecompressor)
 	// that provides Read() and ReadByte() APIs that will consume from
-	// the compressed buffers (d.bufs).
+	// the compressed buffers (d.bufs). With context takeover, the message
+	// may refer to the previous ones, which are given as dictionary.
 	if d.flate == nil {
-		d.flate = flate.NewReader(d)
+		d.flate = flate.NewReaderDict(d, d.dict)
 	} else {
-		d.flate.(flate.Resetter).Reset(d, nil)
+		d.flate.(flate.Resetter).Reset(d, d.dict)
 	}
 	// TODO: When Go 1.15 support is dropped, replace with io.ReadAll()
 	b, err := ioutil.ReadAll(d.flate)
 	// Now reset the compressed buffers list
-	d.bufs = nil
+	d.bufs, d.clen = nil, 0
+	if err == nil && d.window > 0 {
+		d.dict = append(d.dict, b...)
+		if n := len(d.dict) - d.window; n > 0 {
+			d.dict = append(d.dict[:0], d.dict[n:]...)
+		}
+	}
 	return b, err
 }
 
@@ -307,11 +340,16 @@ func (r *websocketReader) Read(p []byte) (int, error) {
 			r.addCBuf(b)
 			// Decompress only when this is the final frame.
 			if r.ff {
+				clen := r.dc.clen
 				b, err = r.dc.decompress()
 				if err != nil {
 					return 0, err
 				}
 				r.fc = false
+				if r.stats != nil {
+					atomic.AddUint64(&r.stats.InBytes, uint64(len(b)))
+					atomic.AddUint64(&r.stats.InCompressedBytes, uint64(clen))
+				}
 			}
 		}
 		// Add to the pending list if dealing with uncompressed frames or
@@ -444,16 +482,7 @@ func (w *websocketWriter) Write(p []byte) (int, error) {
 	// We will end with checking for need to send close message.
 	if len(p) > 0 {
 		if w.compress {
-			buf := &bytes.Buffer{}
-			if w.compressor == nil {
-				w.compressor, _ = flate.NewWriter(buf, flate.BestSpeed)
-			} else {
-				w.compressor.Reset(buf)
-			}
-			w.compressor.Write(p)
-			w.compressor.Close()
-			b := buf.Bytes()
-			p = b[:len(b)-4]
+			p = w.compressMsg(p)
 		}
 		fh, key := wsCreateFrameHeader(w.compress, wsBinaryMessage, len(p))
 		wsMaskBuf(key, p)
@@ -471,6 +500,27 @@ func (w *websocketWriter) Write(p []byte) (int, error) {
 	return total, err
 }
 
+// compressMsg returns the compressed payload of a message. Unless there is
+// no context takeover, the compressor is not reset so that the message can
+// refer to data of the previous ones. The returned buffer is only valid
+// until the next call.
+func (w *websocketWriter) compressMsg(p []byte) []byte {
+	w.cbuf.Reset()
+	if w.compressor == nil {
+		w.compressor, _ = flate.NewWriter(&w.cbuf, flate.BestSpeed)
+	} else if w.noCtx {
+		w.compressor.Reset(&w.cbuf)
+	}
+	w.compressor.Write(p)
+	w.compressor.Flush()
+	b := bytes.TrimSuffix(w.cbuf.Bytes(), compressSyncTail)
+	if w.stats != nil {
+		atomic.AddUint64(&w.stats.OutBytes, uint64(len(p)))
+		atomic.AddUint64(&w.stats.OutCompressedBytes, uint64(len(b)))
+	}
+	return b
+}
+
 func (w *websocketWriter) writeCtrlFrames() (int, error) {
 	var (
 		n     int
@@ -550,17 +600,17 @@ func wsFillFrameHeader(fh []byte, compressed bool, frameType wsOpCode, l int) (i
 	return n, key
 }
 
-func (nc *Conn) wsInitHandshake(u *url.URL) error {
+func (nc *Conn) wsInitHandshake(tc *TransportConn) error {
+	u := tc.URL
 	compress := nc.Opts.Compression
 	tlsRequired := u.Scheme == wsSchemeTLS || nc.Opts.Secure || nc.Opts.TLSConfig != nil
 	// Do TLS here as needed.
 	if tlsRequired {
-		if err := nc.makeTLSConn(); err != nil {
+		if err := tc.HandshakeTLS(); err != nil {
 			return err
 		}
-	} else {
-		nc.bindToNewConn()
 	}
+	conn := tc.Conn
 
 	var err error
 
@@ -569,11 +619,9 @@ func (nc *Conn) wsInitHandshake(u *url.URL) error {
 	if tlsRequired {
 		scheme = "https"
 	}
-	ustr := fmt.Sprintf("%s://%s", scheme, u.Host)
-	u, err = url.Parse(ustr)
-	if err != nil {
-		return err
-	}
+	// Keep the path and query, which may be needed to reach the server
+	// behind a proxy, but not the user info used for the CONNECT.
+	u = &url.URL{Scheme: scheme, Host: u.Host, Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery}
 	req := &http.Request{
 		Method:     "GET",
 		URL:        u,
@@ -583,6 +631,9 @@ func (nc *Conn) wsInitHandshake(u *url.URL) error {
 		Header:     make(http.Header),
 		Host:       u.Host,
 	}
+	if err := nc.wsAddUserHeaders(req); err != nil {
+		return err
+	}
 	wsKey, err := wsMakeChallengeKey()
 	if err != nil {
 		return err
@@ -593,16 +644,19 @@ func (nc *Conn) wsInitHandshake(u *url.URL) error {
 	req.Header["Sec-WebSocket-Key"] = []string{wsKey}
 	req.Header["Sec-WebSocket-Version"] = []string{"13"}
 	if compress {
-		req.Header.Add("Sec-WebSocket-Extensions", wsPMCReqHeaderValue)
+		req.Header.Add("Sec-WebSocket-Extensions", wsPMCOffer(&nc.Opts))
+	}
+	if protos := nc.Opts.WebSocketProtocols; len(protos) > 0 {
+		req.Header["Sec-WebSocket-Protocol"] = []string{strings.Join(protos, ", ")}
 	}
-	if err := req.Write(nc.conn); err != nil {
+	if err := req.Write(conn); err != nil {
 		return err
 	}
 
 	var resp *http.Response
 
-	br := bufio.NewReaderSize(nc.conn, 4096)
-	nc.conn.SetReadDeadline(time.Now().Add(nc.Opts.Timeout))
+	br := bufio.NewReaderSize(conn, 4096)
+	conn.SetReadDeadline(time.Now().Add(nc.Opts.Timeout))
 	resp, err = http.ReadResponse(br, req)
 	if err == nil &&
 		(resp.StatusCode != 101 ||
@@ -612,46 +666,124 @@ func (nc *Conn) wsInitHandshake(u *url.URL) error {
 
 		err = fmt.Errorf("invalid websocket connection")
 	}
+	var proto string
+	if err == nil {
+		proto, err = wsSelectedProtocol(resp.Header, nc.Opts.WebSocketProtocols)
+	}
 	// Check compression extension...
+	var pmc *wsPMCParams
 	if err == nil && compress {
-		// Check that not only permessage-deflate extension is present, but that
-		// we also have server and client no context take over.
-		srvCompress, noCtxTakeover := wsPMCExtensionSupport(resp.Header)
-
+		pmc, err = wsPMCNegotiate(resp.Header, &nc.Opts)
 		// If server does not support compression, then simply disable it in our side.
-		if !srvCompress {
+		if pmc == nil {
 			compress = false
-		} else if !noCtxTakeover {
-			err = fmt.Errorf("compression negotiation error")
 		}
 	}
 	if resp != nil {
 		resp.Body.Close()
 	}
-	nc.conn.SetReadDeadline(time.Time{})
+	conn.SetReadDeadline(time.Time{})
 	if err != nil {
 		return err
 	}
 
-	wsr := wsNewReader(nc.br.r)
+	wsr := wsNewReader(conn)
 	wsr.nc = nc
 	// We have to slurp whatever is in the bufio reader and copy to br.r
 	if n := br.Buffered(); n != 0 {
 		wsr.ib, _ = br.Peek(n)
 	}
-	nc.br.r = wsr
-	nc.bw.w = &websocketWriter{w: nc.bw.w, compress: compress}
-	nc.ws = true
+	if nc.cstats == nil {
+		nc.cstats = &CompressionStats{}
+	}
+	wsw := &websocketWriter{w: nc.newWriter(conn), compress: compress}
+	if compress {
+		wsr.stats, wsw.stats = nc.cstats, nc.cstats
+		wsw.noCtx = pmc.cliNoCtxTakeover || !nc.Opts.CompressionContextTakeover
+		if !pmc.srvNoCtxTakeover {
+			bits := wsPMCMaxWindowBits
+			if pmc.srvMaxWindowBits > 0 {
+				bits = pmc.srvMaxWindowBits
+			}
+			wsr.dc = &wsDecompressor{window: 1 << bits}
+		}
+	}
+	tc.Reader, tc.Writer = wsr, wsw
+	nc.wsProto = proto
 	return nil
 }
 
-func (nc *Conn) wsClose() {
-	nc.mu.Lock()
-	defer nc.mu.Unlock()
-	if !nc.ws {
-		return
+// wsAddUserHeaders adds the headers from the WebSocketHeaders option and
+// the WebSocketHeadersCB callback to the handshake request. The protocol
+// headers, "Upgrade", "Connection" and "Sec-WebSocket-*", are skipped so
+// that they can not be overridden. A "Host" header replaces the host of
+// the request.
+func (nc *Conn) wsAddUserHeaders(req *http.Request) error {
+	add := func(h http.Header) {
+		for k, vals := range h {
+			if wsProtocolHeader(k) {
+				continue
+			}
+			if strings.EqualFold(k, "Host") {
+				if len(vals) > 0 {
+					req.Host = vals[0]
+				}
+				continue
+			}
+			for _, v := range vals {
+				req.Header.Add(k, v)
+			}
+		}
+	}
+	add(nc.Opts.WebSocketHeaders)
+	if cb := nc.Opts.WebSocketHeadersCB; cb != nil {
+		h, err := cb()
+		if err != nil {
+			return err
+		}
+		add(h)
+	}
+	return nil
+}
+
+// wsProtocolHeader returns true if k, in any case, is a header of the
+// websocket handshake itself.
+func wsProtocolHeader(k string) bool {
+	const secPre = "Sec-WebSocket-"
+	return strings.EqualFold(k, "Upgrade") || strings.EqualFold(k, "Connection") ||
+		(len(k) >= len(secPre) && strings.EqualFold(k[:len(secPre)], secPre))
+}
+
+// wsSelectedProtocol returns the subprotocol selected by the server, which
+// must be one of the offered ones, or an empty string if none was selected.
+func wsSelectedProtocol(h http.Header, offered []string) (string, error) {
+	proto := h.Get("Sec-WebSocket-Protocol")
+	if proto == _EMPTY_ {
+		return _EMPTY_, nil
 	}
-	nc.wsEnqueueCloseMsgLocked(wsCloseStatusNormalClosure, _EMPTY_)
+	for _, p := range offered {
+		if p == proto {
+			return proto, nil
+		}
+	}
+	return _EMPTY_, fmt.Errorf("invalid websocket subprotocol %q", proto)
+}
+
+// WebSocketProtocol returns the websocket subprotocol selected by the
+// server during the handshake, or an empty string if none was selected
+// or this is not a websocket connection.
+func (nc *Conn) WebSocketProtocol() string {
+	if nc == nil {
+		return _EMPTY_
+	}
+	nc.mu.RLock()
+	defer nc.mu.RUnlock()
+	return nc.wsProto
+}
+
+// PrepareClose implements TransportCloser by queuing a close message.
+func (w *websocketWriter) PrepareClose() {
+	w.enqueueCloseMsg(wsCloseStatusNormalClosure, _EMPTY_)
 }
 
 func (nc *Conn) wsEnqueueCloseMsg(needsLock bool, status int, payload string) {
@@ -668,9 +800,18 @@ func (nc *Conn) wsEnqueueCloseMsg(needsLock bool, status int, payload string) {
 
 func (nc *Conn) wsEnqueueCloseMsgLocked(status int, payload string) {
 	wr, ok := nc.bw.w.(*websocketWriter)
-	if !ok || wr.cmDone {
+	if !ok || !wr.enqueueCloseMsg(status, payload) {
 		return
 	}
+	nc.bw.flush()
+}
+
+// enqueueCloseMsg queues the close message, to be written after the
+// pending data, unless a close message was already queued.
+func (wr *websocketWriter) enqueueCloseMsg(status int, payload string) bool {
+	if wr.cmDone {
+		return false
+	}
 	statusAndPayloadLen := 2 + len(payload)
 	frame := make([]byte, 2+4+statusAndPayloadLen)
 	n, key := wsFillFrameHeader(frame, false, wsCloseMessage, statusAndPayloadLen)
@@ -684,7 +825,7 @@ func (nc *Conn) wsEnqueueCloseMsgLocked(status int, payload string) {
 	wsMaskBuf(key, frame[n:n+statusAndPayloadLen])
 	wr.cm = frame
 	wr.cmDone = true
-	nc.bw.flush()
+	return true
 }
 
 func (nc *Conn) wsEnqueueControlMsg(needsLock bool, frameType wsOpCode, payload []byte) {
@@ -709,35 +850,62 @@ func (nc *Conn) wsEnqueueControlMsg(needsLock bool, frameType wsOpCode, payload
 	nc.bw.flush()
 }
 
-func wsPMCExtensionSupport(header http.Header) (bool, bool) {
+// wsPMCOffer returns the permessage-deflate extension offered to the server.
+// The client_max_window_bits parameter is not offered since the flate
+// package always uses the maximum window.
+func wsPMCOffer(o *Options) string {
+	offer := wsPMCReqHeaderValue
+	if o.CompressionContextTakeover {
+		offer = wsPMCExtension
+	}
+	if bits := o.CompressionServerMaxWindowBits; bits > 0 {
+		offer += fmt.Sprintf("; %s=%d", wsPMCSrvMaxWindow, bits)
+	}
+	return offer
+}
+
+// wsPMCNegotiate returns the permessage-deflate parameters accepted by the
+// server, or nil if it does not support compression. An error is returned
+// if the parameters are invalid or not compatible with the offer.
+func wsPMCNegotiate(header http.Header, o *Options) (*wsPMCParams, error) {
 	for _, extensionList := range header["Sec-Websocket-Extensions"] {
-		extensions := strings.Split(extensionList, ",")
-		for _, extension := range extensions {
-			extension = strings.Trim(extension, " \t")
+		for _, extension := range strings.Split(extensionList, ",") {
 			params := strings.Split(extension, ";")
-			for i, p := range params {
-				p = strings.Trim(p, " \t")
-				if strings.EqualFold(p, wsPMCExtension) {
-					var snc bool
-					var cnc bool
-					for j := i + 1; j < len(params); j++ {
-						p = params[j]
-						p = strings.Trim(p, " \t")
-						if strings.EqualFold(p, wsPMCSrvNoCtx) {
-							snc = true
-						} else if strings.EqualFold(p, wsPMCCliNoCtx) {
-							cnc = true
-						}
-						if snc && cnc {
-							return true, true
-						}
+			if !strings.EqualFold(strings.Trim(params[0], " \t"), wsPMCExtension) {
+				continue
+			}
+			pmc := &wsPMCParams{}
+			for _, p := range params[1:] {
+				name, value := strings.Trim(p, " \t"), _EMPTY_
+				if i := strings.IndexByte(name, '='); i >= 0 {
+					name, value = strings.TrimRight(name[:i], " \t"), strings.Trim(name[i+1:], " \t\"")
+				}
+				switch {
+				case strings.EqualFold(name, wsPMCSrvNoCtx) && value == _EMPTY_:
+					pmc.srvNoCtxTakeover = true
+				case strings.EqualFold(name, wsPMCCliNoCtx) && value == _EMPTY_:
+					pmc.cliNoCtxTakeover = true
+				case strings.EqualFold(name, wsPMCSrvMaxWindow):
+					bits, err := strconv.Atoi(value)
+					max := o.CompressionServerMaxWindowBits
+					if max == 0 {
+						max = wsPMCMaxWindowBits
+					}
+					if err != nil || bits < wsPMCMinWindowBits || bits > max {
+						return nil, fmt.Errorf("compression negotiation error: invalid %s %q", wsPMCSrvMaxWindow, value)
 					}
-					return true, false
+					pmc.srvMaxWindowBits = bits
+				default:
+					return nil, fmt.Errorf("compression negotiation error: unexpected parameter %q", strings.Trim(p, " \t"))
 				}
 			}
+			if !o.CompressionContextTakeover && !pmc.srvNoCtxTakeover {
+				return nil, fmt.Errorf("compression negotiation error")
+			}
+			return pmc, nil
 		}
 	}
-	return false, false
+	return nil, nil
 }
 
 func wsMakeChallengeKey() (string, error) {
@@ -759,7 +927,3 @@ func wsAcceptKey(key string) string {
 func wsIsControlFrame(frameType wsOpCode) bool {
 	return frameType >= wsCloseMessage
 }
-
-func isWebsocketScheme(u *url.URL) bool {
-	return u.Scheme == wsScheme || u.Scheme == wsSchemeTLS
-}
@@ -14,6 +14,7 @@
 package nats
 
 import (
+	"bufio"
 	"bytes"
 	"compress/flate"
 	"crypto/tls"
@@ -21,6 +22,8 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
+	"net/http"
 	"reflect"
 	"runtime"
 	"strings"
@@ -798,6 +801,209 @@ func TestWSCompressionWithContinuationFrames(t *testing.T) {
 	}
 }
 
+func TestWSCompressionStats(t *testing.T) {
+	sopts := testWSGetDefaultOptions(t, false)
+	sopts.Websocket.Compression = true
+	s := RunServerWithOptions(sopts)
+	defer s.Shutdown()
+
+	nc, err := Connect(fmt.Sprintf("ws://127.0.0.1:%d", sopts.Websocket.Port), Compression(true))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	sub, err := nc.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	msg := bytes.Repeat([]byte("compressible "), 100)
+	for i := 0; i < 10; i++ {
+		if err := nc.Publish("foo", msg); err != nil {
+			t.Fatalf("Error on publish: %v", err)
+		}
+		if _, err := sub.NextMsg(time.Second); err != nil {
+			t.Fatalf("Error getting next message: %v", err)
+		}
+	}
+	stats := nc.CompressionStats()
+	if stats.OutBytes < 10*uint64(len(msg)) || stats.InBytes < 10*uint64(len(msg)) {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+	if r := stats.OutRatio(); r < 5 {
+		t.Fatalf("Unexpected out ratio %v: %+v", r, stats)
+	}
+	if r := stats.InRatio(); r < 5 {
+		t.Fatalf("Unexpected in ratio %v: %+v", r, stats)
+	}
+
+	// No compression, no stats.
+	nc2, err := Connect(fmt.Sprintf("ws://127.0.0.1:%d", sopts.Websocket.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc2.Close()
+	nc2.Publish("foo", msg)
+	nc2.Flush()
+	if stats := nc2.CompressionStats(); stats != (CompressionStats{}) || stats.OutRatio() != 0 {
+		t.Fatalf("Unexpected stats: %+v", stats)
+	}
+}
+
+// testWSReadClientFrame returns the unmasked payload of a frame sent by
+// the websocketWriter.
+func testWSReadClientFrame(t *testing.T, r io.Reader) []byte {
+	t.Helper()
+	var hdr [8]byte
+	if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+		t.Fatalf("Error reading frame: %v", err)
+	}
+	l := int(hdr[1] & 0x7F)
+	switch l {
+	case 126:
+		io.ReadFull(r, hdr[:2])
+		l = int(binary.BigEndian.Uint16(hdr[:2]))
+	case 127:
+		io.ReadFull(r, hdr[:8])
+		l = int(binary.BigEndian.Uint64(hdr[:8]))
+	}
+	var key [4]byte
+	io.ReadFull(r, key[:])
+	p := make([]byte, l)
+	if _, err := io.ReadFull(r, p); err != nil {
+		t.Fatalf("Error reading frame: %v", err)
+	}
+	wsMaskBuf(key[:], p)
+	return p
+}
+
+func TestWSCompressionContextTakeover(t *testing.T) {
+	// The flate package does not look for matches in small writes, so
+	// use a few protocol lines, as would be flushed at once.
+	msg := bytes.Repeat([]byte("PUB foo.bar 40\r\n{\"id\":123,\"name\":\"some device\",\"ok\":true}\r\n"), 4)
+	for _, noCtx := range []bool{false, true} {
+		t.Run(fmt.Sprintf("no_ctx_%v", noCtx), func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			w := &websocketWriter{w: buf, compress: true, noCtx: noCtx, stats: &CompressionStats{}}
+			d := &wsDecompressor{}
+			if !noCtx {
+				d.window = 1 << wsPMCMaxWindowBits
+			}
+			var sizes []int
+			for i := 0; i < 5; i++ {
+				if _, err := w.Write(append([]byte(nil), msg...)); err != nil {
+					t.Fatalf("Error on write: %v", err)
+				}
+				p := testWSReadClientFrame(t, buf)
+				sizes = append(sizes, len(p))
+				d.addBuf(p)
+				b, err := d.decompress()
+				if err != nil {
+					t.Fatalf("Error decompressing message %d: %v", i, err)
+				}
+				if !bytes.Equal(b, msg) {
+					t.Fatalf("Unexpected message %d: %q", i, b)
+				}
+			}
+			// With context takeover, the messages after the first one are
+			// mostly references to it.
+			if noCtx && sizes[4] != sizes[0] || !noCtx && sizes[4] > sizes[0]/3 {
+				t.Fatalf("Unexpected compressed sizes: %v", sizes)
+			}
+			if w.stats.OutBytes != 5*uint64(len(msg)) {
+				t.Fatalf("Unexpected stats: %+v", w.stats)
+			}
+		})
+	}
+
+	// The reader keeps its own window, limited in size.
+	srbuf := &bytes.Buffer{}
+	cbuf := &bytes.Buffer{}
+	compressor, _ := flate.NewWriter(cbuf, flate.BestSpeed)
+	for i := 0; i < 3; i++ {
+		cbuf.Reset()
+		compressor.Write(msg)
+		compressor.Flush()
+		p := bytes.TrimSuffix(cbuf.Bytes(), compressSyncTail)
+		srbuf.Write([]byte{byte(wsBinaryMessage) | wsFinalBit | wsRsv1Bit, byte(len(p))})
+		srbuf.Write(p)
+	}
+	r := wsNewReader(srbuf)
+	r.dc = &wsDecompressor{window: 1 << wsPMCMinWindowBits}
+	r.stats = &CompressionStats{}
+	rbuf := make([]byte, 1024)
+	var got []byte
+	for len(got) < 3*len(msg) {
+		n, err := r.Read(rbuf)
+		if err != nil {
+			t.Fatalf("Error reading: %v", err)
+		}
+		got = append(got, rbuf[:n]...)
+	}
+	if !bytes.Equal(got, bytes.Repeat(msg, 3)) {
+		t.Fatalf("Unexpected data: %q", got)
+	}
+	if len(r.dc.dict) != 1<<wsPMCMinWindowBits {
+		t.Fatalf("Unexpected dictionary size: %v", len(r.dc.dict))
+	}
+	if r.stats.InBytes != 3*uint64(len(msg)) || r.stats.InRatio() <= 1 {
+		t.Fatalf("Unexpected stats: %+v", r.stats)
+	}
+}
+
+func TestWSPMCNegotiate(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		opts     Options
+		response string
+		pmc      *wsPMCParams
+		err      bool
+	}{
+		{"not supported", Options{}, _EMPTY_, nil, false},
+		{"other extension", Options{}, "x-webkit-deflate-frame", nil, false},
+		{"context takeover", Options{CompressionContextTakeover: true}, "permessage-deflate", &wsPMCParams{}, false},
+		{"no context takeover", Options{}, "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			&wsPMCParams{srvNoCtxTakeover: true, cliNoCtxTakeover: true}, false},
+		{"server window", Options{CompressionContextTakeover: true}, "permessage-deflate; server_max_window_bits=10", &wsPMCParams{srvMaxWindowBits: 10}, false},
+		{"server window quoted", Options{CompressionContextTakeover: true, CompressionServerMaxWindowBits: 12}, `permessage-deflate; server_max_window_bits="12"`,
+			&wsPMCParams{srvMaxWindowBits: 12}, false},
+		{"server window too big", Options{CompressionServerMaxWindowBits: 10}, "permessage-deflate; server_max_window_bits=12", nil, true},
+		{"server window invalid", Options{CompressionContextTakeover: true}, "permessage-deflate; server_max_window_bits=7", nil, true},
+		{"client window", Options{}, "permessage-deflate; client_max_window_bits=10", nil, true},
+		{"unknown parameter", Options{}, "permessage-deflate; foo", nil, true},
+		{"no context takeover required", Options{}, "permessage-deflate", nil, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			h := http.Header{}
+			if test.response != _EMPTY_ {
+				h.Set("Sec-WebSocket-Extensions", test.response)
+			}
+			pmc, err := wsPMCNegotiate(h, &test.opts)
+			if test.err != (err != nil) {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(pmc, test.pmc) {
+				t.Fatalf("Expected %+v, got %+v", test.pmc, pmc)
+			}
+		})
+	}
+
+	// Context takeover is only offered when asked for.
+	if offer := wsPMCOffer(&Options{}); offer != wsPMCReqHeaderValue {
+		t.Fatalf("Unexpected offer: %q", offer)
+	}
+	if offer := wsPMCOffer(&Options{CompressionContextTakeover: true}); offer != wsPMCExtension {
+		t.Fatalf("Unexpected offer: %q", offer)
+	}
+	opts := &Options{CompressionContextTakeover: true, CompressionServerMaxWindowBits: 10}
+	if offer := wsPMCOffer(opts); offer != "permessage-deflate; server_max_window_bits=10" {
+		t.Fatalf("Unexpected offer: %q", offer)
+	}
+	if _, err := Connect("ws://127.0.0.1:1234", CompressionServerMaxWindowBits(16)); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+}
+
 func TestWSWithTLS(t *testing.T) {
 	for _, test := range []struct {
 		name        string
@@ -939,7 +1145,7 @@ func TestWSGossipAndReconnect(t *testing.T) {
 
 	// Now check that connection is still WS
 	nc.mu.Lock()
-	isWS := nc.ws
+	_, isWS := nc.transport.(wsTransport)
 	_, ok := nc.bw.w.(*websocketWriter)
 	nc.mu.Unlock()
 
@@ -1108,3 +1314,207 @@ func TestWSNoDeadlockOnAuthFailure(t *testing.T) {
 
 	tm.Stop()
 }
+
+type testWSHandshakeProxy struct {
+	t     *testing.T
+	l     net.Listener
+	srv   string
+	proto string
+	reqs  chan *http.Request
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// newTestWSHandshakeProxy forwards websocket connections to the given server
+// address, reporting the handshake requests and optionally selecting
+// a subprotocol in the responses.
+func newTestWSHandshakeProxy(t *testing.T, srv, proto string) *testWSHandshakeProxy {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	p := &testWSHandshakeProxy{t: t, l: l, srv: srv, proto: proto, reqs: make(chan *http.Request, 10)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, c)
+			p.mu.Unlock()
+			go p.handle(c)
+		}
+	}()
+	return p
+}
+
+func (p *testWSHandshakeProxy) handle(c net.Conn) {
+	defer c.Close()
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	p.reqs <- req
+	sc, err := net.Dial("tcp", p.srv)
+	if err != nil {
+		return
+	}
+	defer sc.Close()
+	if err := req.Write(sc); err != nil {
+		return
+	}
+	sbr := bufio.NewReader(sc)
+	resp, err := http.ReadResponse(sbr, req)
+	if err != nil {
+		return
+	}
+	if p.proto != _EMPTY_ {
+		resp.Header.Set("Sec-WebSocket-Protocol", p.proto)
+	}
+	if err := resp.Write(c); err != nil {
+		return
+	}
+	go io.Copy(sc, br)
+	io.Copy(c, sbr)
+}
+
+func (p *testWSHandshakeProxy) closeConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		c.Close()
+	}
+	p.conns = nil
+}
+
+func (p *testWSHandshakeProxy) close() {
+	p.l.Close()
+	p.closeConns()
+}
+
+func (p *testWSHandshakeProxy) nextRequest() *http.Request {
+	p.t.Helper()
+	select {
+	case req := <-p.reqs:
+		return req
+	case <-time.After(2 * time.Second):
+		p.t.Fatal("Did not get the handshake request")
+	}
+	return nil
+}
+
+func TestWSHandshakePathHeadersAndProtocol(t *testing.T) {
+	sopts := testWSGetDefaultOptions(t, false)
+	s := RunServerWithOptions(sopts)
+	defer s.Shutdown()
+
+	p := newTestWSHandshakeProxy(t, fmt.Sprintf("127.0.0.1:%d", sopts.Websocket.Port), "nats")
+	defer p.close()
+
+	var attempts int32
+	rch := make(chan bool, 1)
+	nc, err := Connect(fmt.Sprintf("ws://%s/nats/ws?tenant=x", p.l.Addr()),
+		WebSocketHeaders(http.Header{
+			"Authorization": []string{"Bearer token"},
+			"Cookie":        []string{"session=abc"},
+			// Protocol headers can not be overridden.
+			"Upgrade":    []string{"foo"},
+			"connection": []string{"close"},
+		}),
+		CustomWebSocketHeaders(func() (http.Header, error) {
+			n := atomic.AddInt32(&attempts, 1)
+			return http.Header{
+				"X-Attempt":                []string{fmt.Sprint(n)},
+				"Sec-WebSocket-Key":        []string{"dGhlIHNhbXBsZSBub25jZQ=="},
+				"sec-websocket-version":    []string{"8"},
+				"Sec-Websocket-Extensions": []string{"permessage-deflate"},
+			}, nil
+		}),
+		WebSocketProtocols("nats", "other"),
+		ReconnectWait(50*time.Millisecond),
+		ReconnectHandler(func(_ *Conn) { rch <- true }))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	req := p.nextRequest()
+	if req.URL.Path != "/nats/ws" || req.URL.RawQuery != "tenant=x" {
+		t.Fatalf("Unexpected request URL: %v", req.URL)
+	}
+	for k, v := range map[string]string{
+		"Authorization":          "Bearer token",
+		"Cookie":                 "session=abc",
+		"X-Attempt":              "1",
+		"Upgrade":                "websocket",
+		"Connection":             "Upgrade",
+		"Sec-WebSocket-Version":  "13",
+		"Sec-WebSocket-Protocol": "nats, other",
+	} {
+		if got := req.Header.Values(k); len(got) != 1 || got[0] != v {
+			t.Fatalf("Expected header %q to be %q, got %q", k, v, got)
+		}
+	}
+	if got := req.Header.Values("Sec-WebSocket-Key"); len(got) != 1 || got[0] == "dGhlIHNhbXBsZSBub25jZQ==" {
+		t.Fatalf("Unexpected key headers: %q", got)
+	}
+	if got := req.Header.Values("Sec-WebSocket-Extensions"); len(got) != 0 {
+		t.Fatalf("Unexpected extensions headers: %q", got)
+	}
+	if proto := nc.WebSocketProtocol(); proto != "nats" {
+		t.Fatalf("Expected protocol %q, got %q", "nats", proto)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+
+	// The callback is invoked again on reconnect.
+	p.closeConns()
+	select {
+	case <-rch:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Did not reconnect")
+	}
+	req = p.nextRequest()
+	if v := req.Header.Get("X-Attempt"); v != "2" {
+		t.Fatalf("Expected refreshed header, got %q", v)
+	}
+	if req.URL.Path != "/nats/ws" || req.URL.RawQuery != "tenant=x" {
+		t.Fatalf("Unexpected request URL: %v", req.URL)
+	}
+}
+
+func TestWSHandshakeErrors(t *testing.T) {
+	sopts := testWSGetDefaultOptions(t, false)
+	s := RunServerWithOptions(sopts)
+	defer s.Shutdown()
+
+	srv := fmt.Sprintf("127.0.0.1:%d", sopts.Websocket.Port)
+
+	// The server selects a protocol that was not offered.
+	p := newTestWSHandshakeProxy(t, srv, "bad")
+	defer p.close()
+	url := fmt.Sprintf("ws://%s", p.l.Addr())
+	if _, err := Connect(url, WebSocketProtocols("nats")); err == nil || !strings.Contains(err.Error(), "subprotocol") {
+		t.Fatalf("Expected subprotocol error, got %v", err)
+	}
+	if _, err := Connect(url); err == nil || !strings.Contains(err.Error(), "subprotocol") {
+		t.Fatalf("Expected subprotocol error, got %v", err)
+	}
+
+	// Errors from the callback fail the connection.
+	cbErr := fmt.Errorf("no credentials")
+	_, err := Connect(fmt.Sprintf("ws://%s", srv), CustomWebSocketHeaders(func() (http.Header, error) {
+		return nil, cbErr
+	}))
+	if err != cbErr {
+		t.Fatalf("Expected %v, got %v", cbErr, err)
+	}
+
+	if _, err := Connect(fmt.Sprintf("ws://%s", srv), WebSocketProtocols("a b")); err != ErrInvalidArg {
+		t.Fatalf("Expected %v, got %v", ErrInvalidArg, err)
+	}
+}